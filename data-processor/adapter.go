@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// objectEvent is the internal representation of an object which arrived in or was removed from a bucket,
+// independent of whether the notification was delivered by S3 directly, by EventBridge or wrapped in an SNS message.
+type objectEvent struct {
+	Bucket    string
+	Key       string
+	Removed   bool
+	VersionID string
+	ETag      string
+	Size      int64
+}
+
+// notification contains the fields needed to tell the supported event shapes apart.
+type notification struct {
+	// S3 and SNS notifications
+	Records []struct {
+		EventName string            `json:"eventName"`
+		S3        *events.S3Entity  `json:"s3"`
+		Sns       *events.SNSEntity `json:"Sns"`
+	} `json:"Records"`
+
+	// EventBridge events
+	Source     string          `json:"source"`
+	DetailType string          `json:"detail-type"`
+	Detail     json.RawMessage `json:"detail"`
+
+	// S3 test events sent when a notification gets configured
+	Event string `json:"Event"`
+}
+
+// eventBridgeDetail is the detail of an EventBridge "Object Created" or "Object Deleted" event.
+type eventBridgeDetail struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key       string `json:"key"`
+		Size      int64  `json:"size"`
+		ETag      string `json:"etag"`
+		VersionID string `json:"version-id"`
+	} `json:"object"`
+}
+
+// parseObjectEvents detects the shape of an event payload and normalises it into objectEvents. S3 test events yield
+// no objects.
+func parseObjectEvents(payload []byte) ([]objectEvent, error) {
+	var n notification
+	err := json.Unmarshal(payload, &n)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal event: %w", err)
+	}
+
+	switch {
+	case n.Event == "s3:TestEvent":
+		return nil, nil
+	case n.Source == "aws.s3":
+		return parseEventBridgeEvent(n)
+	case len(n.Records) > 0:
+		var objects []objectEvent
+		for _, record := range n.Records {
+			switch {
+			case record.S3 != nil:
+				// S3 notifications contain URL-encoded keys, e.g. with spaces encoded as "+".
+				objects = append(objects, objectEvent{
+					Bucket:    record.S3.Bucket.Name,
+					Key:       record.S3.Object.URLDecodedKey,
+					Removed:   strings.HasPrefix(record.EventName, "ObjectRemoved:"),
+					VersionID: record.S3.Object.VersionID,
+					ETag:      record.S3.Object.ETag,
+					Size:      record.S3.Object.Size,
+				})
+			case record.Sns != nil:
+				// The SNS message carries the original S3 (or EventBridge) event as a JSON string.
+				wrapped, err := parseObjectEvents([]byte(record.Sns.Message))
+				if err != nil {
+					return nil, fmt.Errorf("couldn't parse SNS message %s: %w", record.Sns.MessageID, err)
+				}
+				objects = append(objects, wrapped...)
+			default:
+				return nil, fmt.Errorf("unsupported event record")
+			}
+		}
+		return objects, nil
+	}
+
+	return nil, fmt.Errorf("unsupported event")
+}
+
+func parseEventBridgeEvent(n notification) ([]objectEvent, error) {
+	if n.DetailType != "Object Created" && n.DetailType != "Object Deleted" {
+		return nil, fmt.Errorf("unsupported EventBridge event %q", n.DetailType)
+	}
+
+	var detail eventBridgeDetail
+	err := json.Unmarshal(n.Detail, &detail)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal EventBridge event detail: %w", err)
+	}
+
+	return []objectEvent{
+		{
+			Bucket:    detail.Bucket.Name,
+			Key:       detail.Object.Key,
+			Removed:   n.DetailType == "Object Deleted",
+			VersionID: detail.Object.VersionID,
+			ETag:      detail.Object.ETag,
+			Size:      detail.Object.Size,
+		},
+	}, nil
+}
+
+// scheduledEvent reports whether the payload is an EventBridge scheduled event.
+func scheduledEvent(payload []byte) bool {
+	var n notification
+	err := json.Unmarshal(payload, &n)
+	return err == nil && n.Source == "aws.events" && n.DetailType == "Scheduled Event"
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+	"github.com/joidegn/scalable-capital/data-processor/processor"
+)
+
+// batchObject registers an object with the batch of its business date and loads the batch once it is complete.
+func (h handler) batchObject(object objectEvent, businessDate string, fileType string) []RecordResult {
+	release, err := h.batches.Arrive(businessDate, data.BatchFile{
+		FileType:  fileType,
+		Bucket:    object.Bucket,
+		Key:       object.Key,
+		VersionID: object.VersionID,
+		ETag:      object.ETag,
+	})
+	if err != nil {
+		log.Printf("Error adding object to batch %s: %s", businessDate, err)
+		return []RecordResult{{Bucket: object.Bucket, Key: object.Key, FileType: fileType, Status: statusFailed, Error: err.Error()}}
+	}
+	if release == nil {
+		return []RecordResult{{Bucket: object.Bucket, Key: object.Key, FileType: fileType, Status: statusDeferred}}
+	}
+	return h.loadRelease(*release)
+}
+
+// sweepBatches loads the batches whose cutoff has passed, even though files are missing.
+func (h handler) sweepBatches() Report {
+	var report Report
+	releases, err := h.batches.Due()
+	if err != nil {
+		log.Printf("Error finding batches past their cutoff: %s", err)
+		h.d.SendErrorEvent(err)
+	}
+	for _, release := range releases {
+		report.add(h.loadRelease(release)...)
+	}
+	log.Printf("Swept %d batches past their cutoff", len(releases))
+	return report
+}
+
+// loadRelease processes the released files of a batch in load order and finishes the batch.
+func (h handler) loadRelease(release processor.Release) []RecordResult {
+	if len(release.Missing) > 0 {
+		// The log message is matched by a metric filter alerting on incomplete batches.
+		log.Printf("Incomplete batch %s: missing %v", release.BusinessDate, release.Missing)
+		h.d.SendErrorEvent(fmt.Errorf("incomplete batch %s: missing %v", release.BusinessDate, release.Missing))
+	}
+
+	var results []RecordResult
+	deferred := false
+	for _, file := range release.Files {
+		fileResults := h.processObject(objectEvent{
+			Bucket:    file.Bucket,
+			Key:       file.Key,
+			VersionID: file.VersionID,
+			ETag:      file.ETag,
+		})
+		for _, result := range fileResults {
+			deferred = deferred || result.Status == statusDeferred
+		}
+		results = append(results, fileResults...)
+	}
+
+	// A batch with deferred files stays pending until they can be loaded.
+	if deferred {
+		log.Printf("Reopening batch %s with deferred files", release.BusinessDate)
+		err := h.batches.Reopen(release)
+		if err != nil {
+			log.Printf("Error reopening batch %s: %s", release.BusinessDate, err)
+		}
+		return results
+	}
+	err := h.batches.Finish(release)
+	if err != nil {
+		log.Printf("Error finishing batch %s: %s", release.BusinessDate, err)
+	}
+	return results
+}
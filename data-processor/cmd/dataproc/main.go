@@ -0,0 +1,272 @@
+// Command dataproc runs the data processing pipeline on local files, without Lambda or S3.
+//
+// Usage:
+//
+//	dataproc [-backend memory|dynamodb] [-table name] [-rules file] [-sheet name]
+//		[-unknown-keywords reject|accept] [-identifiers json] [-rounding mode] path...
+//
+// Every path is either a file or a directory whose files are processed. Files are routed to a processor by matching
+// their path against the routing rules, the same way the lambda routes object keys, and processed in the load order of
+// their file types, e.g. clients before the portfolios referencing them. Compressed files (gzip, bzip2,
+// zstd) are decompressed and the entries of zip archives are processed individually. Control files (.ctl) are not
+// processed themselves, they provide the control totals of the file next to them, or of the entry of the same archive,
+// named like them without the suffix. dataproc exits with status 1 if any file fails to process.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/joidegn/scalable-capital/data-processor/data"
+	"github.com/joidegn/scalable-capital/data-processor/processor"
+)
+
+type fileResult struct {
+	path     string
+	fileType string
+	counts   processor.Counts
+	err      error
+}
+
+func main() {
+	backend := flag.String("backend", "memory", "where to store the records: memory or dynamodb")
+	tableName := flag.String("table", os.Getenv("DYNAMODB_TABLE_NAME"), "DynamoDB table name for the dynamodb backend")
+	rulesPath := flag.String("rules", os.Getenv("ROUTING_RULES"), "JSON file with routing rules, defaults to the built-in rules")
+	sheet := flag.String("sheet", "", "sheet to read from XLSX workbooks, defaults to the sheet of the routing rule or the first one")
+	unknownKeywords := flag.String("unknown-keywords", os.Getenv("UNKNOWN_KEYWORDS"), "reject or accept transactions whose keyword isn't a known transaction type")
+	identifiers := flag.String("identifiers", os.Getenv("IDENTIFIER_VALIDATORS"), `validators of identifier columns as JSON, e.g. {"account_number": "luhn"}`)
+	rounding := flag.String("rounding", os.Getenv("ROUNDING"), "rounding mode of amounts rounded implicitly, e.g. half-up, defaults to half-even")
+	verbose := flag.Bool("v", false, "log the progress of the pipeline")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: dataproc [-backend memory|dynamodb] [-table name] [-rules file] [-sheet name] [-unknown-keywords reject|accept] [-identifiers json] [-rounding mode] path...")
+		os.Exit(2)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	validator := data.NewValidator()
+	err := validator.SetUnknownKeywords(*unknownKeywords)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dataproc: %v\n", err)
+		os.Exit(2)
+	}
+	err = validator.ConfigureIdentifiers(*identifiers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dataproc: %v\n", err)
+		os.Exit(2)
+	}
+	err = data.SetDefaultRounding(*rounding)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dataproc: %v\n", err)
+		os.Exit(2)
+	}
+	store, err := newStore(*backend, *tableName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dataproc: %v\n", err)
+		os.Exit(2)
+	}
+	p := processor.NewProcessor(store, validator)
+	router, err := processor.LoadRouter(*rulesPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dataproc: %v\n", err)
+		os.Exit(2)
+	}
+
+	paths, err := collectFiles(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dataproc: %v\n", err)
+		os.Exit(2)
+	}
+
+	var results []fileResult
+	for _, path := range sortByLoadOrder(router, paths) {
+		results = append(results, processFile(p, router, path, *sheet)...)
+	}
+
+	if !printSummary(os.Stdout, results) {
+		os.Exit(1)
+	}
+}
+
+func newStore(backend string, tableName string) (data.Store, error) {
+	switch backend {
+	case "memory":
+		return data.NewMemoryStore(), nil
+	case "dynamodb":
+		if tableName == "" {
+			return nil, fmt.Errorf("the dynamodb backend needs a table name")
+		}
+		cfg, err := config.LoadDefaultConfig(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("unable to load SDK config: %w", err)
+		}
+		return data.NewDataManager(nil, dynamodb.NewFromConfig(cfg), tableName), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", backend)
+}
+
+// collectFiles expands directories into the files they contain. Files are returned in lexical order per argument.
+func collectFiles(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(arg, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+		paths = append(paths, files...)
+	}
+	return paths, nil
+}
+
+// sortByLoadOrder orders files by the load order of the file types they are routed to. Files of the same type keep
+// their order, files which aren't routed, e.g. archives, come last.
+func sortByLoadOrder(router *processor.Router, paths []string) []string {
+	routes := make([]processor.Route, len(paths))
+	for i, path := range paths {
+		routes[i], _ = router.Route("", processor.DecompressedName(filepath.ToSlash(path)))
+	}
+	sorted := make([]string, len(paths))
+	for i, j := range processor.SortByLoadOrder(routes) {
+		sorted[i] = paths[j]
+	}
+	return sorted
+}
+
+// processFile processes a file, or each entry of an archive in load order. Compressed files are decompressed first. A
+// sheet overrides the sheet of the routing rules for XLSX workbooks. Control files are skipped.
+func processFile(p *processor.Processor, router *processor.Router, path string, sheet string) []fileResult {
+	if processor.IsControlFile(path) {
+		return nil
+	}
+	input, err := os.Open(path)
+	if err != nil {
+		return []fileResult{{path: path, err: err}}
+	}
+	defer input.Close()
+
+	files, cleanup, err := processor.Expand(filepath.ToSlash(path), input)
+	defer cleanup()
+	if err != nil {
+		return []fileResult{{path: path, err: err}}
+	}
+
+	var results []fileResult
+	var routed []processor.File
+	var routes []processor.Route
+	for _, file := range files {
+		if processor.IsControlFile(file.Name) {
+			continue
+		}
+		route, err := router.Route("", file.Name)
+		if err == nil && route.Controls == processor.ControlsSidecar {
+			route.ControlTotals, err = controlTotals(path, files, file)
+		}
+		if err != nil {
+			results = append(results, fileResult{path: entryPath(path, file), err: err})
+			continue
+		}
+		route.Key = filepath.ToSlash(path)
+		if processor.IsArchive(path) {
+			route.Entry = file.Name
+		}
+		if route.Format == "" {
+			route.Format = processor.DetectFormat(file.Name, "")
+		}
+		if sheet != "" {
+			route.Sheet = sheet
+		}
+		routed = append(routed, file)
+		routes = append(routes, route)
+	}
+
+	for _, i := range processor.SortByLoadOrder(routes) {
+		result := fileResult{
+			path:     entryPath(path, routed[i]),
+			fileType: routes[i].FileType,
+		}
+		result.counts, result.err = processEntry(p, routes[i], routed[i])
+		results = append(results, result)
+	}
+	return results
+}
+
+// controlTotals reads the control totals of a file from the control file next to it or, for an entry of an archive,
+// from the entry of the same archive. It returns nil if there is no control file.
+func controlTotals(path string, files []processor.File, file processor.File) (*data.ControlTotals, error) {
+	if processor.IsArchive(path) {
+		return processor.SidecarControls(files, file.Name)
+	}
+	r, err := os.Open(processor.ControlFileName(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return data.ParseControlFile(r)
+}
+
+func processEntry(p *processor.Processor, route processor.Route, file processor.File) (processor.Counts, error) {
+	r, err := file.Open()
+	if err != nil {
+		return processor.Counts{}, err
+	}
+	defer r.Close()
+	return p.ProcessFile(route, r, nil)
+}
+
+// entryPath names an archive entry after the archive it was found in.
+func entryPath(path string, file processor.File) string {
+	if !processor.IsArchive(path) {
+		return path
+	}
+	return path + ":" + file.Name
+}
+
+// printSummary writes one line per file and reports whether all files were processed successfully.
+func printSummary(out io.Writer, results []fileResult) bool {
+	ok := true
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tTYPE\tSTATUS\tPARSED\tINSERTED\tINVALID\tERROR")
+	for _, result := range results {
+		status, errMsg := "processed", ""
+		if result.err != nil {
+			ok = false
+			status, errMsg = "failed", result.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", result.path, result.fileType, status, result.counts.Parsed, result.counts.Inserted, result.counts.Invalid, errMsg)
+	}
+	w.Flush()
+	return ok
+}
@@ -0,0 +1,288 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// batchPrefix distinguishes batches from data items in the table: batch#<business date>.
+const batchPrefix = "batch#"
+
+// Batch statuses
+const (
+	BatchOpen       = "open"       // waiting for files
+	BatchProcessing = "processing" // claimed by a processor until its lease expires
+	BatchProcessed  = "processed"  // all files have been processed
+	BatchIncomplete = "incomplete" // processed after the cutoff with files missing
+)
+
+// BatchFile is a file which arrived for a batch.
+type BatchFile struct {
+	FileType  string    `dynamodbav:"file_type"`
+	Bucket    string    `dynamodbav:"bucket"`
+	Key       string    `dynamodbav:"key"`
+	VersionID string    `dynamodbav:"version_id"`
+	ETag      string    `dynamodbav:"etag"`
+	ArrivedAt time.Time `dynamodbav:"arrived_at"`
+}
+
+// Batch collects the files of one business date.
+type Batch struct {
+	BusinessDate string
+	Status       string
+	OpenedAt     time.Time
+	// LeaseUntil is when the claim of the processor loading the batch expires, so that another processor can load it
+	// if the first one never finishes, e.g. because the lambda timed out.
+	LeaseUntil time.Time
+	Files      map[string][]BatchFile // by file type, one per key in the order they arrived
+}
+
+// addFile adds a file to the files of its type, replacing an earlier version of the same key.
+func (b *Batch) addFile(file BatchFile) {
+	files := b.Files[file.FileType]
+	for i, f := range files {
+		if f.Key == file.Key {
+			files[i] = file
+			return
+		}
+	}
+	b.Files[file.FileType] = append(files, file)
+}
+
+func batchKey(businessDate string) map[string]types.AttributeValue {
+	return objectKey(batchPrefix + businessDate)
+}
+
+// AddBatchFile registers a file with the batch of its business date, opening the batch if necessary, and returns the
+// updated batch. Every key is an attribute of its own, file_<file type>#<key>, so that files of the same type don't
+// replace each other.
+func (d DataManager) AddBatchFile(businessDate string, file BatchFile) (*Batch, error) {
+	marshalled, err := attributevalue.Marshal(file)
+	if err != nil {
+		log.Printf("Couldn't marshal batch file: %v. Error: %v\n", file, err)
+		return nil, err
+	}
+
+	result, err := d.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.tableName),
+		Key:              batchKey(businessDate),
+		UpdateExpression: aws.String("SET #file = :file, business_date = :business_date, opened_at = if_not_exists(opened_at, :now), #status = if_not_exists(#status, :open)"),
+		ExpressionAttributeNames: map[string]string{
+			"#file":   "file_" + file.FileType + "#" + file.Key,
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":file":          marshalled,
+			":business_date": &types.AttributeValueMemberS{Value: businessDate},
+			":now":           &types.AttributeValueMemberS{Value: file.ArrivedAt.UTC().Format(time.RFC3339)},
+			":open":          &types.AttributeValueMemberS{Value: BatchOpen},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		log.Printf("Couldn't add %v to batch %v. Error: %v\n", file.Key, businessDate, err)
+		return nil, err
+	}
+	return unmarshalBatch(result.Attributes)
+}
+
+// PendingBatches returns the batches which are still waiting for files or being processed.
+func (d DataManager) PendingBatches() ([]Batch, error) {
+	var batches []Batch
+	paginator := dynamodb.NewScanPaginator(d.db, &dynamodb.ScanInput{
+		TableName:        aws.String(d.tableName),
+		FilterExpression: aws.String("begins_with(object_reference, :prefix) AND #status IN (:open, :processing)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix":     &types.AttributeValueMemberS{Value: batchPrefix},
+			":open":       &types.AttributeValueMemberS{Value: BatchOpen},
+			":processing": &types.AttributeValueMemberS{Value: BatchProcessing},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			log.Printf("Couldn't scan for pending batches. Error: %v\n", err)
+			return nil, err
+		}
+		for _, item := range page.Items {
+			batch, err := unmarshalBatch(item)
+			if err != nil {
+				return nil, err
+			}
+			batches = append(batches, *batch)
+		}
+	}
+	return batches, nil
+}
+
+// ClaimBatch claims a batch for processing until the lease expires and reports whether it could be claimed. Open batches
+// can be claimed, and batches being processed whose lease has expired at the given time.
+func (d DataManager) ClaimBatch(businessDate string, now time.Time, leaseUntil time.Time) (bool, error) {
+	_, err := d.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.tableName),
+		Key:                 batchKey(businessDate),
+		UpdateExpression:    aws.String("SET #status = :processing, lease_until = :lease_until"),
+		ConditionExpression: aws.String("#status = :open OR (#status = :processing AND lease_until < :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":open":        &types.AttributeValueMemberS{Value: BatchOpen},
+			":processing":  &types.AttributeValueMemberS{Value: BatchProcessing},
+			":now":         &types.AttributeValueMemberS{Value: now.UTC().Format(time.RFC3339)},
+			":lease_until": &types.AttributeValueMemberS{Value: leaseUntil.UTC().Format(time.RFC3339)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Couldn't claim batch %v. Error: %v\n", businessDate, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// SetBatchStatus moves a batch from one status to another and reports whether the batch had the expected status.
+// Claiming a batch this way makes sure that only one processor loads it.
+func (d DataManager) SetBatchStatus(businessDate string, from string, to string) (bool, error) {
+	_, err := d.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.tableName),
+		Key:                 batchKey(businessDate),
+		UpdateExpression:    aws.String("SET #status = :to"),
+		ConditionExpression: aws.String("#status = :from"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":from": &types.AttributeValueMemberS{Value: from},
+			":to":   &types.AttributeValueMemberS{Value: to},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Couldn't set status of batch %v to %v. Error: %v\n", businessDate, to, err)
+		return false, err
+	}
+	return true, nil
+}
+
+func unmarshalBatch(item map[string]types.AttributeValue) (*Batch, error) {
+	var attributes struct {
+		BusinessDate string    `dynamodbav:"business_date"`
+		Status       string    `dynamodbav:"status"`
+		OpenedAt     time.Time `dynamodbav:"opened_at"`
+		LeaseUntil   time.Time `dynamodbav:"lease_until"`
+	}
+	err := attributevalue.UnmarshalMap(item, &attributes)
+	if err != nil {
+		log.Printf("Couldn't unmarshal batch: %v. Error: %v\n", item, err)
+		return nil, err
+	}
+
+	batch := &Batch{
+		BusinessDate: attributes.BusinessDate,
+		Status:       attributes.Status,
+		OpenedAt:     attributes.OpenedAt,
+		LeaseUntil:   attributes.LeaseUntil,
+		Files:        map[string][]BatchFile{},
+	}
+	for name, value := range item {
+		if !strings.HasPrefix(name, "file_") {
+			continue
+		}
+		var file BatchFile
+		err = attributevalue.Unmarshal(value, &file)
+		if err != nil {
+			log.Printf("Couldn't unmarshal batch file: %v. Error: %v\n", value, err)
+			return nil, err
+		}
+		batch.Files[file.FileType] = append(batch.Files[file.FileType], file)
+	}
+	for _, files := range batch.Files {
+		sort.Slice(files, func(i, j int) bool {
+			if !files[i].ArrivedAt.Equal(files[j].ArrivedAt) {
+				return files[i].ArrivedAt.Before(files[j].ArrivedAt)
+			}
+			return files[i].Key < files[j].Key
+		})
+	}
+	return batch, nil
+}
+
+func (m *MemoryStore) AddBatchFile(businessDate string, file BatchFile) (*Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch, ok := m.batches[businessDate]
+	if !ok {
+		batch = &Batch{
+			BusinessDate: businessDate,
+			Status:       BatchOpen,
+			OpenedAt:     file.ArrivedAt,
+			Files:        map[string][]BatchFile{},
+		}
+		m.batches[businessDate] = batch
+	}
+	batch.addFile(file)
+	return copyBatch(batch), nil
+}
+
+func (m *MemoryStore) PendingBatches() ([]Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var batches []Batch
+	for _, batch := range m.batches {
+		if batch.Status == BatchOpen || batch.Status == BatchProcessing {
+			batches = append(batches, *copyBatch(batch))
+		}
+	}
+	return batches, nil
+}
+
+func (m *MemoryStore) ClaimBatch(businessDate string, now time.Time, leaseUntil time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch, ok := m.batches[businessDate]
+	if !ok || !(batch.Status == BatchOpen || batch.Status == BatchProcessing && batch.LeaseUntil.Before(now)) {
+		return false, nil
+	}
+	batch.Status = BatchProcessing
+	batch.LeaseUntil = leaseUntil
+	return true, nil
+}
+
+func (m *MemoryStore) SetBatchStatus(businessDate string, from string, to string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch, ok := m.batches[businessDate]
+	if !ok || batch.Status != from {
+		return false, nil
+	}
+	batch.Status = to
+	return true, nil
+}
+
+func copyBatch(batch *Batch) *Batch {
+	copied := *batch
+	copied.Files = map[string][]BatchFile{}
+	for fileType, files := range batch.Files {
+		copied.Files[fileType] = append([]BatchFile(nil), files...)
+	}
+	return &copied
+}
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TrailerMarker starts the trailer row upstream can append to a CSV file: TRAILER,<rows>,<hash total>, separated by
+// the delimiter of the file.
+const TrailerMarker = "TRAILER"
+
+// HashColumns names the column of every file type whose values add up to the hash total of a file.
+var HashColumns = map[string]string{
+	"clients":      "tax_free_allowance",
+	"portfolios":   "account_number",
+	"accounts":     "cash_balance",
+	"transactions": "amount",
+	"fxrates":      "rate",
+}
+
+// ControlTotals sum up the content of a file, so that a file which has been truncated or partially uploaded can be
+// told apart from a complete one: the number of data rows, without header and trailer, and the sum of the values of
+// the hash column of the file type.
+type ControlTotals struct {
+	Rows      int     `json:"rows"`
+	HashTotal Decimal `json:"hash_total"`
+}
+
+func (c ControlTotals) String() string {
+	return fmt.Sprintf("%d rows with hash total %s", c.Rows, c.HashTotal)
+}
+
+// Matches reports whether the totals are the same.
+func (c ControlTotals) Matches(other ControlTotals) bool {
+	return c.Rows == other.Rows && c.HashTotal.Cmp(other.HashTotal) == 0
+}
+
+// add counts a data row and adds the value of the hash column, written in the dialect, to the hash total. Values which
+// aren't numbers are left out, their rows are invalid anyway.
+func (c *ControlTotals) add(row []string, hashColumn int, dialect Dialect) {
+	c.Rows++
+	if hashColumn < 0 || hashColumn >= len(row) {
+		return
+	}
+	number, err := dialect.DecimalPoint(strings.TrimSpace(row[hashColumn]))
+	if err != nil {
+		return
+	}
+	value, err := ParseDecimal(number)
+	if err == nil {
+		c.HashTotal = c.HashTotal.Add(value)
+	}
+}
+
+// ControlError reports a file which doesn't match its control totals, or which lacks the control totals it is
+// expected to have.
+type ControlError struct {
+	Source   string         // where the expected totals come from: the trailer or the control file
+	Expected *ControlTotals // nil if the source is missing
+	Read     ControlTotals
+}
+
+func (e *ControlError) Error() string {
+	if e.Expected == nil {
+		return fmt.Sprintf("no %s with control totals, read %s", e.Source, e.Read)
+	}
+	return fmt.Sprintf("file doesn't match the control totals of its %s: read %s instead of %s", e.Source, e.Read, e.Expected)
+}
+
+// VerifyControls checks the totals read from a file against the expected totals of a source. It returns a
+// *ControlError if they differ or if expected is nil.
+func VerifyControls(source string, expected *ControlTotals, read ControlTotals) error {
+	if expected == nil || !expected.Matches(read) {
+		return &ControlError{Source: source, Expected: expected, Read: read}
+	}
+	return nil
+}
+
+// isTrailer reports whether a row is a trailer row.
+func isTrailer(row []string) bool {
+	return len(row) > 0 && strings.EqualFold(strings.TrimSpace(row[0]), TrailerMarker)
+}
+
+// parseTrailer returns the control totals of a trailer row, whose hash total is written in the dialect.
+func parseTrailer(line int, row []string, dialect Dialect) (*ControlTotals, error) {
+	if len(row) != 3 {
+		return nil, fmt.Errorf("trailer row at line %d has %d columns instead of 3: %s, rows and hash total", line, len(row), TrailerMarker)
+	}
+	hashTotal, err := dialect.DecimalPoint(strings.TrimSpace(row[2]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash total %q in control totals", row[2])
+	}
+	return parseControlTotals(row[1], hashTotal)
+}
+
+// ParseControlFile reads the control totals of a control file, which is shipped next to a file under its name with
+// ".ctl" appended. It holds one key=value pair per line, rows and hash_total, and may have blank lines and comments
+// starting with #.
+func ParseControlFile(r io.Reader) (*ControlTotals, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key != "rows" && key != "hash_total" {
+			return nil, fmt.Errorf("control file line %d: expected rows=<count> or hash_total=<sum>, got %q", line, text)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read control file: %w", err)
+	}
+	for _, key := range []string{"rows", "hash_total"} {
+		if _, ok := values[key]; !ok {
+			return nil, fmt.Errorf("control file has no %s", key)
+		}
+	}
+	return parseControlTotals(values["rows"], values["hash_total"])
+}
+
+func parseControlTotals(rows string, hashTotal string) (*ControlTotals, error) {
+	count, err := strconv.Atoi(strings.TrimSpace(rows))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid row count %q in control totals", rows)
+	}
+	total, err := ParseDecimal(strings.TrimSpace(hashTotal))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash total %q in control totals", hashTotal)
+	}
+	return &ControlTotals{Rows: count, HashTotal: total}, nil
+}
+
+// ReadControls reads a CSV file of a file type written in the dialect without decoding its rows and returns the
+// control totals of what has been read, and the control totals of the trailer row, if the file has one.
+func ReadControls(r io.Reader, fileType string, dialect Dialect) (ControlTotals, *ControlTotals, error) {
+	rows := &csvRows[struct{}]{fileType: fileType, r: r, dialect: dialect}
+	for {
+		_, _, err := rows.next()
+		if errors.Is(err, io.EOF) {
+			return rows.totals, rows.trailer, nil
+		}
+		if err != nil {
+			return rows.totals, rows.trailer, err
+		}
+	}
+}
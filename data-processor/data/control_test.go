@@ -0,0 +1,62 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseControlFile(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+		wantErr bool
+	}{
+		{content: "rows=2\nhash_total=1600.50\n", want: "2 rows with hash total 1600.50"},
+		{content: "# accounts_20230826.csv\n\nROWS = 0\nhash_total = 0\n", want: "0 rows with hash total 0"},
+		{content: "rows=2\n", wantErr: true},
+		{content: "rows=two\nhash_total=1\n", wantErr: true},
+		{content: "rows=2\nhash_total=1\nchecksum=abc\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseControlFile(strings.NewReader(tt.content))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseControlFile(%q) error = %v, want error %v", tt.content, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ParseControlFile(%q) = %s, want %s", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestParseCSVTrailer(t *testing.T) {
+	header := "record_id,account_number,cash_balance,currency,taxes_paid\n"
+	rows := "1,1001,1000.00,EUR,5.00\n2,1002,600.50,EUR,0.00\n"
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		control bool // the error is a *ControlError
+		wantErr bool
+	}{
+		{name: "no trailer", content: header + rows, want: 2},
+		{name: "trailer", content: header + rows + "TRAILER,2,1600.50\n", want: 2},
+		{name: "truncated", content: header + rows[:24] + "TRAILER,2,1600.50\n", control: true, wantErr: true},
+		{name: "wrong hash total", content: header + rows + "trailer,2,1600.00\n", control: true, wantErr: true},
+		{name: "not last", content: header + "TRAILER,0,0\n" + rows, wantErr: true},
+		{name: "malformed", content: header + rows + "TRAILER,2\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAccountCSV([]byte(tt.content))
+			var controlErr *ControlError
+			if (err != nil) != tt.wantErr || errors.As(err, &controlErr) != tt.control {
+				t.Fatalf("ParseAccountCSV() error = %v, want error %v and control error %v", err, tt.wantErr, tt.control)
+			}
+			if err == nil && len(got) != tt.want {
+				t.Errorf("ParseAccountCSV() returned %d accounts, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrNoFXRate is returned when there is no exchange rate to convert an amount with.
+var ErrNoFXRate = errors.New("no FX rate")
+
+// fxRateLookback is the number of days before a business date in which a rate is looked for, so that amounts can be
+// converted on weekends and holidays, when no rates are published.
+const fxRateLookback = 7
+
+// Converter converts amounts into a base currency at the exchange rates valid on a business date: the rates published
+// on that date or, failing that, on the closest day up to a week before. Rates quoted the other way around, i.e. of the
+// base currency in the currency of the amount, are used as well. Converted amounts are rounded once, to the minor unit
+// of the base currency.
+type Converter struct {
+	Rates    RateSource
+	Base     string
+	Rounding RoundingMode
+}
+
+// NewConverter returns a converter into a base currency, rounding with DefaultRounding.
+func NewConverter(rates RateSource, base string) (Converter, error) {
+	if !KnownCurrency(base) {
+		return Converter{}, fmt.Errorf("unknown base currency %q", base)
+	}
+	return Converter{Rates: rates, Base: base, Rounding: DefaultRounding}, nil
+}
+
+// Convert returns an amount in the base currency. Amounts in the base currency are returned as they are.
+func (c Converter) Convert(amount Money, businessDate string) (Money, error) {
+	currency := amount.Currency()
+	if currency == c.Base {
+		return amount, nil
+	}
+	if currency == "" {
+		return Money{}, fmt.Errorf("amount %s has no currency", amount)
+	}
+	units, err := MinorUnits(c.Base)
+	if err != nil {
+		return Money{}, err
+	}
+
+	rate, inverse, err := c.rate(currency, businessDate)
+	if err != nil {
+		return Money{}, err
+	}
+	if inverse {
+		converted, err := amount.Amount().Quo(rate, units, c.Rounding)
+		if err != nil {
+			return Money{}, err
+		}
+		return NewMoney(converted, c.Base), nil
+	}
+	return NewMoney(amount.Amount().Mul(rate).Round(units, c.Rounding), c.Base), nil
+}
+
+// Sum adds up amounts in the base currency. Amounts in the same currency are added up before they are converted, so
+// every currency is rounded only once.
+func (c Converter) Sum(businessDate string, amounts ...Money) (Money, error) {
+	byCurrency := map[string]Money{}
+	for _, amount := range amounts {
+		sum, err := byCurrency[amount.Currency()].Add(amount)
+		if err != nil {
+			return Money{}, err
+		}
+		byCurrency[amount.Currency()] = sum
+	}
+	currencies := make([]string, 0, len(byCurrency))
+	for currency := range byCurrency {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	total := NewMoney(Decimal{}, c.Base)
+	for _, currency := range currencies {
+		converted, err := c.Convert(byCurrency[currency], businessDate)
+		if err != nil {
+			return Money{}, err
+		}
+		total, err = total.Add(converted)
+		if err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// rate finds the rate of a currency valid on a business date. inverse is set if the rate is the price of the base
+// currency in the currency, which amounts have to be divided by.
+func (c Converter) rate(currency string, businessDate string) (rate Decimal, inverse bool, err error) {
+	if c.Rates == nil {
+		return Decimal{}, false, fmt.Errorf("%w for %s in %s", ErrNoFXRate, currency, c.Base)
+	}
+	businessDate, err = ParseBusinessDate(businessDate)
+	if err != nil {
+		return Decimal{}, false, err
+	}
+	date, err := time.Parse(businessDateLayout, businessDate)
+	if err != nil {
+		return Decimal{}, false, fmt.Errorf("invalid business date %q", businessDate)
+	}
+
+	for days := 0; days <= fxRateLookback; days++ {
+		day := date.AddDate(0, 0, -days).Format(businessDateLayout)
+		direct, err := c.Rates.GetFXRate(currency, c.Base, day)
+		if err != nil {
+			return Decimal{}, false, err
+		}
+		if direct != nil && direct.Rate.Sign() > 0 {
+			return direct.Rate, false, nil
+		}
+		reverse, err := c.Rates.GetFXRate(c.Base, currency, day)
+		if err != nil {
+			return Decimal{}, false, err
+		}
+		if reverse != nil && reverse.Rate.Sign() > 0 {
+			return reverse.Rate, true, nil
+		}
+	}
+	return Decimal{}, false, fmt.Errorf("%w for %s in %s on or up to %d days before %s", ErrNoFXRate, currency, c.Base, fxRateLookback, businessDate)
+}
+
+// ClientTotals are the figures of a client added up over its accounts and converted into a base currency. Balances,
+// taxes and taxable income are computed from the types of the transactions, see TransactionTypes.
+type ClientTotals struct {
+	ClientReference  string `json:"client_reference"`
+	BusinessDate     string `json:"business_date"`
+	Currency         string `json:"currency"`
+	CashBalance      Money  `json:"cash_balance"`
+	Balance          Money  `json:"balance"`
+	TaxesPaid        Money  `json:"taxes_paid"`
+	TaxableIncome    Money  `json:"taxable_income"`
+	TaxFreeAllowance Money  `json:"tax_free_allowance"`
+}
+
+// Totals adds up the accounts of a client in the base currency at the rates valid on the business date.
+func (c Converter) Totals(joined JoinedData, businessDate string) (ClientTotals, error) {
+	totals := ClientTotals{ClientReference: joined.ObjectReference, BusinessDate: businessDate, Currency: c.Base}
+
+	var cash, balances, taxes, income []Money
+	for _, account := range joined.Accounts {
+		err := account.UpdateBalance()
+		if err != nil {
+			return totals, err
+		}
+		accountTaxes, err := account.Taxes()
+		if err != nil {
+			return totals, err
+		}
+		accountIncome, err := account.TaxableIncome()
+		if err != nil {
+			return totals, err
+		}
+		cash = append(cash, account.CashBalance)
+		balances = append(balances, account.Balance)
+		taxes = append(taxes, accountTaxes)
+		income = append(income, accountIncome)
+	}
+	var err error
+	if totals.CashBalance, err = c.Sum(businessDate, cash...); err != nil {
+		return totals, fmt.Errorf("cash balance of client %s: %w", totals.ClientReference, err)
+	}
+	if totals.Balance, err = c.Sum(businessDate, balances...); err != nil {
+		return totals, fmt.Errorf("balance of client %s: %w", totals.ClientReference, err)
+	}
+	if totals.TaxesPaid, err = c.Sum(businessDate, taxes...); err != nil {
+		return totals, fmt.Errorf("taxes paid by client %s: %w", totals.ClientReference, err)
+	}
+	if totals.TaxableIncome, err = c.Sum(businessDate, income...); err != nil {
+		return totals, fmt.Errorf("taxable income of client %s: %w", totals.ClientReference, err)
+	}
+	allowance := NewMoney(Decimal{}, TaxCurrency)
+	if joined.Client != nil {
+		allowance = joined.Client.TaxFreeAllowance.In(TaxCurrency)
+	}
+	if totals.TaxFreeAllowance, err = c.Convert(allowance, businessDate); err != nil {
+		return totals, fmt.Errorf("tax free allowance of client %s: %w", totals.ClientReference, err)
+	}
+	return totals, nil
+}
+
+// GetClientTotals adds up the accounts of a client in a base currency at the rates valid on a business date. The
+// accounts of the portfolios of the client are read with their transactions like in InsertAccount, including accounts
+// and transactions still stored on their own. The totals of a client which hasn't been loaded are zero.
+func (d DataManager) GetClientTotals(clientReference string, base string, businessDate string) (ClientTotals, error) {
+	converter, err := NewConverter(d, base)
+	if err != nil {
+		return ClientTotals{}, err
+	}
+	joined, err := d.getJoined(clientReference)
+	if err != nil {
+		return ClientTotals{}, err
+	}
+
+	nested := joined
+	joined.Accounts = nil
+	for _, portfolio := range joined.Portfolios {
+		account := nested.account(portfolio.AccountNumber)
+		if account == nil {
+			own, err := d.accountItem(portfolio.AccountNumber)
+			if err != nil {
+				return ClientTotals{}, err
+			}
+			account = own.account(portfolio.AccountNumber)
+		}
+		if account == nil {
+			continue
+		}
+		pending, err := d.pendingTransactions(portfolio.AccountNumber)
+		if err != nil {
+			return ClientTotals{}, err
+		}
+		for _, transaction := range pending {
+			account.Transactions = upsertTransaction(account.Transactions, transaction)
+		}
+		joined.Accounts = append(joined.Accounts, account)
+	}
+	return converter.Totals(joined, businessDate)
+}
+
+func (m *MemoryStore) GetClientTotals(clientReference string, base string, businessDate string) (ClientTotals, error) {
+	converter, err := NewConverter(m, base)
+	if err != nil {
+		return ClientTotals{}, err
+	}
+	return converter.Totals(m.joined(clientReference), businessDate)
+}
+
+// joined collects a client with its portfolios and their accounts and transactions, like the items of DataManager.
+func (m *MemoryStore) joined(clientReference string) JoinedData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	joined := JoinedData{ObjectReference: clientReference}
+	if client, ok := m.Clients[clientReference]; ok {
+		joined.Client = &client
+	}
+	for _, portfolio := range m.Portfolios {
+		if portfolio.ClientReference != clientReference {
+			continue
+		}
+		portfolio := portfolio
+		joined.Portfolios = append(joined.Portfolios, &portfolio)
+		account, ok := m.Accounts[strconv.Itoa(portfolio.AccountNumber)]
+		if !ok {
+			continue
+		}
+		account.Transactions = nil
+		for _, transaction := range m.Transactions {
+			if transaction.AccountNumber == account.AccountNumber {
+				transaction := transaction
+				account.Transactions = append(account.Transactions, &transaction)
+			}
+		}
+		joined.Accounts = append(joined.Accounts, &account)
+	}
+	return joined
+}
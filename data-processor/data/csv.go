@@ -2,17 +2,19 @@ package data
 
 import (
 	"bytes"
-	"encoding/csv"
-
-	"github.com/gocarina/gocsv"
+	"fmt"
 )
 
+// TaxCurrency is the currency of tax free allowances.
+const TaxCurrency = "EUR"
+
 type Client struct {
-	RecordID         int     `dynamodbav:"record_id" csv:"record_id"`
-	FirstName        string  `dynamodbav:"first_name" csv:"first_name"`
-	LastName         string  `dynamodbav:"last_name" csv:"last_name"`
-	ClientReference  string  `dynamodbav:"client_reference" csv:"client_reference"`
-	TaxFreeAllowance float64 `dynamodbav:"tax_free_allowance" csv:"tax_free_allowance"`
+	RecordID         int    `dynamodbav:"record_id" csv:"record_id"`
+	FirstName        string `dynamodbav:"first_name" csv:"first_name"`
+	LastName         string `dynamodbav:"last_name" csv:"last_name"`
+	ClientReference  string `dynamodbav:"client_reference" csv:"client_reference"`
+	TaxFreeAllowance Money  `dynamodbav:"tax_free_allowance" csv:"tax_free_allowance"`
+	Provenance
 }
 
 type Portfolio struct {
@@ -21,49 +23,155 @@ type Portfolio struct {
 	PortfolioReference string `dynamodbav:"portfolio_reference" csv:"portfolio_reference"`
 	ClientReference    string `dynamodbav:"client_reference" csv:"client_reference"`
 	AgentCode          string `dynamodbav:"agent_code" csv:"agent_code"`
+	Provenance
 }
 
 type Account struct {
 	RecordID      int            `dynamodbav:"record_id" csv:"record_id"`
 	AccountNumber int            `dynamodbav:"account_number" csv:"account_number"`
-	CashBalance   float64        `dynamodbav:"cash_balance" csv:"cash_balance"`
+	CashBalance   Money          `dynamodbav:"cash_balance" csv:"cash_balance"`
 	Currency      string         `dynamodbav:"currency" csv:"currency"`
-	TaxesPaid     float64        `dynamodbav:"taxes_paid" csv:"taxes_paid"`
+	TaxesPaid     Money          `dynamodbav:"taxes_paid" csv:"taxes_paid"`
 	Transactions  []*Transaction `dynamodbav:"transactions"`
-	Balance       float64        `dynamodbav:"balance" csv:"-"`
+	Balance       Money          `dynamodbav:"balance" csv:"-"`
+	Provenance
 }
 
 type Transaction struct {
-	RecordID             int     `dynamodbav:"record_id" csv:"record_id"`
-	AccountNumber        int     `dynamodbav:"account_number" csv:"account_number"`
-	TransactionReference string  `dynamodbav:"transaction_reference" csv:"transaction_reference"`
-	Amount               float64 `dynamodbav:"amount" csv:"amount"`
-	Keyword              string  `dynamodbav:"keyword" csv:"keyword"`
+	RecordID             int    `dynamodbav:"record_id" csv:"record_id"`
+	AccountNumber        int    `dynamodbav:"account_number" csv:"account_number"`
+	TransactionReference string `dynamodbav:"transaction_reference" csv:"transaction_reference"`
+	Amount               Money  `dynamodbav:"amount" csv:"amount"`
+	Keyword              string `dynamodbav:"keyword" csv:"keyword"`
+	Provenance
+}
+
+// Stamp sets the provenance of the client and the currency of its tax free allowance.
+func (c *Client) Stamp(file Provenance) error {
+	c.TaxFreeAllowance = c.TaxFreeAllowance.In(TaxCurrency)
+	return c.Provenance.Stamp(file)
+}
+
+// ValidateRow checks that the tax free allowance, if it was given with a currency, is in TaxCurrency.
+func (c *Client) ValidateRow() []FieldError {
+	return currencyErrors(TaxCurrency, "tax free allowances are", namedAmount{"tax_free_allowance", c.TaxFreeAllowance})
+}
+
+// ValidateRow checks that the amounts of the account which were given with a currency, e.g. 100 USD, are in the
+// currency of the account. Stamp sets the currency of the amounts without converting them.
+func (a *Account) ValidateRow() []FieldError {
+	return currencyErrors(a.Currency, "the account is",
+		namedAmount{"cash_balance", a.CashBalance},
+		namedAmount{"taxes_paid", a.TaxesPaid},
+	)
+}
+
+// namedAmount is an amount with the column it was parsed from.
+type namedAmount struct {
+	column string
+	amount Money
+}
+
+// currencyErrors reports the amounts whose currency is not the given one. Amounts without a currency are in it.
+func currencyErrors(currency string, subject string, amounts ...namedAmount) []FieldError {
+	var errs []FieldError
+	for _, a := range amounts {
+		if a.amount.Currency() == "" || currency == "" || a.amount.Currency() == currency {
+			continue
+		}
+		errs = append(errs, FieldError{
+			Column:  a.column,
+			Value:   a.amount.String(),
+			Rule:    RuleCurrency,
+			Message: fmt.Sprintf("is in %s, %s in %s", a.amount.Currency(), subject, currency),
+		})
+	}
+	return errs
+}
+
+// Stamp sets the provenance of the account and the currency of its amounts.
+func (a *Account) Stamp(file Provenance) error {
+	a.applyCurrency()
+	return a.Provenance.Stamp(file)
+}
+
+// applyCurrency sets the currency of the amounts of the account, which are parsed and stored without it, to the
+// currency of the account.
+func (a *Account) applyCurrency() {
+	a.CashBalance = a.CashBalance.In(a.Currency)
+	a.TaxesPaid = a.TaxesPaid.In(a.Currency)
+	a.Balance = a.Balance.In(a.Currency)
+	for _, transaction := range a.Transactions {
+		transaction.Amount = transaction.Amount.In(a.Currency)
+	}
+}
+
+// UpdateBalance sets the balance of the account to its cash balance plus the amounts of its transactions, which are
+// in the currency of the account. Transactions whose type doesn't change the balance are left out.
+func (a *Account) UpdateBalance() error {
+	a.applyCurrency()
+	balance := a.CashBalance
+	for _, transaction := range a.Transactions {
+		if transaction.Type().Balance == BalanceNone {
+			continue
+		}
+		var err error
+		balance, err = balance.Add(transaction.Amount)
+		if err != nil {
+			return fmt.Errorf("balance of account %d: %w", a.AccountNumber, err)
+		}
+	}
+	a.Balance = balance
+	return nil
+}
+
+// Taxes returns the taxes paid on the account: the taxes paid according to the accounts file plus the taxes booked as
+// transactions.
+func (a *Account) Taxes() (Money, error) {
+	a.applyCurrency()
+	taxes := a.TaxesPaid
+	for _, transaction := range a.Transactions {
+		if transaction.Type().Balance != BalanceTax {
+			continue
+		}
+		var err error
+		taxes, err = taxes.Sub(transaction.Amount)
+		if err != nil {
+			return Money{}, fmt.Errorf("taxes paid on account %d: %w", a.AccountNumber, err)
+		}
+	}
+	return taxes, nil
+}
+
+// TaxableIncome adds up the transactions of the account whose type is taxable, e.g. dividends and interest.
+func (a *Account) TaxableIncome() (Money, error) {
+	a.applyCurrency()
+	income := NewMoney(Decimal{}, a.Currency)
+	for _, transaction := range a.Transactions {
+		if !transaction.Type().Taxable {
+			continue
+		}
+		var err error
+		income, err = income.Add(transaction.Amount)
+		if err != nil {
+			return Money{}, fmt.Errorf("taxable income of account %d: %w", a.AccountNumber, err)
+		}
+	}
+	return income, nil
 }
 
 func ParseClientCSV(data []byte) ([]*Client, error) {
-	reader := csv.NewReader(bytes.NewReader(data))
-	clients := []*Client{}
-	err := gocsv.UnmarshalCSV(reader, &clients)
-	return clients, err
+	return collect(NewCSVRows[Client](bytes.NewReader(data), "clients", Dialect{}, nil))
 }
 
 func ParsePortfolioCSV(data []byte) ([]*Portfolio, error) {
-	reader := csv.NewReader(bytes.NewReader(data))
-	portfolios := []*Portfolio{}
-	err := gocsv.UnmarshalCSV(reader, &portfolios)
-	return portfolios, err
+	return collect(NewCSVRows[Portfolio](bytes.NewReader(data), "portfolios", Dialect{}, nil))
 }
 
 func ParseAccountCSV(data []byte) ([]*Account, error) {
-	reader := csv.NewReader(bytes.NewReader(data))
-	accounts := []*Account{}
-	err := gocsv.UnmarshalCSV(reader, &accounts)
-	return accounts, err
+	return collect(NewCSVRows[Account](bytes.NewReader(data), "accounts", Dialect{}, nil))
 }
+
 func ParseTransactionCSV(data []byte) ([]*Transaction, error) {
-	reader := csv.NewReader(bytes.NewReader(data))
-	transactions := []*Transaction{}
-	err := gocsv.UnmarshalCSV(reader, &transactions)
-	return transactions, err
+	return collect(NewCSVRows[Transaction](bytes.NewReader(data), "transactions", Dialect{}, nil))
 }
@@ -2,20 +2,44 @@ package data
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/ryanc414/dynamodbav"
 )
 
 const taxesPaidTableName = "taxes_paid"
 
+// Accounts are nested in the items of their clients, or stored on their own until the portfolio linking them to a
+// client has been processed. Transactions are nested in their accounts, or stored on their own until their account has
+// been processed. Items with these prefixes of their object reference keep track of them.
+const (
+	accountPrefix      = "account#"      // account#<account number> holds the object reference of the item nesting the account
+	transactionsPrefix = "transactions#" // transactions#<account number> lists the transactions stored on their own
+)
+
+// accountLocation tells which item an account is nested in.
+type accountLocation struct {
+	ObjectReference string `dynamodbav:"object_reference"`
+	Item            string `dynamodbav:"item"`
+}
+
+// referenceList is an item listing references, e.g. the transactions of an account which are stored on their own. See
+// addReferences.
+type referenceList struct {
+	ObjectReference string   `dynamodbav:"object_reference"`
+	References      []string `dynamodbav:"references,stringset"`
+}
+
 type JoinedData struct {
 	ObjectReference string `dynamodbav:"object_reference"`
 	*Client
@@ -27,236 +51,213 @@ type DataManager struct {
 	S3Client  *s3.Client
 	db        *dynamodb.Client
 	tableName string
+	loads     *loadWriters
 }
 
-// DownloadFile gets an object from a bucket and stores it in a local file.
-func (d DataManager) DownloadFile(bucketName string, objectKey string) ([]byte, error) {
+// DownloadFile opens an object in a bucket for reading and returns its content type. The body is streamed from S3 and
+// has to be closed by the caller.
+func (d DataManager) DownloadFile(bucketName string, objectKey string) (io.ReadCloser, string, error) {
 	result, err := d.S3Client.GetObject(context.TODO(), &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectKey),
 	})
 	if err != nil {
 		log.Printf("Couldn't get object %v:%v. Error: %v\n", bucketName, objectKey, err)
-		return []byte{}, err
-	}
-	defer result.Body.Close()
-	body, err := io.ReadAll(result.Body)
-	if err != nil {
-		log.Printf("Couldn't read object body from %v. Error: %v\n", objectKey, err)
+		return nil, "", err
 	}
-	return body, err
+	return result.Body, aws.ToString(result.ContentType), nil
 }
 
-func (d DataManager) GetTaxesPaidByClient(clientReference string) (int, error) {
-	var taxesPaid int
-
-	return taxesPaid, nil
+// HeadFile returns the current version of an object in a bucket, nil if there is no such object.
+func (d DataManager) HeadFile(bucketName string, objectKey string) (*ObjectVersion, error) {
+	result, err := d.S3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey),
+	})
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Couldn't head object %v:%v. Error: %v\n", bucketName, objectKey, err)
+		return nil, err
+	}
+	// Unlike in notifications, the ETag is quoted in responses.
+	return &ObjectVersion{VersionID: aws.ToString(result.VersionId), ETag: strings.Trim(aws.ToString(result.ETag), `"`)}, nil
 }
 
-func (d DataManager) InsertClient(client Client) error {
-	joined := JoinedData{
-		ObjectReference: client.ClientReference,
-		Client:          &client,
+// UploadFile writes an object to a bucket.
+func (d DataManager) UploadFile(bucketName string, objectKey string, content io.Reader, contentType string) error {
+	_, err := d.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(objectKey),
+		Body:        content,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		log.Printf("Couldn't put object %v:%v. Error: %v\n", bucketName, objectKey, err)
 	}
+	return err
+}
 
-	// Check if there are already portfolios for this client
-	// This might happen because the portfolio file was processed before the client file
-
-	portfolios, err := d.db.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String(d.tableName),
-		KeyConditionExpression: aws.String("object_reference = :client_reference"),
-		FilterExpression:       aws.String("portfolio_reference <> :null"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":client_reference": &types.AttributeValueMemberS{Value: client.ClientReference},
-			":null":             &types.AttributeValueMemberNULL{Value: true},
-		},
+// GetTaxesPaidByClient adds up the taxes paid on the accounts of a client, see Account.Taxes. The accounts have to be in
+// the same currency, GetClientTotals converts them into a base currency.
+func (d DataManager) GetTaxesPaidByClient(clientReference string) (Money, error) {
+	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(clientReference),
 	})
 	if err != nil {
-		log.Printf("Couldn't query portfolios for client %v. Error: %v\n", client.ClientReference, err)
-		return err
+		log.Printf("Couldn't get client %v. Error: %v\n", clientReference, err)
+		return Money{}, err
+	}
+	var joined JoinedData
+	err = attributevalue.UnmarshalMap(result.Item, &joined)
+	if err != nil {
+		log.Printf("Couldn't unmarshal client: %v. Error: %v\n", result.Item, err)
+		return Money{}, err
 	}
-	if len(portfolios.Items) > 0 {
-		for _, item := range portfolios.Items {
-			var portfolio Portfolio
-			err = attributevalue.UnmarshalMap(item, &portfolio)
-			if err != nil {
-				log.Printf("Couldn't unmarshal portfolio: %v. Error: %v\n", item, err)
-				return err
-			}
-			joined.Portfolios = append(joined.Portfolios, &portfolio)
+
+	var taxesPaid []Money
+	for _, account := range joined.Accounts {
+		taxes, err := account.Taxes()
+		if err != nil {
+			return Money{}, err
 		}
+		taxesPaid = append(taxesPaid, taxes)
 	}
+	return SumMoney(taxesPaid...)
+}
 
-	marshalled, err := dynamodbav.MarshalItem(joined)
+func (d DataManager) InsertClient(client Client) error {
+	// The item of the client might exist already, with portfolios and accounts which were processed before the client
+	// file, or from a previous load of the client. They are kept.
+	joined, err := d.getJoined(client.ClientReference)
 	if err != nil {
-		log.Printf("Couldn't marshal joined data: %v. Error: %v\n", joined, err)
 		return err
 	}
+	joined.Client = &client
 
-	out, err := d.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(d.tableName),
-		Item:      marshalled,
-	})
+	err = d.putJoined(joined, client.Provenance)
 	if err != nil {
 		log.Printf("Couldn't insert client: %v. Error: %v\n", client, err)
 		return err
 	}
-	log.Printf("Inserted client: %v\n", out)
+	err = d.indexReference("client_reference", client.ClientReference)
+	if err != nil {
+		return err
+	}
+	log.Printf("Inserted client: %v\n", client.ClientReference)
 
 	return nil
 }
 
 func (d DataManager) InsertPortfolio(portfolio Portfolio) error {
-	joined := JoinedData{
-		ObjectReference: portfolio.ClientReference,
-		Portfolios: []*Portfolio{
-			&portfolio,
-		},
-	}
-
 	// Check if there already is a client for this portfolio
 	// This would normally be the case unless the portfolio file got processed before the client file
 
-	clients, err := d.db.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String(d.tableName),
-		KeyConditionExpression: aws.String("object_reference = :client_reference"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":client_reference": &types.AttributeValueMemberS{Value: portfolio.ClientReference},
-		},
-	})
+	joined, err := d.getJoined(portfolio.ClientReference)
 	if err != nil {
-		log.Printf("Couldn't query clients for portfolio %v. Error: %v\n", portfolio.PortfolioReference, err)
 		return err
 	}
-
-	// Check if there already is an account for this portfolio. This would be the case if the account file was processed before the portfolio file
-	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(d.tableName),
-		Key: map[string]types.AttributeValue{
-			"object_reference": &types.AttributeValueMemberS{Value: strconv.Itoa(portfolio.AccountNumber)},
-		},
-	})
-	if err != nil {
-		log.Printf("Couldn't query accounts for portfolio %v. Error: %v\n", portfolio.PortfolioReference, err)
-		return err
+	if joined.Client == nil {
+		joined.Client = &Client{ClientReference: portfolio.ClientReference}
 	}
-	if result.Item != nil {
-		var account Account
-		err = attributevalue.UnmarshalMap(result.Item, &account)
-		if err != nil {
-			log.Printf("Couldn't unmarshal account: %v. Error: %v\n", result.Item, err)
-			return err
+	replaced := false
+	for i, existing := range joined.Portfolios {
+		if existing.PortfolioReference == portfolio.PortfolioReference {
+			joined.Portfolios[i] = &portfolio
+			replaced = true
 		}
-		joined.Accounts = append(joined.Accounts, &account)
+	}
+	if !replaced {
+		joined.Portfolios = append(joined.Portfolios, &portfolio)
 	}
 
-	joined.Client = &Client{ClientReference: portfolio.ClientReference}
-	if len(clients.Items) > 0 {
-		joined.Client = &Client{}
-		err = attributevalue.UnmarshalMap(clients.Items[0], joined.Client)
+	// Check if there already is an account for this portfolio. This would be the case if the account file was
+	// processed before the portfolio file, in which case the account is stored on its own and moves to the client.
+	if joined.account(portfolio.AccountNumber) == nil {
+		own, err := d.getJoined(strconv.Itoa(portfolio.AccountNumber))
 		if err != nil {
-			log.Printf("Couldn't unmarshal client: %v. Error: %v\n", clients.Items[0], err)
 			return err
 		}
+		if account := own.account(portfolio.AccountNumber); account != nil {
+			joined.Accounts = append(joined.Accounts, account)
+		}
 	}
 
-	marshalled, err := dynamodbav.MarshalItem(joined)
+	err = d.putJoined(joined, portfolio.Provenance)
 	if err != nil {
-		log.Printf("Couldn't marshal joined data: %v. Error: %v\n", joined, err)
+		log.Printf("Couldn't insert portfolio: %v. Error: %v\n", portfolio, err)
 		return err
 	}
 
-	out, err := d.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(d.tableName),
-		Item:      marshalled,
+	// From now on the account is found in the item of the client, see accountItem.
+	location, err := attributevalue.MarshalMap(accountLocation{
+		ObjectReference: accountPrefix + strconv.Itoa(portfolio.AccountNumber),
+		Item:            portfolio.ClientReference,
 	})
 	if err != nil {
-		log.Printf("Couldn't insert portfolio: %v. Error: %v\n", portfolio, err)
+		log.Printf("Couldn't marshal location of account %v. Error: %v\n", portfolio.AccountNumber, err)
+		return err
+	}
+	err = d.putItem(location, portfolio.Provenance)
+	if err != nil {
+		log.Printf("Couldn't locate account %v at client %v. Error: %v\n", portfolio.AccountNumber, portfolio.ClientReference, err)
+		return err
+	}
+	err = d.indexReference("portfolio_reference", portfolio.PortfolioReference)
+	if err != nil {
+		return err
+	}
+	err = d.indexReference("agent_code", portfolio.AgentCode)
+	if err != nil {
 		return err
 	}
-	log.Printf("Inserted portfolio: %v\n", out)
+	log.Printf("Inserted portfolio: %v\n", portfolio.PortfolioReference)
 
 	return nil
 }
 
 func (d DataManager) InsertAccount(account Account) error {
-	joined := JoinedData{
-		ObjectReference: strconv.Itoa(account.AccountNumber),
-		Accounts: []*Account{
-			&account,
-		},
-	}
+	// The account goes to the item of the client of its portfolio, or is stored on its own until the portfolio has
+	// been processed.
 
-	// Check if there alread is a portfolio for this account
-
-	portfolios, err := d.db.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String(d.tableName),
-		KeyConditionExpression: aws.String("account_number = :account_number"),
-		FilterExpression:       aws.String("portfolio_reference <> :null"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":account_number": &types.AttributeValueMemberS{Value: strconv.Itoa(account.AccountNumber)},
-			":null":           &types.AttributeValueMemberNULL{Value: true},
-		},
-	})
+	joined, err := d.accountItem(account.AccountNumber)
 	if err != nil {
-		log.Printf("Couldn't query portfolios for account %v. Error: %v\n", account.AccountNumber, err)
 		return err
 	}
-	if len(portfolios.Items) > 0 {
-		for _, item := range portfolios.Items {
-			var portfolio Portfolio
-			err = attributevalue.UnmarshalMap(item, &portfolio)
-			if err != nil {
-				log.Printf("Couldn't unmarshal portfolio: %v. Error: %v\n", item, err)
-				return err
-			}
-			joined.Portfolios = append(joined.Portfolios, &portfolio)
-			joined.ObjectReference = portfolio.ClientReference
-		}
-	}
 
 	// Check if there are already transactions for this account
-	// This might happen because the transaction file was processed before the account file
+	// This might happen because the transaction file was processed before the account file, or the account is loaded
+	// again
 
-	transactions, err := d.db.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String(d.tableName),
-		KeyConditionExpression: aws.String("object_reference = :account_number"),
-		FilterExpression:       aws.String("transaction_reference <> :null"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":account_number": &types.AttributeValueMemberS{Value: strconv.Itoa(account.AccountNumber)},
-			":null":           &types.AttributeValueMemberNULL{Value: true},
-		},
-	})
+	if previous := joined.account(account.AccountNumber); previous != nil {
+		account.Transactions = previous.Transactions
+	}
+	pending, err := d.pendingTransactions(account.AccountNumber)
 	if err != nil {
-		log.Printf("Couldn't query transactions for account %v. Error: %v\n", account.AccountNumber, err)
 		return err
 	}
-
-	for _, item := range transactions.Items {
-		var transaction Transaction
-		err = attributevalue.UnmarshalMap(item, &transaction)
-		if err != nil {
-			log.Printf("Couldn't unmarshal transaction: %v. Error: %v\n", item, err)
-			return err
-		}
-		account.Transactions = append(account.Transactions, &transaction)
+	for _, transaction := range pending {
+		account.Transactions = upsertTransaction(account.Transactions, transaction)
 	}
-
-	marshalled, err := dynamodbav.MarshalItem(joined)
+	err = account.UpdateBalance()
 	if err != nil {
-		log.Printf("Couldn't marshal joined data: %v. Error: %v\n", joined, err)
 		return err
 	}
+	joined.setAccount(&account)
 
-	out, err := d.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(d.tableName),
-		Item:      marshalled,
-	})
+	err = d.putJoined(joined, account.Provenance)
 	if err != nil {
 		log.Printf("Couldn't insert account: %v. Error: %v\n", account, err)
 		return err
 	}
-	log.Printf("Inserted account: %v\n", out)
+	err = d.indexReference("account_number", strconv.Itoa(account.AccountNumber))
+	if err != nil {
+		return err
+	}
+	log.Printf("Inserted account: %v\n", account.AccountNumber)
 
 	return nil
 }
@@ -265,60 +266,214 @@ func (d DataManager) InsertTransaction(transaction Transaction) error {
 	// Check if there already is an account for this transaction
 	// This would be the case if the account file was processed before the transaction file and is the normal case
 
-	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(d.tableName),
-		Key: map[string]types.AttributeValue{
-			"account_number": &types.AttributeValueMemberS{Value: strconv.Itoa(transaction.AccountNumber)},
-		},
-	})
+	joined, err := d.accountItem(transaction.AccountNumber)
 	if err != nil {
 		log.Printf("Couldn't query accounts for transaction %v. Error: %v\n", transaction.TransactionReference, err)
 		return err
 	}
-	if result.Item != nil {
-		var account Account
-		err = attributevalue.UnmarshalMap(result.Item, &account)
+	if account := joined.account(transaction.AccountNumber); account != nil {
+		account.Transactions = upsertTransaction(account.Transactions, &transaction)
+		err = account.UpdateBalance()
 		if err != nil {
-			log.Printf("Couldn't unmarshal account: %v. Error: %v\n", result.Item, err)
 			return err
 		}
-		account.Transactions = append(account.Transactions, &transaction)
-		marshalled, err := dynamodbav.MarshalItem(account)
+		err = d.putJoined(joined, transaction.Provenance)
 		if err != nil {
-			log.Printf("Couldn't marshal account: %v. Error: %v\n", account, err)
+			log.Printf("Couldn't insert account: %v. Error: %v\n", account, err)
 			return err
 		}
-		out, err := d.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
-			TableName: aws.String(d.tableName),
-			Item:      marshalled,
-		})
+		log.Printf("Inserted transaction %v into account: %v\n", transaction.TransactionReference, account.AccountNumber)
+	} else {
+
+		amount, err := transaction.Amount.MarshalDynamoDBAttributeValue()
 		if err != nil {
-			log.Printf("Couldn't insert account: %v. Error: %v\n", account, err)
+			log.Printf("Couldn't marshal amount of transaction: %v. Error: %v\n", transaction, err)
 			return err
 		}
-		log.Printf("Inserted account: %v\n", out)
-	} else {
+		item := map[string]types.AttributeValue{
+			"object_reference":      &types.AttributeValueMemberS{Value: transaction.TransactionReference},
+			"account_number":        &types.AttributeValueMemberN{Value: strconv.Itoa(transaction.AccountNumber)},
+			"transaction_reference": &types.AttributeValueMemberS{Value: transaction.TransactionReference},
+			"amount":                amount,
+			"keyword":               &types.AttributeValueMemberS{Value: transaction.Keyword},
+		}
+		provenance, err := attributevalue.MarshalMap(transaction.Provenance)
+		if err != nil {
+			log.Printf("Couldn't marshal provenance of transaction: %v. Error: %v\n", transaction, err)
+			return err
+		}
+		for name, value := range provenance {
+			item[name] = value
+		}
 
-		out, err := d.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
-			TableName: aws.String(d.tableName),
-			Item: map[string]types.AttributeValue{
-				"object_reference":      &types.AttributeValueMemberS{Value: transaction.TransactionReference},
-				"account_number":        &types.AttributeValueMemberN{Value: strconv.Itoa(transaction.AccountNumber)},
-				"transaction_reference": &types.AttributeValueMemberS{Value: transaction.TransactionReference},
-				"amount":                &types.AttributeValueMemberN{Value: strconv.FormatFloat(transaction.Amount, 'f', 2, 64)},
-				"keyword":               &types.AttributeValueMemberS{Value: transaction.Keyword},
-			},
-		})
+		err = d.putItem(item, transaction.Provenance)
 		if err != nil {
 			log.Printf("Couldn't insert transaction: %v. Error: %v\n", transaction, err)
 			return err
 		}
-		log.Printf("Inserted transaction: %v\n", out)
+
+		// The account picks the transaction up once it is processed, see InsertAccount.
+		err = d.addReferences(transactionsPrefix+strconv.Itoa(transaction.AccountNumber), transaction.TransactionReference)
+		if err != nil {
+			log.Printf("Couldn't list transaction %v for account %v. Error: %v\n", transaction.TransactionReference, transaction.AccountNumber, err)
+			return err
+		}
+		log.Printf("Inserted transaction: %v\n", transaction.TransactionReference)
 	}
 
 	return nil
 }
 
+// addReferences adds references to the string set of an item which lists them, creating the item if it doesn't exist.
+func (d DataManager) addReferences(reference string, references ...string) error {
+	_, err := d.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.tableName),
+		Key:              objectKey(reference),
+		UpdateExpression: aws.String("ADD #references :references"),
+		ExpressionAttributeNames: map[string]string{
+			"#references": "references",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":references": &types.AttributeValueMemberSS{Value: references},
+		},
+	})
+	return err
+}
+
+// getJoined reads the item of a client, or of an account stored on its own. An item which doesn't exist is returned
+// empty.
+func (d DataManager) getJoined(reference string) (JoinedData, error) {
+	joined := JoinedData{ObjectReference: reference}
+	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(reference),
+	})
+	if err != nil {
+		log.Printf("Couldn't get item %v. Error: %v\n", reference, err)
+		return joined, err
+	}
+	if result.Item == nil {
+		return joined, nil
+	}
+	err = attributevalue.UnmarshalMap(result.Item, &joined)
+	if err != nil {
+		log.Printf("Couldn't unmarshal joined data: %v. Error: %v\n", result.Item, err)
+		return joined, err
+	}
+	return joined, nil
+}
+
+func (d DataManager) putJoined(joined JoinedData, provenance Provenance) error {
+	marshalled, err := dynamodbav.MarshalItem(joined)
+	if err != nil {
+		log.Printf("Couldn't marshal joined data: %v. Error: %v\n", joined, err)
+		return err
+	}
+	return d.putItem(marshalled, provenance)
+}
+
+// accountItem reads the item an account is nested in: the item of the client of its portfolio once the portfolio has
+// been processed, the item of the account itself before.
+func (d DataManager) accountItem(accountNumber int) (JoinedData, error) {
+	reference := strconv.Itoa(accountNumber)
+	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(accountPrefix + reference),
+	})
+	if err != nil {
+		log.Printf("Couldn't locate account %v. Error: %v\n", accountNumber, err)
+		return JoinedData{}, err
+	}
+	if result.Item != nil {
+		var location accountLocation
+		err = attributevalue.UnmarshalMap(result.Item, &location)
+		if err != nil {
+			log.Printf("Couldn't unmarshal location of account: %v. Error: %v\n", result.Item, err)
+			return JoinedData{}, err
+		}
+		reference = location.Item
+	}
+	return d.getJoined(reference)
+}
+
+// pendingTransactions returns the transactions which were processed before their account, see InsertTransaction.
+// Transactions which have been retracted since are left out.
+func (d DataManager) pendingTransactions(accountNumber int) ([]*Transaction, error) {
+	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(transactionsPrefix + strconv.Itoa(accountNumber)),
+	})
+	if err != nil {
+		log.Printf("Couldn't get transactions of account %v. Error: %v\n", accountNumber, err)
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	var list referenceList
+	err = attributevalue.UnmarshalMap(result.Item, &list)
+	if err != nil {
+		log.Printf("Couldn't unmarshal transactions of account: %v. Error: %v\n", result.Item, err)
+		return nil, err
+	}
+
+	var transactions []*Transaction
+	for _, reference := range list.References {
+		item, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName: aws.String(d.tableName),
+			Key:       objectKey(reference),
+		})
+		if err != nil {
+			log.Printf("Couldn't get transaction %v. Error: %v\n", reference, err)
+			return nil, err
+		}
+		if item.Item == nil {
+			continue
+		}
+		var transaction Transaction
+		err = attributevalue.UnmarshalMap(item.Item, &transaction)
+		if err != nil {
+			log.Printf("Couldn't unmarshal transaction: %v. Error: %v\n", item.Item, err)
+			return nil, err
+		}
+		transactions = append(transactions, &transaction)
+	}
+	return transactions, nil
+}
+
+// account returns the nested account with the number, nil if there is none.
+func (j JoinedData) account(number int) *Account {
+	for _, account := range j.Accounts {
+		if account.AccountNumber == number {
+			return account
+		}
+	}
+	return nil
+}
+
+// setAccount nests an account, replacing the account with the same number if there is one.
+func (j *JoinedData) setAccount(account *Account) {
+	for i, existing := range j.Accounts {
+		if existing.AccountNumber == account.AccountNumber {
+			j.Accounts[i] = account
+			return
+		}
+	}
+	j.Accounts = append(j.Accounts, account)
+}
+
+// upsertTransaction adds a transaction to the transactions of an account, replacing the transaction with the same
+// reference if there is one, so that processing a file twice never books a transaction twice.
+func upsertTransaction(transactions []*Transaction, transaction *Transaction) []*Transaction {
+	for i, existing := range transactions {
+		if existing.TransactionReference == transaction.TransactionReference {
+			transactions[i] = transaction
+			return transactions
+		}
+	}
+	return append(transactions, transaction)
+}
+
 func (d DataManager) SendErrorEvent(err error) error {
 	return nil
 }
@@ -328,5 +483,6 @@ func NewDataManager(s3Client *s3.Client, dbClient *dynamodb.Client, tableName st
 		S3Client:  s3Client,
 		db:        dbClient,
 		tableName: tableName,
+		loads:     newLoadWriters(),
 	}
 }
@@ -0,0 +1,204 @@
+package data
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ValueUnmarshaler is implemented by field types which parse their own column values.
+type ValueUnmarshaler interface {
+	UnmarshalCSV(value string) error
+}
+
+// RowValidator is implemented by records which check values against each other once all of their fields are set.
+// The errors are reported with the line of the row.
+type RowValidator interface {
+	ValidateRow() []FieldError
+}
+
+// decoder sets the fields of records of type T from the values of a row, mapping columns to fields by the csv tags of
+// their canonical names.
+type decoder[T any] struct {
+	validator *Validator
+	dialect   Dialect // the decimal separator of amounts, see Dialect.DecimalPoint
+	header    []string
+	columns   []Column
+	fields    [][]int // index chain of the field of every column, nil for columns without a field
+	amounts   []bool  // whether the field of every column is a Money or a Decimal
+	data      []int   // indexes of the columns holding data, i.e. all but the ReasonColumn
+}
+
+func newDecoder[T any](schema Schema, header []string, validator *Validator) *decoder[T] {
+	var record T
+	indexes := fieldIndexes(reflect.TypeOf(record), nil)
+	columns := map[string]Column{}
+	for _, column := range schema.Columns {
+		columns[column.Name] = column
+	}
+
+	d := &decoder[T]{
+		validator: validator,
+		columns:   make([]Column, len(header)),
+		fields:    make([][]int, len(header)),
+		amounts:   make([]bool, len(header)),
+	}
+	for i, name := range header {
+		d.columns[i] = columns[name]
+		d.fields[i] = indexes[name]
+		if d.fields[i] != nil {
+			field := reflect.TypeOf(record).FieldByIndex(d.fields[i]).Type
+			d.amounts[i] = field == reflect.TypeOf(Money{}) || field == reflect.TypeOf(Decimal{})
+		}
+		if name != ReasonColumn {
+			d.header = append(d.header, name)
+			d.data = append(d.data, i)
+		}
+	}
+	return d
+}
+
+// fieldIndexes returns the index chains of the fields of a struct by their csv tags, including the fields of embedded
+// structs. Fields without a csv tag are not mapped.
+func fieldIndexes(t reflect.Type, parent []int) map[string][]int {
+	indexes := map[string][]int{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		index := append(append([]int{}, parent...), i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for name, embedded := range fieldIndexes(field.Type, index) {
+				indexes[name] = embedded
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("csv"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		indexes[name] = index
+	}
+	return indexes
+}
+
+// decode parses a row read from the given line. It returns a *RowError listing every invalid value of the row.
+func (d *decoder[T]) decode(line int, row []string) (T, error) {
+	var record T
+	if len(row) != len(d.columns) {
+		return record, d.rowError(line, row, []FieldError{{
+			Line:    line,
+			Rule:    RuleColumns,
+			Message: fmt.Sprintf("has %d columns, the header has %d", len(row), len(d.columns)),
+		}})
+	}
+
+	value := reflect.ValueOf(&record).Elem()
+	var errs []FieldError
+	for i, raw := range row {
+		column := d.columns[i]
+		fieldErr := FieldError{Line: line, Column: column.Name, Value: raw}
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			if column.Required {
+				fieldErr.Rule, fieldErr.Message = RuleRequired, "is required"
+				errs = append(errs, fieldErr)
+			}
+			continue
+		}
+		if d.amounts[i] {
+			var err error
+			raw, err = d.dialect.DecimalPoint(raw)
+			if err != nil {
+				fieldErr.Rule, fieldErr.Message = RuleType, err.Error()
+				errs = append(errs, fieldErr)
+				continue
+			}
+		}
+		if d.fields[i] != nil {
+			err := setField(value.FieldByIndex(d.fields[i]), raw)
+			if err != nil {
+				fieldErr.Rule, fieldErr.Message = RuleType, err.Error()
+				errs = append(errs, fieldErr)
+				continue
+			}
+		}
+		valid := true
+		for _, check := range column.Checks {
+			if !check.Valid(raw) {
+				fieldErr.Rule, fieldErr.Message = check.Rule, check.Message
+				errs = append(errs, fieldErr)
+				valid = false
+				break
+			}
+		}
+		if valid {
+			rule, message, ok := d.validator.validate(column.Name, raw)
+			if !ok {
+				fieldErr.Rule, fieldErr.Message = rule, message
+				errs = append(errs, fieldErr)
+			} else if suggestion, ok := d.validator.unknownReference(column, raw); ok {
+				fieldErr.Rule, fieldErr.Message = RuleReference, fmt.Sprintf("matches none of the %s loaded", column.References)
+				fieldErr.Suggestion = suggestion
+				errs = append(errs, fieldErr)
+			}
+		}
+	}
+	if validator, ok := any(&record).(RowValidator); ok && len(errs) == 0 {
+		for _, fieldErr := range validator.ValidateRow() {
+			fieldErr.Line = line
+			errs = append(errs, fieldErr)
+		}
+	}
+	if len(errs) > 0 {
+		return record, d.rowError(line, row, errs)
+	}
+	return record, nil
+}
+
+func (d *decoder[T]) rowError(line int, row []string, errs []FieldError) *RowError {
+	rowErr := &RowError{Line: line, Errors: errs, Header: d.header}
+	for _, i := range d.data {
+		if i < len(row) {
+			rowErr.Record = append(rowErr.Record, row[i])
+		}
+	}
+	return rowErr
+}
+
+func setField(field reflect.Value, value string) error {
+	if unmarshaler, ok := field.Addr().Interface().(ValueUnmarshaler); ok {
+		return unmarshaler.UnmarshalCSV(value)
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		field.SetInt(number)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a non-negative integer")
+		}
+		field.SetUint(number)
+	case reflect.Float32, reflect.Float64:
+		number, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		field.SetFloat(number)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
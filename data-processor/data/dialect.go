@@ -0,0 +1,237 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Character encodings of text files. Files are transcoded to UTF-8 before they are parsed.
+const (
+	// EncodingAuto reads UTF-8, but takes bytes which aren't valid UTF-8 to be Windows-1252, so that files exported
+	// with a Windows code page are read correctly too.
+	EncodingAuto        = ""
+	EncodingUTF8        = "utf-8"
+	EncodingWindows1252 = "windows-1252"
+	EncodingISO88591    = "iso-8859-1"
+)
+
+// encodingNames maps the accepted names of encodings to their constants.
+var encodingNames = map[string]string{
+	"":             EncodingAuto,
+	"auto":         EncodingAuto,
+	"utf-8":        EncodingUTF8,
+	"utf8":         EncodingUTF8,
+	"windows-1252": EncodingWindows1252,
+	"cp1252":       EncodingWindows1252,
+	"iso-8859-1":   EncodingISO88591,
+	"latin1":       EncodingISO88591,
+	"latin-1":      EncodingISO88591,
+}
+
+// delimiters are the delimiters a CSV file is sniffed for.
+var delimiters = []rune{',', ';', '\t', '|'}
+
+// sniffSize is the size of the start of a CSV file which is sniffed for its delimiter and quote character.
+const sniffSize = 64 << 10
+
+// Dialect describes how a CSV file is written. Empty fields are sniffed from the start of the file: the delimiter is
+// the most frequent of comma, semicolon, tab and pipe in the header, the quote character is a single quote if more
+// fields start with one than with a double quote, and the encoding is EncodingAuto. A byte order mark always
+// determines the encoding and is removed. The decimal separator of amounts is not sniffed, it is a point unless it is
+// set to a comma.
+type Dialect struct {
+	Delimiter string `json:"delimiter,omitempty"`
+	Quote     string `json:"quote,omitempty"` // " or '
+	Encoding  string `json:"encoding,omitempty"`
+	Decimal   string `json:"decimal,omitempty"` // . or ,
+}
+
+// Validate checks the fields which are set.
+func (d Dialect) Validate() error {
+	if d.Delimiter != "" {
+		delimiter, size := utf8.DecodeRuneInString(d.Delimiter)
+		if size != len(d.Delimiter) || delimiter == '"' || delimiter == '\'' || delimiter == '\r' || delimiter == '\n' {
+			return fmt.Errorf("invalid delimiter %q", d.Delimiter)
+		}
+	}
+	if d.Quote != "" && d.Quote != `"` && d.Quote != "'" {
+		return fmt.Errorf("invalid quote character %q, must be \" or '", d.Quote)
+	}
+	if _, ok := encodingNames[strings.ToLower(d.Encoding)]; !ok {
+		return fmt.Errorf("unknown encoding %q", d.Encoding)
+	}
+	if d.Decimal != "" && d.Decimal != "." && d.Decimal != "," {
+		return fmt.Errorf("invalid decimal separator %q, must be . or ,", d.Decimal)
+	}
+	return nil
+}
+
+// DecimalPoint rewrites a number or an amount written in the dialect with a decimal point, as ParseMoney expects it.
+// With a decimal comma points may only separate thousands, e.g. 1.234,56 EUR becomes 1234.56 EUR, so that a value
+// like 1.5 is rejected instead of being read as one and a half.
+func (d Dialect) DecimalPoint(s string) (string, error) {
+	if d.Decimal != "," {
+		return s, nil
+	}
+	fields := strings.Fields(s)
+	for i, field := range fields {
+		if isCurrencyCode(field) {
+			continue
+		}
+		integer, fraction, comma := strings.Cut(field, ",")
+		if strings.Contains(fraction, ".") || !groupedByThousands(strings.TrimLeft(integer, "+-")) {
+			return "", fmt.Errorf("invalid amount %q, with a decimal comma points may only separate thousands", s)
+		}
+		fields[i] = strings.ReplaceAll(integer, ".", "")
+		if comma {
+			fields[i] += "." + fraction
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// groupedByThousands reports whether the points in the integer part of a number, if any, separate groups of three
+// digits.
+func groupedByThousands(integer string) bool {
+	groups := strings.Split(integer, ".")
+	for i, group := range groups {
+		if len(groups) > 1 && (group == "" || len(group) > 3 || i > 0 && len(group) < 3) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewDecodingReader transcodes text in the given encoding to UTF-8 while it is read. A byte order mark overrides the
+// encoding and is removed.
+func NewDecodingReader(r io.Reader, encoding string) (io.Reader, error) {
+	name, ok := encodingNames[strings.ToLower(encoding)]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	var decoder transform.Transformer
+	switch name {
+	case EncodingAuto:
+		decoder = utf8Fallback{}
+	case EncodingUTF8:
+		decoder = unicode.UTF8.NewDecoder()
+	case EncodingWindows1252:
+		decoder = charmap.Windows1252.NewDecoder()
+	case EncodingISO88591:
+		decoder = charmap.ISO8859_1.NewDecoder()
+	}
+	return transform.NewReader(r, unicode.BOMOverride(decoder)), nil
+}
+
+// utf8Fallback passes valid UTF-8 through and decodes all other bytes as Windows-1252.
+type utf8Fallback struct{ transform.NopResetter }
+
+func (utf8Fallback) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst, nSrc := 0, 0
+	for nSrc < len(src) {
+		if !utf8.FullRune(src[nSrc:]) && !atEOF {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+		r, size := utf8.DecodeRune(src[nSrc:])
+		if r == utf8.RuneError && size == 1 {
+			r = charmap.Windows1252.DecodeByte(src[nSrc])
+		}
+		if nDst+utf8.RuneLen(r) > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+		nSrc += size
+	}
+	return nDst, nSrc, nil
+}
+
+// sniff fills in the delimiter and quote character of a dialect from the start of a file, unless they are set.
+func (d Dialect) sniff(sample []byte) (delimiter rune, quote rune) {
+	header, _, _ := bytes.Cut(sample, []byte("\n"))
+	delimiter, _ = utf8.DecodeRuneInString(d.Delimiter)
+	if d.Delimiter == "" {
+		delimiter = ','
+		most := 0
+		for _, candidate := range delimiters {
+			count := countUnquoted(header, candidate)
+			if count > most {
+				delimiter, most = candidate, count
+			}
+		}
+	}
+
+	quote, _ = utf8.DecodeRuneInString(d.Quote)
+	if d.Quote == "" {
+		quote = '"'
+		single, double := 0, 0
+		for _, line := range bytes.Split(sample, []byte("\n")) {
+			for _, field := range bytes.Split(line, []byte(string(delimiter))) {
+				switch {
+				case bytes.HasPrefix(field, []byte("'")):
+					single++
+				case bytes.HasPrefix(field, []byte(`"`)):
+					double++
+				}
+			}
+		}
+		if single > double {
+			quote = '\''
+		}
+	}
+	return delimiter, quote
+}
+
+// countUnquoted counts the occurrences of a character outside of double quotes.
+func countUnquoted(line []byte, c rune) int {
+	count := 0
+	quoted := false
+	for _, r := range string(line) {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == c && !quoted:
+			count++
+		}
+	}
+	return count
+}
+
+// quoteSwapper swaps single and double quotes, so that encoding/csv, which only knows double quotes, can read files
+// quoted with single quotes. Values are swapped back after parsing.
+type quoteSwapper struct {
+	r io.Reader
+}
+
+func (s quoteSwapper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	for i, b := range p[:n] {
+		switch b {
+		case '"':
+			p[i] = '\''
+		case '\'':
+			p[i] = '"'
+		}
+	}
+	return n, err
+}
+
+func swapQuotes(values []string) {
+	for i, value := range values {
+		values[i] = strings.Map(func(r rune) rune {
+			switch r {
+			case '"':
+				return '\''
+			case '\'':
+				return '"'
+			}
+			return r
+		}, value)
+	}
+}
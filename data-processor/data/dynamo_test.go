@@ -0,0 +1,402 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// dynamoRequest is a request received by fakeDynamo: the operation and its JSON input.
+type dynamoRequest struct {
+	Operation string
+	Input     map[string]any
+}
+
+// fakeDynamo serves the DynamoDB API from an HTTP test server. It records every request and answers it with the JSON
+// returned by respond, or an empty object.
+type fakeDynamo struct {
+	mu       sync.Mutex
+	requests []dynamoRequest
+	respond  func(request dynamoRequest) string
+}
+
+func newFakeDynamo(t *testing.T) (*fakeDynamo, DataManager) {
+	fake := &fakeDynamo{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading request: %v", err)
+		}
+		request := dynamoRequest{Operation: strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")}
+		err = json.Unmarshal(body, &request.Input)
+		if err != nil {
+			t.Errorf("unmarshalling %s request: %v", request.Operation, err)
+		}
+
+		fake.mu.Lock()
+		fake.requests = append(fake.requests, request)
+		respond := fake.respond
+		fake.mu.Unlock()
+
+		response := "{}"
+		if respond != nil {
+			response = respond(request)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		fmt.Fprint(w, response)
+	}))
+	t.Cleanup(srv.Close)
+
+	db := dynamodb.New(dynamodb.Options{
+		Region:           "eu-central-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: dynamodb.EndpointResolverFromURL(srv.URL),
+	})
+	return fake, *NewDataManager(nil, db, "table")
+}
+
+// operations returns the requests of an operation.
+func (f *fakeDynamo) operations(operation string) []dynamoRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var requests []dynamoRequest
+	for _, request := range f.requests {
+		if request.Operation == operation {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// key returns the object reference of the key of a request or of an entry of a transaction.
+func key(input map[string]any) string {
+	k, _ := input["Key"].(map[string]any)
+	if k == nil {
+		k, _ = input["Item"].(map[string]any)
+	}
+	reference, _ := k["object_reference"].(map[string]any)
+	s, _ := reference["S"].(string)
+	return s
+}
+
+func TestPutItemShardsManifest(t *testing.T) {
+	fake, d := newFakeDynamo(t)
+	load := Load{ObjectKey: "fxrates_20230826.csv", SourceKey: "fxrates_20230826.csv", LoadedAt: time.Date(2023, 8, 26, 6, 0, 0, 0, time.UTC)}
+	provenance := Provenance{BusinessDate: "2023-08-26", SourceKey: load.SourceKey, LoadedAt: load.LoadedAt}
+
+	for i := 0; i <= manifestPageSize; i++ {
+		err := d.putItem(objectKey(fmt.Sprintf("item#%d", i)), provenance)
+		if err != nil {
+			t.Fatalf("putItem() error = %v", err)
+		}
+	}
+	// Writing an item again in the same load neither reads its previous state nor adds it to the manifest again.
+	err := d.putItem(objectKey("item#0"), provenance)
+	if err != nil {
+		t.Fatalf("putItem() error = %v", err)
+	}
+
+	if got := len(fake.operations("GetItem")); got != manifestPageSize+1 {
+		t.Errorf("GetItem requests = %d, want %d", got, manifestPageSize+1)
+	}
+	if got := len(fake.operations("PutItem")); got != 1 {
+		t.Errorf("PutItem requests = %d, want 1", got)
+	}
+	transactions := fake.operations("TransactWriteItems")
+	if len(transactions) != manifestPageSize+1 {
+		t.Fatalf("TransactWriteItems requests = %d, want %d", len(transactions), manifestPageSize+1)
+	}
+
+	pages := map[string]int{}
+	headers := 0
+	for _, transaction := range transactions {
+		for _, entry := range transaction.Input["TransactItems"].([]any) {
+			update, _ := entry.(map[string]any)["Update"].(map[string]any)
+			if update == nil {
+				continue
+			}
+			switch reference := key(update); reference {
+			case loadPrefix + load.ID():
+				headers++
+			default:
+				pages[reference]++
+			}
+		}
+	}
+	if headers != 2 {
+		t.Errorf("manifest header updates = %d, want 2", headers)
+	}
+	want := map[string]int{
+		loadPrefix + load.ID() + "#0": manifestPageSize,
+		loadPrefix + load.ID() + "#1": 1,
+	}
+	if fmt.Sprint(pages) != fmt.Sprint(want) {
+		t.Errorf("manifest pages = %v, want %v", pages, want)
+	}
+}
+
+func TestRetractLoadReadsManifestPages(t *testing.T) {
+	fake, d := newFakeDynamo(t)
+	load := "fxrates_20230826.csv@2023-08-26T06:00:00Z"
+	fake.respond = func(request dynamoRequest) string {
+		if request.Operation != "GetItem" {
+			return "{}"
+		}
+		switch key(request.Input) {
+		case loadPrefix + load:
+			return `{"Item": {"object_reference": {"S": "load#` + load + `"}, "pages": {"N": "2"}}}`
+		case loadPrefix + load + "#0":
+			return `{"Item": {"references": {"SS": ["item#0", "item#1"]}}}`
+		case loadPrefix + load + "#1":
+			return `{"Item": {"references": {"SS": ["item#2"]}}}`
+		case "item#0", "item#1", "item#2":
+			return `{"Item": {"object_reference": {"S": "` + key(request.Input) + `"}}}`
+		}
+		return "{}"
+	}
+
+	retracted, err := d.retractLoad(load)
+	if err != nil {
+		t.Fatalf("retractLoad() error = %v", err)
+	}
+	if retracted != 3 {
+		t.Errorf("retractLoad() = %d, want 3", retracted)
+	}
+
+	var deleted []string
+	for _, request := range fake.operations("DeleteItem") {
+		deleted = append(deleted, key(request.Input))
+	}
+	want := []string{loadPrefix + load + "#1", loadPrefix + load + "#0", loadPrefix + load}
+	if fmt.Sprint(deleted) != fmt.Sprint(want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+}
+
+func TestInsertTransactionIntoAccount(t *testing.T) {
+	fake, d := newFakeDynamo(t)
+	items := fake.table()
+
+	account := Account{RecordID: 1, AccountNumber: 12345678, CashBalance: NewMoney(NewDecimal(10000, 2), ""), Currency: "EUR", TaxesPaid: NewMoney(Decimal{}, "")}
+	err := d.InsertAccount(account)
+	if err != nil {
+		t.Fatalf("InsertAccount() error = %v", err)
+	}
+	err = d.InsertTransaction(Transaction{RecordID: 1, AccountNumber: 12345678, TransactionReference: "t1", Amount: NewMoney(NewDecimal(2550, 2), ""), Keyword: "DEPOSIT"})
+	if err != nil {
+		t.Fatalf("InsertTransaction() error = %v", err)
+	}
+
+	// The transaction is booked to the account stored on its own, in the item InsertAccount wrote.
+	if got := storedAccount(t, d, "12345678", 12345678); got == nil || len(got.Transactions) != 1 || got.Balance.String() != "125.50" {
+		t.Errorf("account = %+v, want transaction t1 and balance 125.50", got)
+	}
+	for _, reference := range []string{"t1", transactionsPrefix + "12345678"} {
+		if _, ok := items[reference]; ok {
+			t.Errorf("items = %v, want no transaction stored on its own", keys(items))
+		}
+	}
+}
+
+func TestInsertTransactionIntoPortfolioAccount(t *testing.T) {
+	fake, d := newFakeDynamo(t)
+	items := fake.table()
+
+	err := d.InsertClient(Client{RecordID: 1, ClientReference: "c1", TaxFreeAllowance: NewMoney(NewDecimal(801, 0), "")})
+	if err != nil {
+		t.Fatalf("InsertClient() error = %v", err)
+	}
+	// The transaction is processed before its account and the account before its portfolio.
+	err = d.InsertTransaction(Transaction{RecordID: 1, AccountNumber: 1001, TransactionReference: "t1", Amount: NewMoney(NewDecimal(2550, 2), ""), Keyword: "DEPOSIT"})
+	if err != nil {
+		t.Fatalf("InsertTransaction() error = %v", err)
+	}
+	err = d.InsertAccount(Account{RecordID: 1, AccountNumber: 1001, CashBalance: NewMoney(NewDecimal(10000, 2), ""), Currency: "EUR", TaxesPaid: NewMoney(Decimal{}, "")})
+	if err != nil {
+		t.Fatalf("InsertAccount() error = %v", err)
+	}
+	for _, portfolio := range []Portfolio{
+		{RecordID: 1, AccountNumber: 1001, PortfolioReference: "p1", ClientReference: "c1"},
+		{RecordID: 2, AccountNumber: 1002, PortfolioReference: "p2", ClientReference: "c1"},
+	} {
+		err = d.InsertPortfolio(portfolio)
+		if err != nil {
+			t.Fatalf("InsertPortfolio() error = %v", err)
+		}
+	}
+	err = d.InsertAccount(Account{RecordID: 2, AccountNumber: 1002, CashBalance: NewMoney(NewDecimal(5000, 2), ""), Currency: "EUR", TaxesPaid: NewMoney(Decimal{}, "")})
+	if err != nil {
+		t.Fatalf("InsertAccount() error = %v", err)
+	}
+	err = d.InsertTransaction(Transaction{RecordID: 2, AccountNumber: 1002, TransactionReference: "t2", Amount: NewMoney(NewDecimal(-1000, 2), ""), Keyword: "WITHDRAWAL"})
+	if err != nil {
+		t.Fatalf("InsertTransaction() error = %v", err)
+	}
+
+	// Both accounts are nested in the item of the client, which kept the client and both portfolios.
+	joined, err := d.getJoined("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined.Client == nil || joined.Client.TaxFreeAllowance.String() != "801" || len(joined.Portfolios) != 2 {
+		t.Errorf("client item = %+v, want the client and two portfolios", joined)
+	}
+	if got := storedAccount(t, d, "c1", 1001); got == nil || got.Balance.String() != "125.50" {
+		t.Errorf("account 1001 = %+v, want balance 125.50", got)
+	}
+	if got := storedAccount(t, d, "c1", 1002); got == nil || got.Balance.String() != "40.00" {
+		t.Errorf("account 1002 = %+v, want balance 40.00", got)
+	}
+	if _, ok := items["0"]; ok {
+		t.Errorf("items = %v, want no item of account 0", keys(items))
+	}
+}
+
+// table makes the fake keep items like a table: GetItem reads what PutItem wrote and UpdateItem adds to string sets.
+// The items are returned by object reference, in their JSON representation.
+func (f *fakeDynamo) table() map[string]map[string]any {
+	items := map[string]map[string]any{}
+	f.respond = func(request dynamoRequest) string {
+		switch request.Operation {
+		case "GetItem":
+			item, ok := items[key(request.Input)]
+			if !ok {
+				return "{}"
+			}
+			response, _ := json.Marshal(map[string]any{"Item": item})
+			return string(response)
+		case "PutItem":
+			items[key(request.Input)] = request.Input["Item"].(map[string]any)
+		case "UpdateItem":
+			// Only ADD #name :value for a string set is supported.
+			reference := key(request.Input)
+			fields := strings.Fields(request.Input["UpdateExpression"].(string))
+			name := request.Input["ExpressionAttributeNames"].(map[string]any)[fields[1]].(string)
+			value := request.Input["ExpressionAttributeValues"].(map[string]any)[fields[2]].(map[string]any)
+			if items[reference] == nil {
+				items[reference] = map[string]any{"object_reference": map[string]any{"S": reference}}
+			}
+			set, _ := items[reference][name].(map[string]any)
+			strings, _ := set["SS"].([]any)
+			items[reference][name] = map[string]any{"SS": append(strings, value["SS"].([]any)...)}
+		}
+		return "{}"
+	}
+	return items
+}
+
+func keys(items map[string]map[string]any) []string {
+	var references []string
+	for reference := range items {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+	return references
+}
+
+// storedAccount reads an account nested in an item.
+func storedAccount(t *testing.T, d DataManager, reference string, number int) *Account {
+	t.Helper()
+	joined, err := d.getJoined(reference)
+	if err != nil {
+		t.Fatalf("getJoined(%s) error = %v", reference, err)
+	}
+	return joined.account(number)
+}
+
+func TestGetClientTotals(t *testing.T) {
+	fake, d := newFakeDynamo(t)
+	fake.table()
+
+	inserts := []func() error{
+		func() error {
+			return d.InsertFXRate(FXRate{Currency: "USD", BaseCurrency: "EUR", Rate: NewDecimal(9215, 4), Provenance: Provenance{BusinessDate: "2023-08-28"}})
+		},
+		func() error {
+			return d.InsertClient(Client{RecordID: 1, ClientReference: "c1", TaxFreeAllowance: NewMoney(NewDecimal(801, 0), "")})
+		},
+		// The account in USD and one of its transactions are processed before its portfolio.
+		func() error {
+			return d.InsertTransaction(Transaction{RecordID: 1, AccountNumber: 1002, TransactionReference: "t1", Amount: NewMoney(NewDecimal(5000, 2), ""), Keyword: "DEPOSIT"})
+		},
+		func() error {
+			return d.InsertAccount(Account{RecordID: 2, AccountNumber: 1002, CashBalance: NewMoney(NewDecimal(20000, 2), ""), Currency: "USD", TaxesPaid: NewMoney(NewDecimal(2000, 2), "")})
+		},
+		func() error {
+			return d.InsertPortfolio(Portfolio{RecordID: 1, AccountNumber: 1001, PortfolioReference: "p1", ClientReference: "c1"})
+		},
+		func() error {
+			return d.InsertPortfolio(Portfolio{RecordID: 2, AccountNumber: 1002, PortfolioReference: "p2", ClientReference: "c1"})
+		},
+		func() error {
+			return d.InsertAccount(Account{RecordID: 1, AccountNumber: 1001, CashBalance: NewMoney(NewDecimal(10000, 2), ""), Currency: "EUR", TaxesPaid: NewMoney(NewDecimal(1000, 2), "")})
+		},
+		func() error {
+			return d.InsertTransaction(Transaction{RecordID: 2, AccountNumber: 1001, TransactionReference: "t2", Amount: NewMoney(NewDecimal(2550, 2), ""), Keyword: "DEPOSIT"})
+		},
+	}
+	for i, insert := range inserts {
+		if err := insert(); err != nil {
+			t.Fatalf("insert %d error = %v", i, err)
+		}
+	}
+
+	totals, err := d.GetClientTotals("c1", "EUR", "2023-08-28")
+	if err != nil {
+		t.Fatalf("GetClientTotals() error = %v", err)
+	}
+	// USD are converted at 0.9215 and rounded half-even to cents.
+	figures := fmt.Sprint(totals.CashBalance, " ", totals.Balance, " ", totals.TaxesPaid, " ", totals.TaxFreeAllowance)
+	if want := "284.30 EUR 355.88 EUR 28.43 EUR 801 EUR"; figures != want {
+		t.Errorf("GetClientTotals() = %s, want %s", figures, want)
+	}
+}
+
+func TestKnownReferences(t *testing.T) {
+	fake, d := newFakeDynamo(t)
+	fake.table()
+
+	for _, reference := range []string{"c1", "c2", "c3"} {
+		err := d.InsertClient(Client{RecordID: 1, ClientReference: reference, TaxFreeAllowance: NewMoney(NewDecimal(801, 0), "")})
+		if err != nil {
+			t.Fatalf("InsertClient() error = %v", err)
+		}
+	}
+	err := d.InsertPortfolio(Portfolio{RecordID: 1, AccountNumber: 1001, PortfolioReference: "p1", ClientReference: "c1", AgentCode: "A1"})
+	if err != nil {
+		t.Fatalf("InsertPortfolio() error = %v", err)
+	}
+
+	tests := []struct {
+		column string
+		limit  int
+		want   []string
+	}{
+		{"client_reference", 10, []string{"c1", "c2", "c3"}},
+		{"client_reference", 2, []string{"c1", "c2"}},
+		{"portfolio_reference", 10, []string{"p1"}},
+		{"agent_code", 10, []string{"A1"}},
+		{"account_number", 10, nil},
+		{"first_name", 10, nil},
+	}
+	for _, tt := range tests {
+		got, err := d.KnownReferences(tt.column, tt.limit)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("KnownReferences(%s, %d) = %v, %v, want %v", tt.column, tt.limit, got, err, tt.want)
+		}
+	}
+	// The references are read from their index, not by scanning the table.
+	if scans := fake.operations("Scan"); len(scans) != 0 {
+		t.Errorf("KnownReferences() scanned the table %d times, want no scan", len(scans))
+	}
+}
@@ -0,0 +1,259 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Types of the fields of a fixed-width layout.
+const (
+	FieldText   = "text"   // trimmed of padding
+	FieldNumber = "number" // digits padded with zeros or spaces, signed by a leading or trailing + or -
+	FieldDate   = "date"   // YYYYMMDD, blank or all zeros for no date
+)
+
+// Field is a field of a fixed-width record. Start is the position of its first character, counting from 1. Numbers
+// can have implied decimals, e.g. 0001234 with two decimals is 12.34.
+type Field struct {
+	Name     string `json:"name"`
+	Start    int    `json:"start"`
+	Length   int    `json:"length"`
+	Type     string `json:"type"`
+	Decimals int    `json:"decimals,omitempty"`
+}
+
+// Layout is the record layout of a fixed-width file type. Field names are columns of the schema of the file type, so
+// the fields are mapped onto records and validated like the columns of a CSV file.
+type Layout struct {
+	FileType string
+	Fields   []Field
+}
+
+// Layouts are the default fixed-width layouts of the file types, as delivered by the legacy custodian. Routing rules
+// can declare the layout of other sources.
+var Layouts = map[string]Layout{
+	"clients": {FileType: "clients", Fields: []Field{
+		{Name: "record_id", Start: 1, Length: 10, Type: FieldNumber},
+		{Name: "first_name", Start: 11, Length: 30, Type: FieldText},
+		{Name: "last_name", Start: 41, Length: 30, Type: FieldText},
+		{Name: "client_reference", Start: 71, Length: 36, Type: FieldText},
+		{Name: "tax_free_allowance", Start: 107, Length: 13, Type: FieldNumber, Decimals: 2},
+		{Name: "business_date", Start: 120, Length: 8, Type: FieldDate},
+	}},
+	"portfolios": {FileType: "portfolios", Fields: []Field{
+		{Name: "record_id", Start: 1, Length: 10, Type: FieldNumber},
+		{Name: "account_number", Start: 11, Length: 10, Type: FieldNumber},
+		{Name: "portfolio_reference", Start: 21, Length: 36, Type: FieldText},
+		{Name: "client_reference", Start: 57, Length: 36, Type: FieldText},
+		{Name: "agent_code", Start: 93, Length: 10, Type: FieldText},
+		{Name: "business_date", Start: 103, Length: 8, Type: FieldDate},
+	}},
+	"accounts": {FileType: "accounts", Fields: []Field{
+		{Name: "record_id", Start: 1, Length: 10, Type: FieldNumber},
+		{Name: "account_number", Start: 11, Length: 10, Type: FieldNumber},
+		{Name: "cash_balance", Start: 21, Length: 15, Type: FieldNumber, Decimals: 2},
+		{Name: "currency", Start: 36, Length: 3, Type: FieldText},
+		{Name: "taxes_paid", Start: 39, Length: 13, Type: FieldNumber, Decimals: 2},
+		{Name: "business_date", Start: 52, Length: 8, Type: FieldDate},
+	}},
+	"transactions": {FileType: "transactions", Fields: []Field{
+		{Name: "record_id", Start: 1, Length: 10, Type: FieldNumber},
+		{Name: "account_number", Start: 11, Length: 10, Type: FieldNumber},
+		{Name: "transaction_reference", Start: 21, Length: 36, Type: FieldText},
+		{Name: "amount", Start: 57, Length: 15, Type: FieldNumber, Decimals: 2},
+		{Name: "keyword", Start: 72, Length: 20, Type: FieldText},
+		{Name: "business_date", Start: 92, Length: 8, Type: FieldDate},
+	}},
+	"fxrates": {FileType: "fxrates", Fields: []Field{
+		{Name: "record_id", Start: 1, Length: 10, Type: FieldNumber},
+		{Name: "currency", Start: 11, Length: 3, Type: FieldText},
+		{Name: "base_currency", Start: 14, Length: 3, Type: FieldText},
+		{Name: "rate", Start: 17, Length: 15, Type: FieldNumber, Decimals: 6},
+		{Name: "business_date", Start: 32, Length: 8, Type: FieldDate},
+	}},
+}
+
+// Validate checks that the fields of the layout are well-formed, don't overlap and are columns of the schema of the
+// file type.
+func (l Layout) Validate() error {
+	_, _, err := l.resolve()
+	return err
+}
+
+// resolve validates the layout and resolves the names of its fields like a header, see ResolveHeader.
+func (l Layout) resolve() (Schema, []string, error) {
+	if len(l.Fields) == 0 {
+		return Schema{}, nil, fmt.Errorf("no fixed-width layout for file type %q", l.FileType)
+	}
+	names := make([]string, len(l.Fields))
+	for i, field := range l.Fields {
+		switch field.Type {
+		case FieldText, FieldNumber, FieldDate:
+		default:
+			return Schema{}, nil, fmt.Errorf("field %s of the %s layout has the unknown type %q", field.Name, l.FileType, field.Type)
+		}
+		if field.Start < 1 || field.Length < 1 || field.Decimals < 0 {
+			return Schema{}, nil, fmt.Errorf("field %s of the %s layout has an invalid position", field.Name, l.FileType)
+		}
+		for _, other := range l.Fields[:i] {
+			if field.Start < other.Start+other.Length && other.Start < field.Start+field.Length {
+				return Schema{}, nil, fmt.Errorf("fields %s and %s of the %s layout overlap", other.Name, field.Name, l.FileType)
+			}
+		}
+		names[i] = field.Name
+	}
+	schema, columns, err := ResolveHeader(l.FileType, names)
+	if err != nil {
+		return Schema{}, nil, fmt.Errorf("fixed-width layout: %w", err)
+	}
+	return schema, columns, nil
+}
+
+// fixedWidthRows reads records of type T from a fixed-width file, one record per line. Positions count characters,
+// not bytes. Lines shorter than the layout are padded with spaces, characters beyond the layout are ignored and blank
+// lines are skipped.
+type fixedWidthRows[T any] struct {
+	layout    Layout
+	r         io.Reader
+	encoding  string
+	validator *Validator
+	reader    *bufio.Reader
+	decoder   *decoder[T]
+	columns   []string // canonical names of the fields
+	line      int
+}
+
+// NewFixedWidthRows returns the records of a fixed-width file of the given file type, laid out in the fields and
+// transcoded from the encoding to UTF-8. Without fields the file is laid out as in Layouts. The layout is checked
+// against the schema of the file type on the first call to Next. Invalid rows are reported with a *RowError.
+func NewFixedWidthRows[T any](r io.Reader, fileType string, fields []Field, encoding string, validator *Validator) Rows[T] {
+	layout := Layout{FileType: fileType, Fields: fields}
+	if len(fields) == 0 {
+		layout.Fields = Layouts[fileType].Fields
+	}
+	return &fixedWidthRows[T]{layout: layout, r: r, encoding: encoding, validator: validator}
+}
+
+func (r *fixedWidthRows[T]) Next() (T, error) {
+	var record T
+	if r.decoder == nil {
+		schema, columns, err := r.layout.resolve()
+		if err != nil {
+			return record, err
+		}
+		decoded, err := NewDecodingReader(r.r, r.encoding)
+		if err != nil {
+			return record, err
+		}
+		r.reader = bufio.NewReader(decoded)
+		r.decoder = newDecoder[T](schema, columns, r.validator)
+		r.columns = columns
+	}
+
+	for {
+		text, err := r.reader.ReadString('\n')
+		if text == "" && err != nil {
+			return record, err
+		}
+		r.line++
+		text = strings.TrimRight(text, "\r\n")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		return r.decode([]rune(text))
+	}
+}
+
+func (r *fixedWidthRows[T]) decode(line []rune) (T, error) {
+	values := make([]string, len(r.layout.Fields))
+	var errs []FieldError
+	for i, field := range r.layout.Fields {
+		raw := ""
+		if start := field.Start - 1; start < len(line) {
+			raw = string(line[start:min(start+field.Length, len(line))])
+		}
+		value, ok := fixedWidthValue(field, raw)
+		if !ok {
+			errs = append(errs, FieldError{
+				Line:    r.line,
+				Column:  r.columns[i],
+				Value:   raw,
+				Rule:    RuleType,
+				Message: fmt.Sprintf("must be a %s", field.Type),
+			})
+			continue
+		}
+		values[i] = value
+	}
+	if len(errs) > 0 {
+		var record T
+		return record, r.decoder.rowError(r.line, values, errs)
+	}
+	return r.decoder.decode(r.line, values)
+}
+
+// fixedWidthValue converts the raw characters of a field to the text of a CSV column.
+func fixedWidthValue(field Field, raw string) (string, bool) {
+	value := strings.TrimSpace(raw)
+	switch field.Type {
+	case FieldNumber:
+		return impliedDecimal(value, field.Decimals)
+	case FieldDate:
+		if strings.Trim(value, "0") == "" {
+			return "", true
+		}
+	}
+	return value, true
+}
+
+// impliedDecimal converts zero-padded digits with an optional leading or trailing sign to a decimal number, placing
+// the decimal point before the given number of digits.
+func impliedDecimal(value string, decimals int) (string, bool) {
+	if value == "" {
+		return "", true
+	}
+	sign := ""
+	switch {
+	case strings.HasPrefix(value, "-"), strings.HasPrefix(value, "+"):
+		sign, value = value[:1], strings.TrimSpace(value[1:])
+	case strings.HasSuffix(value, "-"), strings.HasSuffix(value, "+"):
+		sign, value = value[len(value)-1:], strings.TrimSpace(value[:len(value)-1])
+	}
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return "", false
+	}
+	if sign == "+" {
+		sign = ""
+	}
+
+	for len(value) <= decimals {
+		value = "0" + value
+	}
+	integer := strings.TrimLeft(value[:len(value)-decimals], "0")
+	if integer == "" {
+		integer = "0"
+	}
+	if decimals == 0 {
+		return sign + integer, true
+	}
+	return sign + integer + "." + value[len(value)-decimals:], true
+}
+
+func ParseClientFixedWidth(data []byte) ([]*Client, error) {
+	return collect(NewFixedWidthRows[Client](bytes.NewReader(data), "clients", nil, EncodingAuto, nil))
+}
+
+func ParsePortfolioFixedWidth(data []byte) ([]*Portfolio, error) {
+	return collect(NewFixedWidthRows[Portfolio](bytes.NewReader(data), "portfolios", nil, EncodingAuto, nil))
+}
+
+func ParseAccountFixedWidth(data []byte) ([]*Account, error) {
+	return collect(NewFixedWidthRows[Account](bytes.NewReader(data), "accounts", nil, EncodingAuto, nil))
+}
+
+func ParseTransactionFixedWidth(data []byte) ([]*Transaction, error) {
+	return collect(NewFixedWidthRows[Transaction](bytes.NewReader(data), "transactions", nil, EncodingAuto, nil))
+}
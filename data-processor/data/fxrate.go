@@ -0,0 +1,92 @@
+package data
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/ryanc414/dynamodbav"
+)
+
+// fxRatePrefix distinguishes exchange rates from data items in the table: fxrate#<currency>#<base>#<business date>.
+const fxRatePrefix = "fxrate#"
+
+// FXRate is the exchange rate of a currency published for a business date: one unit of Currency is worth Rate units of
+// BaseCurrency.
+type FXRate struct {
+	RecordID     int     `dynamodbav:"record_id" csv:"record_id"`
+	Currency     string  `dynamodbav:"currency" csv:"currency"`
+	BaseCurrency string  `dynamodbav:"base_currency" csv:"base_currency"`
+	Rate         Decimal `dynamodbav:"rate" csv:"rate"`
+	Provenance
+}
+
+func fxRateReference(currency string, baseCurrency string, businessDate string) string {
+	return fxRatePrefix + currency + "#" + baseCurrency + "#" + businessDate
+}
+
+// RateSource looks up the exchange rate published for a business date. It returns nil if there is none.
+type RateSource interface {
+	GetFXRate(currency string, baseCurrency string, businessDate string) (*FXRate, error)
+}
+
+func (d DataManager) InsertFXRate(rate FXRate) error {
+	marshalled, err := dynamodbav.MarshalItem(rate)
+	if err != nil {
+		log.Printf("Couldn't marshal FX rate: %v. Error: %v\n", rate, err)
+		return err
+	}
+	marshalled["object_reference"] = &types.AttributeValueMemberS{
+		Value: fxRateReference(rate.Currency, rate.BaseCurrency, rate.BusinessDate),
+	}
+
+	err = d.putItem(marshalled, rate.Provenance)
+	if err != nil {
+		log.Printf("Couldn't insert FX rate: %v. Error: %v\n", rate, err)
+		return err
+	}
+	log.Printf("Inserted FX rate: %v\n", fxRateReference(rate.Currency, rate.BaseCurrency, rate.BusinessDate))
+
+	return nil
+}
+
+func (d DataManager) GetFXRate(currency string, baseCurrency string, businessDate string) (*FXRate, error) {
+	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(fxRateReference(currency, baseCurrency, businessDate)),
+	})
+	if err != nil {
+		log.Printf("Couldn't get FX rate of %v in %v on %v. Error: %v\n", currency, baseCurrency, businessDate, err)
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	var rate FXRate
+	err = attributevalue.UnmarshalMap(result.Item, &rate)
+	if err != nil {
+		log.Printf("Couldn't unmarshal FX rate: %v. Error: %v\n", result.Item, err)
+		return nil, err
+	}
+	return &rate, nil
+}
+
+func (m *MemoryStore) InsertFXRate(rate FXRate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	put(m, m.FXRates, fxRateReference(rate.Currency, rate.BaseCurrency, rate.BusinessDate), rate)
+	return nil
+}
+
+func (m *MemoryStore) GetFXRate(currency string, baseCurrency string, businessDate string) (*FXRate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rate, ok := m.FXRates[fxRateReference(currency, baseCurrency, businessDate)]
+	if !ok {
+		return nil, nil
+	}
+	return &rate, nil
+}
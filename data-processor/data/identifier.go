@@ -0,0 +1,192 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// IdentifierValidator checks the identifiers of a column, e.g. references joining records of different files.
+// Validate explains what is wrong with an invalid identifier.
+type IdentifierValidator interface {
+	Validate(value string) error
+}
+
+// IdentifierFunc is a function used as an IdentifierValidator.
+type IdentifierFunc func(value string) error
+
+func (f IdentifierFunc) Validate(value string) error {
+	return f(value)
+}
+
+// DefaultIdentifiers returns the validators of the identifier columns used unless configured otherwise, see
+// Validator. More validators can be added to the map returned.
+func DefaultIdentifiers() map[string]IdentifierValidator {
+	return map[string]IdentifierValidator{
+		"client_reference":    UUID(),
+		"portfolio_reference": UUID(),
+		"agent_code":          Pattern(`^[A-Z]{6}$`),
+	}
+}
+
+// UUID checks that identifiers are UUIDs formatted as 8-4-4-4-12 hexadecimal digits.
+func UUID() IdentifierValidator {
+	return IdentifierFunc(func(value string) error {
+		if len(value) != 36 {
+			return fmt.Errorf("must be a UUID, it has %d characters instead of 36", len(value))
+		}
+		for i, c := range value {
+			switch {
+			case i == 8 || i == 13 || i == 18 || i == 23:
+				if c != '-' {
+					return fmt.Errorf("must be a UUID, there is no dash at position %d", i+1)
+				}
+			case !strings.ContainsRune("0123456789abcdefABCDEF", c):
+				return fmt.Errorf("must be a UUID, %q at position %d isn't a hexadecimal digit", c, i+1)
+			}
+		}
+		return nil
+	})
+}
+
+// Luhn checks that identifiers are digits ending in a check digit computed with the Luhn algorithm, as used for
+// account numbers.
+func Luhn() IdentifierValidator {
+	return IdentifierFunc(func(value string) error {
+		if len(value) < 2 || strings.Trim(value, "0123456789") != "" {
+			return fmt.Errorf("must be at least two digits")
+		}
+		sum := 0
+		for i := len(value) - 1; i >= 0; i-- {
+			digit := int(value[i] - '0')
+			if (len(value)-1-i)%2 == 1 {
+				digit *= 2
+				if digit > 9 {
+					digit -= 9
+				}
+			}
+			sum += digit
+		}
+		if sum%10 != 0 {
+			return fmt.Errorf("has an invalid check digit")
+		}
+		return nil
+	})
+}
+
+// Pattern checks that identifiers match a regular expression.
+func Pattern(pattern string) IdentifierValidator {
+	re := regexp.MustCompile(pattern)
+	return IdentifierFunc(func(value string) error {
+		if !re.MatchString(value) {
+			return fmt.Errorf("must match %s", pattern)
+		}
+		return nil
+	})
+}
+
+// ParseIdentifierValidator returns the validator named by a specification: uuid, luhn, pattern:<regular expression>
+// or none for no validator.
+func ParseIdentifierValidator(spec string) (IdentifierValidator, error) {
+	name, pattern, _ := strings.Cut(spec, ":")
+	switch name {
+	case "uuid":
+		return UUID(), nil
+	case "luhn":
+		return Luhn(), nil
+	case "none":
+		return nil, nil
+	case "pattern":
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return Pattern(pattern), nil
+	}
+	return nil, fmt.Errorf("unknown identifier validator %q, must be uuid, luhn, pattern:<regular expression> or none", spec)
+}
+
+// ConfigureIdentifiers changes the validators of columns given as a JSON object mapping columns to validators, see
+// ParseIdentifierValidator, e.g. {"account_number": "luhn", "agent_code": "none"}. Other columns keep their validators.
+func (v *Validator) ConfigureIdentifiers(config string) error {
+	if config == "" {
+		return nil
+	}
+	var specs map[string]string
+	err := json.Unmarshal([]byte(config), &specs)
+	if err != nil {
+		return fmt.Errorf("couldn't parse identifier validators: %w", err)
+	}
+	validators := map[string]IdentifierValidator{}
+	for column, spec := range specs {
+		validator, err := ParseIdentifierValidator(spec)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", column, err)
+		}
+		validators[column] = validator
+	}
+	if v.Identifiers == nil {
+		v.Identifiers = map[string]IdentifierValidator{}
+	}
+	for column, validator := range validators {
+		if validator == nil {
+			delete(v.Identifiers, column)
+			continue
+		}
+		v.Identifiers[column] = validator
+	}
+	return nil
+}
+
+// Suggest returns the candidate closest to a mistyped identifier, if one is close enough to be a likely typo: at most
+// a quarter of the characters, and at least one, have to be inserted, removed or replaced. Case is ignored.
+// Candidates whose length alone differs by more than that are skipped without comparing them.
+func Suggest(value string, candidates []string) (string, bool) {
+	maxDistance := max(1, len(value)/4)
+	sorted := append([]string{}, candidates...)
+	sort.Strings(sorted)
+
+	best, bestDistance := "", maxDistance+1
+	for _, candidate := range sorted {
+		if candidate == value || abs(utf8.RuneCountInString(candidate)-utf8.RuneCountInString(value)) >= bestDistance {
+			continue
+		}
+		distance := levenshtein(strings.ToLower(value), strings.ToLower(candidate))
+		if distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best, best != ""
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// levenshtein returns the number of characters which have to be inserted, removed or replaced to turn a into b.
+func levenshtein(a string, b string) int {
+	x, y := []rune(a), []rune(b)
+	previous := make([]int, len(y)+1)
+	current := make([]int, len(y)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		current[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(y)]
+}
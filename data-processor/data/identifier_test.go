@@ -0,0 +1,68 @@
+package data
+
+import "testing"
+
+func TestIdentifierValidators(t *testing.T) {
+	tests := []struct {
+		validator IdentifierValidator
+		value     string
+		valid     bool
+	}{
+		{UUID(), "9e40659b-8b9f-4fc4-814b-5a7b5a23b64d", true},
+		{UUID(), "9E40659B-8B9F-4FC4-814B-5A7B5A23B64D", true},
+		{UUID(), "9e40659b-8b9f-4fc4-814b-5a7b-5a23b64d", false},
+		{UUID(), "9e40659b-8b9f-4fc4-814b05a7b5a23b64d", false},
+		{UUID(), "9e40659b-8b9f-4fc4-814b-5a7b5a23b64g", false},
+		{Luhn(), "79927398713", true},
+		{Luhn(), "79927398710", false},
+		{Luhn(), "7992739871x", false},
+		{Pattern(`^[A-Z]{6}$`), "EREZBT", true},
+		{Pattern(`^[A-Z]{6}$`), "EREZB7", false},
+	}
+	for _, tt := range tests {
+		if err := tt.validator.Validate(tt.value); (err == nil) != tt.valid {
+			t.Errorf("Validate(%s) = %v, want valid %v", tt.value, err, tt.valid)
+		}
+	}
+}
+
+func TestConfigureIdentifiers(t *testing.T) {
+	v := NewValidator()
+	err := v.ConfigureIdentifiers(`{"account_number": "luhn", "agent_code": "none", "client_reference": "pattern:^C[0-9]+$"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.Identifiers["agent_code"]; ok {
+		t.Errorf("agent_code is still validated")
+	}
+	if v.Identifiers["account_number"].Validate("12345678") == nil || v.Identifiers["client_reference"].Validate("C12") != nil {
+		t.Errorf("configured validators don't apply")
+	}
+	if v.ConfigureIdentifiers(`{"account_number": "crc32"}`) == nil || v.ConfigureIdentifiers(`{"agent_code": "pattern:["}`) == nil {
+		t.Errorf("ConfigureIdentifiers() accepted an invalid validator")
+	}
+	// Other validators and rows opened without a validator are not affected.
+	if _, ok := NewValidator().Identifiers["agent_code"]; !ok {
+		t.Errorf("ConfigureIdentifiers() changed the default validators")
+	}
+	if _, err := ParsePortfolioCSV([]byte("record_id,account_number,portfolio_reference,client_reference,agent_code\n1,1,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,erezbt\n")); err == nil {
+		t.Errorf("ParsePortfolioCSV() accepted an invalid agent code after ConfigureIdentifiers()")
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	known := []string{"9e40659b-8b9f-4fc4-814b-5a7b5a23b64d", "f4a0cc2c-d0b4-4f14-b202-c8a5e45e90e7"}
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"9e40659b-8b9f-4fc4-814b-5a7b-5a23b64d", "9e40659b-8b9f-4fc4-814b-5a7b5a23b64d"},
+		{"F4A0CC2C-D0B4-4F14-B202-C8A5E45E90E", "f4a0cc2c-d0b4-4f14-b202-c8a5e45e90e7"},
+		{"439695b4-508d-4562-8576-670e70024627", ""},
+	}
+	for _, tt := range tests {
+		if got, _ := Suggest(tt.value, known); got != tt.want {
+			t.Errorf("Suggest(%s) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// jsonRows reads records of type T from JSON objects, either one per line (JSON Lines) or the elements of an array.
+// The keys of the objects are matched against the latest version of the schema of the file type, as objects leave
+// out keys rather than columns changing over time. Keys may be aliases, unknown keys make a row invalid.
+type jsonRows[T any] struct {
+	fileType  string
+	validator *Validator
+	names     map[string]string // canonical column names by name and alias
+	index     map[string]int    // position of every canonical column in the rows passed to the decoder
+	decoder   *decoder[T]
+	// object returns the next object and the line, or for arrays the position, it was read from.
+	object func() (map[string]json.RawMessage, int, error)
+}
+
+// NewJSONLRows returns the records of a JSON Lines file of the given file type, one object per line. Blank lines are
+// skipped. Lines which aren't JSON objects are reported as invalid rows.
+func NewJSONLRows[T any](r io.Reader, fileType string, validator *Validator) Rows[T] {
+	reader := bufio.NewReader(r)
+	line := 0
+	rows := &jsonRows[T]{fileType: fileType, validator: validator}
+	rows.object = func() (map[string]json.RawMessage, int, error) {
+		for {
+			text, err := reader.ReadBytes('\n')
+			if len(text) == 0 && err != nil {
+				return nil, line, err
+			}
+			line++
+			text = bytes.TrimSpace(text)
+			if len(text) == 0 {
+				continue
+			}
+			var object map[string]json.RawMessage
+			if json.Unmarshal(text, &object) != nil || object == nil {
+				return nil, line, &RowError{Line: line, Errors: []FieldError{{
+					Line:    line,
+					Value:   string(text),
+					Rule:    RuleFormat,
+					Message: "is not a JSON object",
+				}}}
+			}
+			return object, line, nil
+		}
+	}
+	return rows
+}
+
+// NewJSONRows returns the records of a JSON file of the given file type holding an array of objects. The objects are
+// decoded one at a time. Errors report the position of the object in the array instead of a line.
+func NewJSONRows[T any](r io.Reader, fileType string, validator *Validator) Rows[T] {
+	decoder := json.NewDecoder(r)
+	position := 0
+	rows := &jsonRows[T]{fileType: fileType, validator: validator}
+	rows.object = func() (map[string]json.RawMessage, int, error) {
+		if position == 0 {
+			token, err := decoder.Token()
+			if errors.Is(err, io.EOF) {
+				return nil, position, ErrEmptyFile
+			}
+			if err != nil {
+				return nil, position, err
+			}
+			if token != json.Delim('[') {
+				return nil, position, fmt.Errorf("expected an array of objects")
+			}
+		}
+		if !decoder.More() {
+			_, err := decoder.Token()
+			if err != nil {
+				return nil, position, err
+			}
+			return nil, position, io.EOF
+		}
+		position++
+
+		var object map[string]json.RawMessage
+		err := decoder.Decode(&object)
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) || (err == nil && object == nil) {
+			return nil, position, &RowError{Line: position, Errors: []FieldError{{
+				Line:    position,
+				Rule:    RuleFormat,
+				Message: "is not a JSON object",
+			}}}
+		}
+		return object, position, err
+	}
+	return rows
+}
+
+func (r *jsonRows[T]) Next() (T, error) {
+	var record T
+	if r.decoder == nil {
+		schema, err := LatestSchema(r.fileType)
+		if err != nil {
+			return record, err
+		}
+		var header []string
+		r.index = map[string]int{}
+		for i, column := range schema.Columns {
+			header = append(header, column.Name)
+			r.index[column.Name] = i
+		}
+		r.names, r.decoder = schema.names(), newDecoder[T](schema, header, r.validator)
+	}
+
+	object, line, err := r.object()
+	if err != nil {
+		return record, err
+	}
+
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	row := make([]string, len(r.index))
+	var errs []FieldError
+	for _, key := range keys {
+		canonical, ok := r.names[strings.ToLower(strings.TrimSpace(key))]
+		if !ok {
+			errs = append(errs, FieldError{Line: line, Column: key, Value: string(object[key]), Rule: RuleColumns, Message: "is not a column of the schema"})
+			continue
+		}
+		value, err := jsonValue(object[key])
+		if err != nil {
+			errs = append(errs, FieldError{Line: line, Column: canonical, Value: string(object[key]), Rule: RuleType, Message: err.Error()})
+			continue
+		}
+		row[r.index[canonical]] = value
+	}
+
+	record, err = r.decoder.decode(line, row)
+	if len(errs) == 0 {
+		return record, err
+	}
+	var rowErr *RowError
+	if errors.As(err, &rowErr) {
+		// Values which aren't scalars have been left empty, they don't need to be reported as missing as well.
+		reported := map[string]bool{}
+		for _, fieldErr := range errs {
+			reported[fieldErr.Column] = true
+		}
+		for _, fieldErr := range rowErr.Errors {
+			if fieldErr.Rule != RuleRequired || !reported[fieldErr.Column] {
+				errs = append(errs, fieldErr)
+			}
+		}
+		rowErr.Errors = errs
+		return record, rowErr
+	}
+	return record, r.decoder.rowError(line, row, errs)
+}
+
+// jsonValue returns the text of a JSON scalar as it would appear in a CSV file. null becomes an empty value.
+func jsonValue(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case bytes.Equal(raw, []byte("null")):
+		return "", nil
+	case len(raw) > 0 && raw[0] == '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case len(raw) > 0 && (raw[0] == '{' || raw[0] == '['):
+		return "", fmt.Errorf("must be a string, number or boolean")
+	}
+	return string(raw), nil
+}
+
+func ParseClientJSONL(data []byte) ([]*Client, error) {
+	return collect(NewJSONLRows[Client](bytes.NewReader(data), "clients", nil))
+}
+
+func ParseClientJSON(data []byte) ([]*Client, error) {
+	return collect(NewJSONRows[Client](bytes.NewReader(data), "clients", nil))
+}
+
+func ParsePortfolioJSONL(data []byte) ([]*Portfolio, error) {
+	return collect(NewJSONLRows[Portfolio](bytes.NewReader(data), "portfolios", nil))
+}
+
+func ParsePortfolioJSON(data []byte) ([]*Portfolio, error) {
+	return collect(NewJSONRows[Portfolio](bytes.NewReader(data), "portfolios", nil))
+}
+
+func ParseAccountJSONL(data []byte) ([]*Account, error) {
+	return collect(NewJSONLRows[Account](bytes.NewReader(data), "accounts", nil))
+}
+
+func ParseAccountJSON(data []byte) ([]*Account, error) {
+	return collect(NewJSONRows[Account](bytes.NewReader(data), "accounts", nil))
+}
+
+func ParseTransactionJSONL(data []byte) ([]*Transaction, error) {
+	return collect(NewJSONLRows[Transaction](bytes.NewReader(data), "transactions", nil))
+}
+
+func ParseTransactionJSON(data []byte) ([]*Transaction, error) {
+	return collect(NewJSONRows[Transaction](bytes.NewReader(data), "transactions", nil))
+}
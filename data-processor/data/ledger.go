@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/ryanc414/dynamodbav"
+)
+
+// ledgerPrefix distinguishes ledger entries from data items in the table: ledger#<bucket>/<key>.
+const ledgerPrefix = "ledger#"
+
+// Ledger statuses
+const (
+	LedgerProcessed = "processed"
+	LedgerFailed    = "failed"
+	LedgerRetracted = "retracted"
+)
+
+// ObjectVersion identifies a version of a file. Any of the fields may be unknown, e.g. S3 only reports version IDs
+// for versioned buckets and the checksum is only known once the file has been downloaded.
+type ObjectVersion struct {
+	VersionID string `dynamodbav:"version_id" json:"version_id,omitempty"`
+	ETag      string `dynamodbav:"etag" json:"etag,omitempty"`
+	Checksum  string `dynamodbav:"checksum" json:"checksum,omitempty"`
+}
+
+// Matches reports whether two versions are known to be the same, comparing whichever identifiers are known for both.
+func (v ObjectVersion) Matches(other ObjectVersion) bool {
+	switch {
+	case v.VersionID != "" && other.VersionID != "":
+		return v.VersionID == other.VersionID
+	case v.ETag != "" && other.ETag != "":
+		return v.ETag == other.ETag
+	case v.Checksum != "" && other.Checksum != "":
+		return v.Checksum == other.Checksum
+	}
+	return false
+}
+
+// LedgerEntry records the outcome of the last processing of a file.
+type LedgerEntry struct {
+	ObjectReference string `dynamodbav:"object_reference" json:"-"`
+	Bucket          string `dynamodbav:"bucket" json:"bucket"`
+	Key             string `dynamodbav:"key" json:"key"`
+	ObjectVersion
+	Status    string    `dynamodbav:"status" json:"status"`
+	UpdatedAt time.Time `dynamodbav:"updated_at" json:"updated_at"`
+}
+
+func ledgerReference(bucket string, key string) string {
+	return ledgerPrefix + bucket + "/" + key
+}
+
+func (d DataManager) GetLedgerEntry(bucket string, key string) (*LedgerEntry, error) {
+	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(ledgerReference(bucket, key)),
+	})
+	if err != nil {
+		log.Printf("Couldn't get ledger entry for %v:%v. Error: %v\n", bucket, key, err)
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	return dynamodbav.UnmarshalItem[LedgerEntry](result.Item)
+}
+
+func (d DataManager) PutLedgerEntry(entry LedgerEntry) error {
+	entry.ObjectReference = ledgerReference(entry.Bucket, entry.Key)
+	marshalled, err := dynamodbav.MarshalItem(entry)
+	if err != nil {
+		log.Printf("Couldn't marshal ledger entry: %v. Error: %v\n", entry, err)
+		return err
+	}
+	_, err = d.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item:      marshalled,
+	})
+	if err != nil {
+		log.Printf("Couldn't put ledger entry: %v. Error: %v\n", entry, err)
+	}
+	return err
+}
+
+func (m *MemoryStore) GetLedgerEntry(bucket string, key string) (*LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.ledger[ledgerReference(bucket, key)]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (m *MemoryStore) PutLedgerEntry(entry LedgerEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.ObjectReference = ledgerReference(entry.Bucket, entry.Key)
+	m.ledger[entry.ObjectReference] = entry
+	return nil
+}
@@ -0,0 +1,509 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// RoundingMode decides how a decimal is rounded to fewer decimal places.
+type RoundingMode int
+
+const (
+	RoundHalfEven RoundingMode = iota // to the nearest neighbour, ties to the even one (banker's rounding)
+	RoundHalfUp                       // to the nearest neighbour, ties away from zero (commercial rounding)
+	RoundHalfDown                     // to the nearest neighbour, ties towards zero
+	RoundDown                         // towards zero, i.e. truncated
+	RoundUp                           // away from zero
+	RoundFloor                        // towards negative infinity
+	RoundCeiling                      // towards positive infinity
+)
+
+// roundingModes are the names of the rounding modes in configuration.
+var roundingModes = map[string]RoundingMode{
+	"half-even": RoundHalfEven,
+	"half-up":   RoundHalfUp,
+	"half-down": RoundHalfDown,
+	"down":      RoundDown,
+	"up":        RoundUp,
+	"floor":     RoundFloor,
+	"ceiling":   RoundCeiling,
+}
+
+// DefaultRounding is the rounding mode used where amounts are rounded implicitly, e.g. when converting currencies,
+// see SetDefaultRounding.
+var DefaultRounding = RoundHalfEven
+
+// SetDefaultRounding sets DefaultRounding by the name of a rounding mode, e.g. half-up. An empty name rounds half-even.
+func SetDefaultRounding(name string) error {
+	if name == "" {
+		DefaultRounding = RoundHalfEven
+		return nil
+	}
+	mode, ok := roundingModes[name]
+	if !ok {
+		names := make([]string, 0, len(roundingModes))
+		for name := range roundingModes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown rounding mode %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+	DefaultRounding = mode
+	return nil
+}
+
+// ErrCurrencyMismatch is returned when amounts in different currencies are combined.
+var ErrCurrencyMismatch = errors.New("currencies don't match")
+
+// Decimal is an exact decimal number: an integer coefficient scaled by a number of decimal places. It keeps the
+// decimal places it was parsed with, so 1.50 stays 1.50. The zero value is 0.
+type Decimal struct {
+	coefficient *big.Int // nil for zero, never modified once set
+	scale       int32    // number of decimal places, not negative
+}
+
+// NewDecimal returns coefficient / 10^scale, e.g. NewDecimal(12345, 2) is 123.45.
+func NewDecimal(coefficient int64, scale int32) Decimal {
+	if scale < 0 {
+		return Decimal{coefficient: new(big.Int).Mul(big.NewInt(coefficient), pow10(-scale))}
+	}
+	return Decimal{coefficient: big.NewInt(coefficient), scale: scale}
+}
+
+// MaxDecimalDigits is the number of significant digits, decimal places and digits before the decimal point a parsed
+// decimal may have, which is the precision of DynamoDB numbers.
+const MaxDecimalDigits = 38
+
+// ParseDecimal parses a decimal number like -1234.50, +7 or 1.5e3. Unlike floating point numbers the value is exact.
+// Decimals with more than MaxDecimalDigits digits or decimal places are rejected.
+func ParseDecimal(s string) (Decimal, error) {
+	text := s
+	exponent := int64(0)
+	if i := strings.IndexAny(text, "eE"); i >= 0 {
+		var err error
+		exponent, err = strconv.ParseInt(text[i+1:], 10, 32)
+		if err != nil {
+			return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+		}
+		text = text[:i]
+	}
+	sign := ""
+	if strings.HasPrefix(text, "-") || strings.HasPrefix(text, "+") {
+		sign, text = text[:1], text[1:]
+	}
+	integer, fraction, _ := strings.Cut(text, ".")
+	digits := integer + fraction
+	if strings.Contains(digits, ",") {
+		return Decimal{}, fmt.Errorf("invalid decimal %q, the decimal separator is a point unless the dialect of the file sets it to a comma", s)
+	}
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+	}
+
+	// The bounds are checked before the coefficient is scaled, so that an exponent like 1e200000000 doesn't compute a
+	// huge power of ten.
+	scale := int64(len(fraction)) - exponent
+	significant := int64(len(strings.TrimLeft(digits, "0")))
+	if significant > MaxDecimalDigits || scale > MaxDecimalDigits || significant-scale > MaxDecimalDigits {
+		return Decimal{}, fmt.Errorf("decimal %q exceeds %d digits", s, MaxDecimalDigits)
+	}
+	coefficient, _ := new(big.Int).SetString(sign+digits, 10)
+	if scale < 0 {
+		return Decimal{coefficient: coefficient.Mul(coefficient, pow10(int32(-scale)))}, nil
+	}
+	return Decimal{coefficient: coefficient, scale: int32(scale)}, nil
+}
+
+func (d Decimal) coef() *big.Int {
+	if d.coefficient == nil {
+		return new(big.Int)
+	}
+	return d.coefficient
+}
+
+// Scale returns the number of decimal places.
+func (d Decimal) Scale() int32 {
+	return d.scale
+}
+
+// String formats the decimal with all of its decimal places, e.g. -0.50.
+func (d Decimal) String() string {
+	digits := new(big.Int).Abs(d.coef()).String()
+	if d.scale > 0 {
+		for len(digits) <= int(d.scale) {
+			digits = "0" + digits
+		}
+		digits = digits[:len(digits)-int(d.scale)] + "." + digits[len(digits)-int(d.scale):]
+	}
+	if d.coef().Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// Sign returns -1, 0 or 1.
+func (d Decimal) Sign() int {
+	return d.coef().Sign()
+}
+
+// IsZero reports whether the decimal is 0.
+func (d Decimal) IsZero() bool {
+	return d.Sign() == 0
+}
+
+// Cmp compares two decimals by value, so 1.5 and 1.50 are equal.
+func (d Decimal) Cmp(e Decimal) int {
+	a, b := align(d, e)
+	return a.Cmp(b)
+}
+
+// Neg returns -d.
+func (d Decimal) Neg() Decimal {
+	return Decimal{coefficient: new(big.Int).Neg(d.coef()), scale: d.scale}
+}
+
+// Add returns d + e with the larger number of decimal places.
+func (d Decimal) Add(e Decimal) Decimal {
+	a, b := align(d, e)
+	return Decimal{coefficient: new(big.Int).Add(a, b), scale: max(d.scale, e.scale)}
+}
+
+// Sub returns d - e with the larger number of decimal places.
+func (d Decimal) Sub(e Decimal) Decimal {
+	return d.Add(e.Neg())
+}
+
+// Mul returns d * e exactly, with the decimal places of both.
+func (d Decimal) Mul(e Decimal) Decimal {
+	return Decimal{coefficient: new(big.Int).Mul(d.coef(), e.coef()), scale: d.scale + e.scale}
+}
+
+// Quo returns d / e rounded to the given number of decimal places.
+func (d Decimal) Quo(e Decimal, scale int32, mode RoundingMode) (Decimal, error) {
+	if e.IsZero() {
+		return Decimal{}, errors.New("division by zero")
+	}
+	// d / e = dc * 10^es / (ec * 10^ds), scaled by 10^scale
+	numerator := new(big.Int).Mul(d.coef(), pow10(e.scale+scale))
+	denominator := new(big.Int).Mul(e.coef(), pow10(d.scale))
+	return Decimal{coefficient: roundQuo(numerator, denominator, mode), scale: scale}, nil
+}
+
+// Round returns the decimal with the given number of decimal places, rounding if it has more.
+func (d Decimal) Round(scale int32, mode RoundingMode) Decimal {
+	if scale >= d.scale {
+		return Decimal{coefficient: new(big.Int).Mul(d.coef(), pow10(scale-d.scale)), scale: scale}
+	}
+	return Decimal{coefficient: roundQuo(d.coef(), pow10(d.scale-scale), mode), scale: scale}
+}
+
+// Float64 returns the nearest floating point number, e.g. for display. It is not meant for calculations.
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// UnmarshalCSV parses the decimal of a column, see ParseDecimal.
+func (d *Decimal) UnmarshalCSV(value string) error {
+	parsed, err := ParseDecimal(value)
+	if err != nil {
+		return fmt.Errorf("must be a number")
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalJSON writes the decimal as a JSON number with all of its decimal places.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON reads a decimal from a JSON number or string.
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	text := string(b)
+	if text == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+	parsed, err := ParseDecimal(text)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalDynamoDBAttributeValue stores the decimal as a number, which DynamoDB keeps exactly.
+func (d Decimal) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	return &types.AttributeValueMemberN{Value: d.String()}, nil
+}
+
+// UnmarshalDynamoDBAttributeValue reads a decimal stored as a number or a string.
+func (d *Decimal) UnmarshalDynamoDBAttributeValue(value types.AttributeValue) error {
+	var text string
+	switch value := value.(type) {
+	case *types.AttributeValueMemberN:
+		text = value.Value
+	case *types.AttributeValueMemberS:
+		text = value.Value
+	case *types.AttributeValueMemberNULL:
+		return nil
+	default:
+		return fmt.Errorf("can't read a decimal from %T", value)
+	}
+	parsed, err := ParseDecimal(text)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// align returns the coefficients of two decimals scaled to the same number of decimal places.
+func align(d, e Decimal) (*big.Int, *big.Int) {
+	a, b := d.coef(), e.coef()
+	switch {
+	case d.scale < e.scale:
+		a = new(big.Int).Mul(a, pow10(e.scale-d.scale))
+	case e.scale < d.scale:
+		b = new(big.Int).Mul(b, pow10(d.scale-e.scale))
+	}
+	return a, b
+}
+
+// roundQuo divides and rounds the quotient according to the rounding mode.
+func roundQuo(numerator, denominator *big.Int, mode RoundingMode) *big.Int {
+	quotient, remainder := new(big.Int).QuoRem(numerator, denominator, new(big.Int))
+	if remainder.Sign() == 0 {
+		return quotient
+	}
+	sign := int64(numerator.Sign() * denominator.Sign())
+	half := new(big.Int).Abs(remainder)
+	half.Lsh(half, 1)
+	tie := half.Cmp(new(big.Int).Abs(denominator)) // compares the remainder with half of the denominator
+
+	away := false
+	switch mode {
+	case RoundHalfEven:
+		away = tie > 0 || tie == 0 && quotient.Bit(0) == 1
+	case RoundHalfUp:
+		away = tie >= 0
+	case RoundHalfDown:
+		away = tie > 0
+	case RoundUp:
+		away = true
+	case RoundFloor:
+		away = sign < 0
+	case RoundCeiling:
+		away = sign > 0
+	}
+	if away {
+		quotient.Add(quotient, big.NewInt(sign))
+	}
+	return quotient
+}
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// Money is an exact amount in a currency. Files carry amounts and currencies in separate columns, so amounts are
+// parsed, stored in DynamoDB as numbers and written to JSON without their currency, which records set from their
+// currency column. Arithmetic on amounts in different currencies fails with ErrCurrencyMismatch, an amount without a
+// currency takes the currency of the other one.
+type Money struct {
+	amount   Decimal
+	currency string
+}
+
+// NewMoney returns an amount in a currency.
+func NewMoney(amount Decimal, currency string) Money {
+	return Money{amount: amount, currency: currency}
+}
+
+// ParseMoney parses an amount like 789.56, optionally followed or preceded by its currency as in 789.56 EUR. A
+// currency in the text has to match the given currency, if there is one.
+func ParseMoney(s string, currency string) (Money, error) {
+	fields := strings.Fields(s)
+	amount, code := s, ""
+	switch {
+	case len(fields) == 2 && isCurrencyCode(fields[1]):
+		amount, code = fields[0], fields[1]
+	case len(fields) == 2 && isCurrencyCode(fields[0]):
+		amount, code = fields[1], fields[0]
+	}
+	if code != "" {
+		if currency != "" && code != currency {
+			return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, code, currency)
+		}
+		currency = code
+	}
+	decimal, err := ParseDecimal(amount)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{amount: decimal, currency: currency}, nil
+}
+
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Amount returns the amount without its currency.
+func (m Money) Amount() Decimal {
+	return m.amount
+}
+
+// Currency returns the ISO 4217 code of the currency, or "" if the currency isn't known.
+func (m Money) Currency() string {
+	return m.currency
+}
+
+// In returns the amount in the given currency, without converting it.
+func (m Money) In(currency string) Money {
+	return Money{amount: m.amount, currency: currency}
+}
+
+// String formats the amount followed by its currency, e.g. 789.56 EUR.
+func (m Money) String() string {
+	if m.currency == "" {
+		return m.amount.String()
+	}
+	return m.amount.String() + " " + m.currency
+}
+
+// Sign returns -1, 0 or 1.
+func (m Money) Sign() int {
+	return m.amount.Sign()
+}
+
+// IsZero reports whether the amount is 0.
+func (m Money) IsZero() bool {
+	return m.amount.IsZero()
+}
+
+// Cmp compares two amounts in the same currency.
+func (m Money) Cmp(n Money) (int, error) {
+	_, err := m.common(n)
+	if err != nil {
+		return 0, err
+	}
+	return m.amount.Cmp(n.amount), nil
+}
+
+// Equal reports whether two amounts have the same value and currency.
+func (m Money) Equal(n Money) bool {
+	return m.currency == n.currency && m.amount.Cmp(n.amount) == 0
+}
+
+// Neg returns -m.
+func (m Money) Neg() Money {
+	return Money{amount: m.amount.Neg(), currency: m.currency}
+}
+
+// Add returns m + n.
+func (m Money) Add(n Money) (Money, error) {
+	currency, err := m.common(n)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{amount: m.amount.Add(n.amount), currency: currency}, nil
+}
+
+// Sub returns m - n.
+func (m Money) Sub(n Money) (Money, error) {
+	return m.Add(n.Neg())
+}
+
+// Mul returns the amount multiplied by a factor, exactly. Round the result to get back to the decimal places of the
+// currency.
+func (m Money) Mul(factor Decimal) Money {
+	return Money{amount: m.amount.Mul(factor), currency: m.currency}
+}
+
+// Round rounds the amount to the given number of decimal places.
+func (m Money) Round(scale int32, mode RoundingMode) Money {
+	return Money{amount: m.amount.Round(scale, mode), currency: m.currency}
+}
+
+// common returns the currency of the result of combining two amounts.
+func (m Money) common(n Money) (string, error) {
+	switch {
+	case m.currency == n.currency, n.currency == "":
+		return m.currency, nil
+	case m.currency == "":
+		return n.currency, nil
+	}
+	return "", fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.currency, n.currency)
+}
+
+// SumMoney adds up amounts, which have to be in the same currency. The sum of no amounts is 0 without a currency.
+func SumMoney(amounts ...Money) (Money, error) {
+	var sum Money
+	for _, amount := range amounts {
+		var err error
+		sum, err = sum.Add(amount)
+		if err != nil {
+			return Money{}, err
+		}
+	}
+	return sum, nil
+}
+
+// UnmarshalCSV parses the amount of a column, see ParseMoney.
+func (m *Money) UnmarshalCSV(value string) error {
+	parsed, err := ParseMoney(value, m.currency)
+	if err != nil {
+		return fmt.Errorf("must be a number")
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalJSON writes the amount as a JSON number with all of its decimal places.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.amount.String()), nil
+}
+
+// UnmarshalJSON reads an amount from a JSON number or string.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	text := string(b)
+	if text == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+	parsed, err := ParseMoney(text, m.currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalDynamoDBAttributeValue stores the amount as a number, which DynamoDB keeps exactly.
+func (m Money) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	return &types.AttributeValueMemberN{Value: m.amount.String()}, nil
+}
+
+// UnmarshalDynamoDBAttributeValue reads an amount stored as a number or a string.
+func (m *Money) UnmarshalDynamoDBAttributeValue(value types.AttributeValue) error {
+	return m.amount.UnmarshalDynamoDBAttributeValue(value)
+}
@@ -0,0 +1,302 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "789.56", want: "789.56"},
+		{input: "15000.00", want: "15000.00"},
+		{input: "-0.05", want: "-0.05"},
+		{input: "+7", want: "7"},
+		{input: ".5", want: "0.5"},
+		{input: "1.5e3", want: "1500"},
+		{input: "12345E-4", want: "1.2345"},
+		{input: "1,5", wantErr: true}, // see Dialect.DecimalPoint
+		{input: "-", wantErr: true},
+		{input: "NaN", wantErr: true},
+		{input: "1.2.3", wantErr: true},
+		{input: "1e200000000", wantErr: true},
+		{input: "1e-200000000", wantErr: true},
+		{input: "1e37", want: "10000000000000000000000000000000000000"},
+		{input: "1e38", wantErr: true},
+		{input: "0.00000000000000000000000000000000000001", want: "0.00000000000000000000000000000000000001"},
+		{input: "0.000000000000000000000000000000000000001", wantErr: true},
+		{input: "123456789012345678901234567890123456789", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseDecimal(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDecimal() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseDecimal() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	sum := mustDecimal(t, "0.1").Add(mustDecimal(t, "0.2"))
+	if sum.Cmp(mustDecimal(t, "0.3")) != 0 {
+		t.Errorf("0.1 + 0.2 = %s, want 0.3", sum)
+	}
+	if got := mustDecimal(t, "10").Sub(mustDecimal(t, "0.01")).String(); got != "9.99" {
+		t.Errorf("10 - 0.01 = %s, want 9.99", got)
+	}
+	if got := mustDecimal(t, "19.99").Mul(mustDecimal(t, "0.19")).String(); got != "3.7981" {
+		t.Errorf("19.99 * 0.19 = %s, want 3.7981", got)
+	}
+	got, err := mustDecimal(t, "100").Quo(mustDecimal(t, "3"), 2, RoundHalfEven)
+	if err != nil || got.String() != "33.33" {
+		t.Errorf("100 / 3 = %s, %v, want 33.33", got, err)
+	}
+	if _, err := mustDecimal(t, "1").Quo(Decimal{}, 2, RoundHalfEven); err == nil {
+		t.Errorf("1 / 0 didn't fail")
+	}
+}
+
+func TestDecimalRound(t *testing.T) {
+	tests := []struct {
+		input string
+		mode  RoundingMode
+		want  string
+	}{
+		{"2.345", RoundHalfEven, "2.34"},
+		{"2.355", RoundHalfEven, "2.36"},
+		{"-2.345", RoundHalfEven, "-2.34"},
+		{"2.345", RoundHalfUp, "2.35"},
+		{"-2.345", RoundHalfUp, "-2.35"},
+		{"2.345", RoundHalfDown, "2.34"},
+		{"2.3451", RoundHalfDown, "2.35"},
+		{"2.349", RoundDown, "2.34"},
+		{"-2.349", RoundDown, "-2.34"},
+		{"2.341", RoundUp, "2.35"},
+		{"-2.341", RoundUp, "-2.35"},
+		{"-2.341", RoundFloor, "-2.35"},
+		{"2.349", RoundFloor, "2.34"},
+		{"-2.349", RoundCeiling, "-2.34"},
+		{"2.341", RoundCeiling, "2.35"},
+		{"2.5", RoundHalfEven, "2.50"},
+	}
+	for _, tt := range tests {
+		if got := mustDecimal(t, tt.input).Round(2, tt.mode).String(); got != tt.want {
+			t.Errorf("Round(%s, %d) = %s, want %s", tt.input, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestMoney(t *testing.T) {
+	eur := NewMoney(mustDecimal(t, "789.56"), "EUR")
+	if _, err := eur.Add(NewMoney(mustDecimal(t, "1"), "USD")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Add() error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+	sum, err := SumMoney(eur, NewMoney(mustDecimal(t, "0.44"), ""), eur.Neg())
+	if err != nil || sum.String() != "0.44 EUR" {
+		t.Errorf("SumMoney() = %s, %v, want 0.44 EUR", sum, err)
+	}
+	if _, err := ParseMoney("12.30 USD", "EUR"); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("ParseMoney() error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+
+	encoded, err := json.Marshal(struct{ Amount Money }{eur})
+	if err != nil || string(encoded) != `{"Amount":789.56}` {
+		t.Errorf("json.Marshal() = %s, %v", encoded, err)
+	}
+	var decoded struct{ Amount Money }
+	err = json.Unmarshal([]byte(`{"Amount":"15000.10"}`), &decoded)
+	if err != nil || decoded.Amount.String() != "15000.10" {
+		t.Errorf("json.Unmarshal() = %s, %v, want 15000.10", decoded.Amount, err)
+	}
+}
+
+func TestAccountRoundTrip(t *testing.T) {
+	rows, err := ParseAccountCSV([]byte("record_id,account_number,cash_balance,currency,taxes_paid\n1,12345678,15000.10,EUR,0.30\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := rows[0]
+	err = account.Stamp(Provenance{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.Transactions = []*Transaction{
+		{TransactionReference: "1", Amount: NewMoney(mustDecimal(t, "0.10"), "")},
+		{TransactionReference: "2", Amount: NewMoney(mustDecimal(t, "-0.20"), "")},
+	}
+	err = account.UpdateBalance()
+	if err != nil || account.Balance.String() != "15000.00 EUR" {
+		t.Errorf("UpdateBalance() = %s, %v, want 15000.00 EUR", account.Balance, err)
+	}
+
+	item, err := attributevalue.MarshalMap(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := item["cash_balance"].(*types.AttributeValueMemberN); !ok || n.Value != "15000.10" {
+		t.Errorf("cash_balance = %#v, want the number 15000.10", item["cash_balance"])
+	}
+	var unmarshalled Account
+	err = attributevalue.UnmarshalMap(item, &unmarshalled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshalled.applyCurrency()
+	if !unmarshalled.TaxesPaid.Equal(account.TaxesPaid) || unmarshalled.Balance.String() != "15000.00 EUR" {
+		t.Errorf("unmarshalled account = %+v, want %+v", unmarshalled, account)
+	}
+}
+
+func mustDecimal(t *testing.T, s string) Decimal {
+	t.Helper()
+	d, err := ParseDecimal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestSetDefaultRounding(t *testing.T) {
+	defer SetDefaultRounding("")
+
+	if err := SetDefaultRounding("half-up"); err != nil || DefaultRounding != RoundHalfUp {
+		t.Errorf("SetDefaultRounding(half-up) = %v, DefaultRounding = %v, want %v", err, DefaultRounding, RoundHalfUp)
+	}
+	if err := SetDefaultRounding("bankers"); err == nil {
+		t.Errorf("SetDefaultRounding(bankers) = nil, want an error")
+	}
+	if err := SetDefaultRounding(""); err != nil || DefaultRounding != RoundHalfEven {
+		t.Errorf("SetDefaultRounding() = %v, DefaultRounding = %v, want %v", err, DefaultRounding, RoundHalfEven)
+	}
+}
+
+func TestAccountCurrencyMismatch(t *testing.T) {
+	_, err := ParseAccountCSV([]byte("record_id,account_number,cash_balance,currency,taxes_paid\n1,12345678,100 USD,EUR,0.00\n"))
+	var rowErr *RowError
+	if !errors.As(err, &rowErr) || len(rowErr.Errors) != 1 || rowErr.Errors[0].Column != "cash_balance" || rowErr.Errors[0].Rule != RuleCurrency {
+		t.Errorf("ParseAccountCSV() error = %v, want a currency error for cash_balance", err)
+	}
+
+	accounts, err := ParseAccountCSV([]byte("record_id,account_number,cash_balance,currency,taxes_paid\n1,12345678,100 EUR,EUR,0.00\n"))
+	if err != nil || len(accounts) != 1 {
+		t.Fatalf("ParseAccountCSV() = %v, %v, want one account", accounts, err)
+	}
+}
+
+func TestAmountColumnsWithCurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		parse    func() error
+		wantRule string // the rule of the only error, empty for none
+	}{
+		{"taxes paid in the currency of the account", func() error {
+			_, err := ParseAccountCSV([]byte("record_id,account_number,cash_balance,currency,taxes_paid\n1,12345678,100.00,EUR,0.30 EUR\n"))
+			return err
+		}, ""},
+		{"taxes paid in another currency", func() error {
+			_, err := ParseAccountCSV([]byte("record_id,account_number,cash_balance,currency,taxes_paid\n1,12345678,100.00,EUR,0.30 USD\n"))
+			return err
+		}, RuleCurrency},
+		{"negative taxes paid", func() error {
+			_, err := ParseAccountCSV([]byte("record_id,account_number,cash_balance,currency,taxes_paid\n1,12345678,100.00,EUR,-0.30 EUR\n"))
+			return err
+		}, RuleRange},
+		{"allowance in EUR", func() error {
+			_, err := ParseClientCSV([]byte("record_id,first_name,last_name,client_reference,tax_free_allowance\n1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801 EUR\n"))
+			return err
+		}, ""},
+		{"allowance in USD", func() error {
+			_, err := ParseClientCSV([]byte("record_id,first_name,last_name,client_reference,tax_free_allowance\n1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801 USD\n"))
+			return err
+		}, RuleCurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.parse()
+			if tt.wantRule == "" {
+				if err != nil {
+					t.Errorf("error = %v, want none", err)
+				}
+				return
+			}
+			var rowErr *RowError
+			if !errors.As(err, &rowErr) || len(rowErr.Errors) != 1 || rowErr.Errors[0].Rule != tt.wantRule {
+				t.Errorf("error = %v, want a %s error", err, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestDecimalPoint(t *testing.T) {
+	comma := Dialect{Decimal: ","}
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "1.234,56 EUR", want: "1234.56 EUR"},
+		{input: "EUR -1.234.567,8", want: "EUR -1234567.8"},
+		{input: "789,56", want: "789.56"},
+		{input: "15000", want: "15000"},
+		{input: "1,5e3", want: "1.5e3"},
+		{input: "1.5", wantErr: true},
+		{input: "1.23,4", wantErr: true},
+		{input: "1234.567,8", wantErr: true},
+		{input: ".123,4", wantErr: true},
+		{input: "1,234.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := comma.DecimalPoint(tt.input)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("DecimalPoint(%s) = %q, %v, want %q and error %v", tt.input, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	if got, err := (Dialect{}).DecimalPoint("1.5"); err != nil || got != "1.5" {
+		t.Errorf("DecimalPoint(1.5) with a decimal point = %q, %v, want 1.5", got, err)
+	}
+	if _, err := ParseDecimal("1234,56"); err == nil || !strings.Contains(err.Error(), "decimal separator") {
+		t.Errorf("ParseDecimal(1234,56) error = %v, want an error explaining the decimal separator", err)
+	}
+}
+
+func TestAccountsWithDecimalComma(t *testing.T) {
+	content := "record_id;account_number;cash_balance;currency;taxes_paid\n" +
+		"1;1001;1.234,56;EUR;0,30\n" +
+		"2;1002;1.5;EUR;0,00\n" +
+		"3;1003;2.000,10 EUR;EUR;0\n" +
+		"TRAILER;3;1.234,56\n"
+	rows := NewCSVRows[Account](strings.NewReader(content), "accounts", Dialect{Decimal: ","}, nil)
+
+	account, err := rows.Next()
+	if err != nil || account.CashBalance.String() != "1234.56" || account.TaxesPaid.String() != "0.30" {
+		t.Errorf("Next() = %s and %s, %v, want 1234.56 and 0.30", account.CashBalance, account.TaxesPaid, err)
+	}
+	// A point which doesn't separate thousands is rejected rather than read as the decimal point.
+	_, err = rows.Next()
+	var rowErr *RowError
+	if !errors.As(err, &rowErr) || len(rowErr.Errors) != 1 || rowErr.Errors[0].Column != "cash_balance" || rowErr.Errors[0].Rule != RuleType {
+		t.Errorf("Next() error = %v, want a type error for cash_balance", err)
+	}
+	account, err = rows.Next()
+	if err != nil || account.CashBalance.String() != "2000.10 EUR" {
+		t.Errorf("Next() = %s, %v, want 2000.10 EUR", account.CashBalance, err)
+	}
+	// The hash total of the trailer is written with a decimal comma too.
+	if _, err = rows.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Next() error = %v, want %v", err, io.EOF)
+	}
+}
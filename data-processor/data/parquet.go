@@ -0,0 +1,237 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// parquetBatchSize is the number of rows read from a row group at a time.
+const parquetBatchSize = 64
+
+// parquetRows reads records of type T from a Parquet file. The top-level columns of the file are matched against the
+// schema of the file type like the header of a CSV file, and their values are converted to the text a CSV file would
+// hold, so that they are validated and decoded the same way. Row groups are read one after another in small batches,
+// so only the pages being read are held in memory.
+type parquetRows[T any] struct {
+	fileType  string
+	validator *Validator
+	r         io.Reader
+	temporary *os.File
+	decoder   *decoder[T]
+	columns   []parquet.Field
+	groups    []parquet.RowGroup
+	group     int
+	rows      parquet.Rows
+	batch     []parquet.Row
+	read      int // number of rows in batch
+	next      int // position of the next row in batch
+	line      int // number of the row in the file, starting at 1
+}
+
+// NewParquetRows returns the records of a Parquet file of the given file type. Parquet files have to be read at
+// random, so unless r is a file or an in-memory reader the file is buffered in a temporary file on the first call to
+// Next, which is removed by Close. Nested columns aren't supported. Rows are numbered from 1 in error reports.
+func NewParquetRows[T any](r io.Reader, fileType string, validator *Validator) Rows[T] {
+	return &parquetRows[T]{fileType: fileType, r: r, validator: validator}
+}
+
+func (r *parquetRows[T]) Next() (T, error) {
+	var record T
+	if r.decoder == nil {
+		err := r.open()
+		if err != nil {
+			return record, err
+		}
+	}
+
+	for r.next == r.read {
+		err := r.readBatch()
+		if err != nil {
+			return record, err
+		}
+	}
+	row := r.batch[r.next]
+	r.next++
+	r.line++
+
+	values := make([]string, len(r.columns))
+	for _, value := range row {
+		column := value.Column()
+		if column < 0 || column >= len(values) {
+			continue
+		}
+		text, err := parquetValue(r.columns[column], value)
+		if err != nil {
+			return record, &RowError{Line: r.line, Errors: []FieldError{{
+				Line:    r.line,
+				Column:  r.columns[column].Name(),
+				Rule:    RuleType,
+				Message: err.Error(),
+			}}}
+		}
+		values[column] = text
+	}
+	return r.decoder.decode(r.line, values)
+}
+
+// Close releases the rows being read and removes the temporary file the Parquet file was buffered in.
+func (r *parquetRows[T]) Close() error {
+	var errs []error
+	if r.rows != nil {
+		errs = append(errs, r.rows.Close())
+		r.rows = nil
+	}
+	if r.temporary != nil {
+		errs = append(errs, r.temporary.Close(), os.Remove(r.temporary.Name()))
+		r.temporary = nil
+	}
+	return errors.Join(errs...)
+}
+
+func (r *parquetRows[T]) open() error {
+	reader, size, temporary, err := randomAccess(r.r, "parquet-*.parquet")
+	r.temporary = temporary
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return ErrEmptyFile
+	}
+	file, err := parquet.OpenFile(reader, size)
+	if err != nil {
+		return fmt.Errorf("couldn't open Parquet file: %w", err)
+	}
+
+	r.columns = file.Schema().Fields()
+	header := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		if !column.Leaf() || column.Repeated() {
+			return fmt.Errorf("column %s is nested, only flat Parquet schemas are supported", column.Name())
+		}
+		header[i] = column.Name()
+	}
+	schema, columns, err := ResolveHeader(r.fileType, header)
+	if err != nil {
+		return err
+	}
+	r.decoder = newDecoder[T](schema, columns, r.validator)
+	r.groups = file.RowGroups()
+	r.batch = make([]parquet.Row, parquetBatchSize)
+	return nil
+}
+
+// readBatch reads the next rows of the current row group, moving on to the next row group once it has been read.
+func (r *parquetRows[T]) readBatch() error {
+	if r.rows == nil {
+		if r.group == len(r.groups) {
+			return io.EOF
+		}
+		r.rows = r.groups[r.group].Rows()
+		r.group++
+	}
+	read, err := r.rows.ReadRows(r.batch)
+	r.read, r.next = read, 0
+	if errors.Is(err, io.EOF) {
+		err = r.rows.Close()
+		r.rows = nil
+	}
+	return err
+}
+
+// parquetValue converts a Parquet value to its text as it would appear in a CSV file. Dates are formatted as
+// YYYY-MM-DD, timestamps as RFC 3339 and decimals with their scale. Null values are empty.
+func parquetValue(column parquet.Field, value parquet.Value) (string, error) {
+	if value.IsNull() {
+		return "", nil
+	}
+	logical := column.Type().LogicalType()
+	if logical == nil {
+		logical = &format.LogicalType{}
+	}
+
+	switch value.Kind() {
+	case parquet.Boolean:
+		return strconv.FormatBool(value.Boolean()), nil
+	case parquet.Int32, parquet.Int64:
+		integer := value.Int64()
+		switch {
+		case logical.Date != nil:
+			return time.Unix(integer*24*60*60, 0).UTC().Format(time.DateOnly), nil
+		case logical.Timestamp != nil:
+			return parquetTimestamp(integer, logical.Timestamp.Unit).Format(time.RFC3339Nano), nil
+		case logical.Decimal != nil:
+			return formatDecimal(big.NewInt(integer), int(logical.Decimal.Scale)), nil
+		}
+		return strconv.FormatInt(integer, 10), nil
+	case parquet.Float:
+		return strconv.FormatFloat(float64(value.Float()), 'f', -1, 32), nil
+	case parquet.Double:
+		return strconv.FormatFloat(value.Double(), 'f', -1, 64), nil
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		if logical.Decimal != nil {
+			return formatDecimal(twosComplement(value.ByteArray()), int(logical.Decimal.Scale)), nil
+		}
+		return string(value.ByteArray()), nil
+	}
+	return "", fmt.Errorf("has the unsupported Parquet type %s", value.Kind())
+}
+
+func parquetTimestamp(value int64, unit format.TimeUnit) time.Time {
+	switch {
+	case unit.Millis != nil:
+		return time.UnixMilli(value).UTC()
+	case unit.Micros != nil:
+		return time.UnixMicro(value).UTC()
+	}
+	return time.Unix(0, value).UTC()
+}
+
+// twosComplement decodes a big-endian two's complement integer as used by Parquet decimals.
+func twosComplement(b []byte) *big.Int {
+	integer := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		integer.Sub(integer, new(big.Int).Lsh(big.NewInt(1), uint(len(b))*8))
+	}
+	return integer
+}
+
+// formatDecimal formats an unscaled decimal, e.g. 12345 with scale 2 becomes 123.45.
+func formatDecimal(unscaled *big.Int, scale int) string {
+	if scale <= 0 {
+		return unscaled.String()
+	}
+	digits := new(big.Int).Abs(unscaled).String()
+	for len(digits) <= scale {
+		digits = "0" + digits
+	}
+	sign := ""
+	if unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+func ParseClientParquet(data []byte) ([]*Client, error) {
+	return collect(NewParquetRows[Client](bytes.NewReader(data), "clients", nil))
+}
+
+func ParsePortfolioParquet(data []byte) ([]*Portfolio, error) {
+	return collect(NewParquetRows[Portfolio](bytes.NewReader(data), "portfolios", nil))
+}
+
+func ParseAccountParquet(data []byte) ([]*Account, error) {
+	return collect(NewParquetRows[Account](bytes.NewReader(data), "accounts", nil))
+}
+
+func ParseTransactionParquet(data []byte) ([]*Transaction, error) {
+	return collect(NewParquetRows[Transaction](bytes.NewReader(data), "transactions", nil))
+}
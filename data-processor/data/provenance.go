@@ -0,0 +1,86 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// businessDateLayout is the layout business dates are stored in.
+const businessDateLayout = "2006-01-02"
+
+// Provenance records which file a record was loaded from and when. It is embedded in every record type.
+type Provenance struct {
+	BusinessDate string    `dynamodbav:"business_date" csv:"business_date" json:"business_date,omitempty"`
+	SourceKey    string    `dynamodbav:"source_key" csv:"-" json:"source_key,omitempty"`
+	LoadedAt     time.Time `dynamodbav:"loaded_at" csv:"-" json:"loaded_at,omitempty"`
+}
+
+// Stamp sets the source and load time of a record. The business date of the file is only used if the record does not
+// carry its own business date column.
+func (p *Provenance) Stamp(file Provenance) error {
+	businessDate := p.BusinessDate
+	if businessDate == "" {
+		businessDate = file.BusinessDate
+	}
+	businessDate, err := ParseBusinessDate(businessDate)
+	if err != nil {
+		return err
+	}
+
+	p.BusinessDate = businessDate
+	p.SourceKey = file.SourceKey
+	p.LoadedAt = file.LoadedAt
+	return nil
+}
+
+// load identifies the load which wrote the record.
+func (p Provenance) load() string {
+	return loadID(p.SourceKey, p.LoadedAt)
+}
+
+// EntrySeparator separates the key of an archive from the name of an entry in the source key of the entry.
+const EntrySeparator = "!"
+
+// EntryKey returns the source key of a file: the key of the object, or of the archive followed by the name of the
+// entry, so that every entry of an archive is loaded and retracted on its own.
+func EntryKey(key string, entry string) string {
+	if entry == "" {
+		return key
+	}
+	return key + EntrySeparator + entry
+}
+
+// Load is one load of a file. Records are attributed to their load by the source key and load time of their
+// provenance, so that a failed load can be retracted without touching what other loads of the same file, or other
+// entries of the same archive, have stored.
+type Load struct {
+	// ObjectKey is the key of the object the file was read from, which retracts all its loads once it is deleted.
+	ObjectKey string
+	// SourceKey is the key of the file, see EntryKey.
+	SourceKey string
+	LoadedAt  time.Time
+}
+
+// ID identifies the load.
+func (l Load) ID() string {
+	return loadID(l.SourceKey, l.LoadedAt)
+}
+
+func loadID(sourceKey string, loadedAt time.Time) string {
+	return sourceKey + "@" + loadedAt.UTC().Format(time.RFC3339Nano)
+}
+
+// ParseBusinessDate normalises a business date given as YYYYMMDD or YYYY-MM-DD to YYYY-MM-DD. An empty date stays
+// empty.
+func ParseBusinessDate(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	for _, layout := range []string{"20060102", businessDateLayout} {
+		date, err := time.Parse(layout, s)
+		if err == nil {
+			return date.Format(businessDateLayout), nil
+		}
+	}
+	return "", fmt.Errorf("invalid business date %q", s)
+}
@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// The references of the identifier columns are indexed as they are loaded, so that the known references of a column
+// are read from a few items instead of scanning the table: references#<column>#<shard> lists the references of a
+// column which hash to the shard. The references are spread over referenceShards items to stay below the size limit of
+// an item.
+const (
+	referencesPrefix = "references#"
+	referenceShards  = 16
+)
+
+// referenceIndex returns the object reference of a shard of the index of a column.
+func referenceIndex(column string, shard int) string {
+	return referencesPrefix + column + "#" + strconv.Itoa(shard)
+}
+
+// referenceShard returns the shard of the index listing a reference.
+func referenceShard(value string) int {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return int(h.Sum32() % referenceShards)
+}
+
+// indexReference lists a reference of a column as known, see KnownReferences.
+func (d DataManager) indexReference(column string, value string) error {
+	err := d.addReferences(referenceIndex(column, referenceShard(value)), value)
+	if err != nil {
+		log.Printf("Couldn't index %v %v. Error: %v\n", column, value, err)
+	}
+	return err
+}
+
+// KnownReferences returns up to limit identifiers of a column which have been loaded, e.g. the references of clients
+// for client_reference. They are read from the index of the column, which lists the references loaded since it
+// exists. Columns which aren't identifiers have no known references.
+func (d DataManager) KnownReferences(column string, limit int) ([]string, error) {
+	switch column {
+	case "client_reference", "portfolio_reference", "agent_code", "account_number":
+	default:
+		return nil, nil
+	}
+
+	known := map[string]bool{}
+	for shard := 0; shard < referenceShards; shard++ {
+		result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName: aws.String(d.tableName),
+			Key:       objectKey(referenceIndex(column, shard)),
+		})
+		if err != nil {
+			log.Printf("Couldn't get known %v. Error: %v\n", column, err)
+			return nil, err
+		}
+		if result.Item == nil {
+			continue
+		}
+		var list referenceList
+		err = attributevalue.UnmarshalMap(result.Item, &list)
+		if err != nil {
+			log.Printf("Couldn't unmarshal known %v: %v. Error: %v\n", column, result.Item, err)
+			return nil, err
+		}
+		for _, value := range list.References {
+			known[value] = true
+		}
+	}
+	return sortedKeys(known, limit), nil
+}
+
+func (m *MemoryStore) KnownReferences(column string, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	known := map[string]bool{}
+	switch column {
+	case "client_reference":
+		for reference := range m.Clients {
+			known[reference] = true
+		}
+	case "portfolio_reference":
+		for reference := range m.Portfolios {
+			known[reference] = true
+		}
+	case "agent_code":
+		for _, portfolio := range m.Portfolios {
+			known[portfolio.AgentCode] = true
+		}
+	case "account_number":
+		for _, account := range m.Accounts {
+			known[strconv.Itoa(account.AccountNumber)] = true
+		}
+	}
+	return sortedKeys(known, limit), nil
+}
+
+// sortedKeys returns the first keys of a set in order, at most limit of them.
+func sortedKeys(set map[string]bool, limit int) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
@@ -0,0 +1,392 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Items describing which load wrote which item share the table with the data items, distinguished by these prefixes
+// of their object reference. Loads are identified by Load.ID.
+const (
+	historyPrefix = "history#" // history#<load>#<object reference> holds the item as it was before the load
+	loadPrefix    = "load#"    // load#<load> holds the number of pages of the manifest of the load
+	loadsPrefix   = "loads#"   // loads#<object key> lists the loads of an object
+)
+
+// manifestPageSize is the number of object references per page of the manifest of a load, load#<load>#<page>, which
+// keeps the pages far below the size limit of DynamoDB items no matter how many items a load writes.
+const manifestPageSize = 1000
+
+// loadManifest is the header of the manifest of a load.
+type loadManifest struct {
+	ObjectReference string `dynamodbav:"object_reference"`
+	Pages           int    `dynamodbav:"pages"`
+}
+
+// manifestPage lists some of the items written by a load.
+type manifestPage struct {
+	ObjectReference string   `dynamodbav:"object_reference"`
+	References      []string `dynamodbav:"references,stringset"`
+}
+
+// loadIndex lists the loads of an object.
+type loadIndex struct {
+	ObjectReference string   `dynamodbav:"object_reference"`
+	Loads           []string `dynamodbav:"loads,stringset"`
+}
+
+func historyKey(load string, reference string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"object_reference": &types.AttributeValueMemberS{Value: historyPrefix + load + "#" + reference},
+	}
+}
+
+func objectKey(reference string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"object_reference": &types.AttributeValueMemberS{Value: reference},
+	}
+}
+
+func manifestPageKey(load string, page int) map[string]types.AttributeValue {
+	return objectKey(loadPrefix + load + "#" + strconv.Itoa(page))
+}
+
+// loadWriters keeps track of the loads in progress: the items every load has written so far, so that the previous
+// state of an item is kept and its reference added to the manifest only the first time the load writes it.
+type loadWriters struct {
+	mu      sync.Mutex
+	written map[string]map[string]bool
+}
+
+func newLoadWriters() *loadWriters {
+	return &loadWriters{written: map[string]map[string]bool{}}
+}
+
+// first reports whether the load hasn't written the item yet and returns the page of the manifest its reference goes
+// to. The page is new if it is the first reference on it.
+func (w *loadWriters) first(load string, reference string) (bool, int, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	written := w.written[load]
+	if written[reference] {
+		return false, 0, false
+	}
+	return true, len(written) / manifestPageSize, len(written)%manifestPageSize == 0
+}
+
+// add records that the load has written the item.
+func (w *loadWriters) add(load string, reference string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.written[load] == nil {
+		w.written[load] = map[string]bool{}
+	}
+	w.written[load][reference] = true
+}
+
+func (w *loadWriters) finish(load string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.written, load)
+}
+
+// putItem writes an item on behalf of the load of a record. The first time the load writes the item, the state the
+// item had before is kept and its reference is added to the manifest of the load, so that the load can be retracted
+// later, see RetractLoad. These writes are made in one transaction with the item itself, so that every item written
+// is in the manifest, and an item written again by the same load costs a single write.
+func (d DataManager) putItem(item map[string]types.AttributeValue, provenance Provenance) error {
+	reference, ok := item["object_reference"].(*types.AttributeValueMemberS)
+	if !ok {
+		return fmt.Errorf("item has no object reference")
+	}
+	load := provenance.load()
+	first, page, newPage := d.loads.first(load, reference.Value)
+	if provenance.SourceKey == "" || !first {
+		if provenance.SourceKey != "" {
+			item["written_by"] = &types.AttributeValueMemberS{Value: load}
+		}
+		_, err := d.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName: aws.String(d.tableName),
+			Item:      item,
+		})
+		return err
+	}
+	item["written_by"] = &types.AttributeValueMemberS{Value: load}
+
+	previous, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(reference.Value),
+	})
+	if err != nil {
+		log.Printf("Couldn't get previous state of %v. Error: %v\n", reference.Value, err)
+		return err
+	}
+
+	var writes []types.TransactWriteItem
+	if previous.Item != nil {
+		history := historyKey(load, reference.Value)
+		history["previous"] = &types.AttributeValueMemberM{Value: previous.Item}
+		writes = append(writes, types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(d.tableName),
+			Item:      history,
+		}})
+	}
+	if newPage {
+		writes = append(writes, types.TransactWriteItem{Update: &types.Update{
+			TableName:        aws.String(d.tableName),
+			Key:              objectKey(loadPrefix + load),
+			UpdateExpression: aws.String("SET pages = :pages"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":pages": &types.AttributeValueMemberN{Value: strconv.Itoa(page + 1)},
+			},
+		}})
+	}
+	writes = append(writes,
+		types.TransactWriteItem{Update: &types.Update{
+			TableName:        aws.String(d.tableName),
+			Key:              manifestPageKey(load, page),
+			UpdateExpression: aws.String("ADD #references :reference"),
+			ExpressionAttributeNames: map[string]string{
+				"#references": "references",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":reference": &types.AttributeValueMemberSS{Value: []string{reference.Value}},
+			},
+		}},
+		types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(d.tableName),
+			Item:      item,
+		}},
+	)
+	_, err = d.db.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	if err != nil {
+		log.Printf("Couldn't write %v for %v. Error: %v\n", reference.Value, load, err)
+		return err
+	}
+	d.loads.add(load, reference.Value)
+	return nil
+}
+
+// BeginLoad adds a load to the loads of its object, so that all of them are retracted once the object is deleted.
+func (d DataManager) BeginLoad(load Load) error {
+	_, err := d.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.tableName),
+		Key:              objectKey(loadsPrefix + load.ObjectKey),
+		UpdateExpression: aws.String("ADD loads :load"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":load": &types.AttributeValueMemberSS{Value: []string{load.ID()}},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't record load %v. Error: %v\n", load.ID(), err)
+	}
+	return err
+}
+
+// FinishLoad forgets which items the load has written.
+func (d DataManager) FinishLoad(load Load) error {
+	d.loads.finish(load.ID())
+	return nil
+}
+
+// RetractLoad withdraws the items written by one load of a file. Items which were last written by the load are
+// restored to the state they had before the load. Items without a previous state, or which have been written by other
+// loads since, are marked as withdrawn instead.
+func (d DataManager) RetractLoad(load Load) (int, error) {
+	retracted, err := d.retractLoad(load.ID())
+	if err != nil {
+		return retracted, err
+	}
+	_, err = d.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.tableName),
+		Key:              objectKey(loadsPrefix + load.ObjectKey),
+		UpdateExpression: aws.String("DELETE loads :load"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":load": &types.AttributeValueMemberSS{Value: []string{load.ID()}},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't remove load %v. Error: %v\n", load.ID(), err)
+	}
+	return retracted, err
+}
+
+// RetractSource withdraws everything loaded from an object by any of its loads, see RetractLoad.
+func (d DataManager) RetractSource(key string) (int, error) {
+	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(loadsPrefix + key),
+	})
+	if err != nil {
+		log.Printf("Couldn't get loads of %v. Error: %v\n", key, err)
+		return 0, err
+	}
+	if result.Item == nil {
+		log.Printf("Nothing was loaded from %v\n", key)
+		return 0, nil
+	}
+	var index loadIndex
+	err = attributevalue.UnmarshalMap(result.Item, &index)
+	if err != nil {
+		log.Printf("Couldn't unmarshal loads of %v. Error: %v\n", key, err)
+		return 0, err
+	}
+
+	// Later loads are undone first, so that earlier loads restore what was there before them.
+	sort.Sort(sort.Reverse(sort.StringSlice(index.Loads)))
+	retracted := 0
+	for _, load := range index.Loads {
+		count, err := d.retractLoad(load)
+		retracted += count
+		if err != nil {
+			return retracted, err
+		}
+	}
+
+	_, err = d.db.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(loadsPrefix + key),
+	})
+	if err != nil {
+		log.Printf("Couldn't delete loads of %v. Error: %v\n", key, err)
+		return retracted, err
+	}
+	return retracted, nil
+}
+
+// retractLoad withdraws the items listed in the manifest of a load, page by page.
+func (d DataManager) retractLoad(load string) (int, error) {
+	result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(loadPrefix + load),
+	})
+	if err != nil {
+		log.Printf("Couldn't get items loaded by %v. Error: %v\n", load, err)
+		return 0, err
+	}
+	if result.Item == nil {
+		log.Printf("Nothing was loaded by %v\n", load)
+		return 0, nil
+	}
+	var manifest loadManifest
+	err = attributevalue.UnmarshalMap(result.Item, &manifest)
+	if err != nil {
+		log.Printf("Couldn't unmarshal items loaded by %v. Error: %v\n", load, err)
+		return 0, err
+	}
+
+	retracted := 0
+	for page := manifest.Pages - 1; page >= 0; page-- {
+		result, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName: aws.String(d.tableName),
+			Key:       manifestPageKey(load, page),
+		})
+		if err != nil {
+			log.Printf("Couldn't get page %d of the items loaded by %v. Error: %v\n", page, load, err)
+			return retracted, err
+		}
+		var references manifestPage
+		err = attributevalue.UnmarshalMap(result.Item, &references)
+		if err != nil {
+			log.Printf("Couldn't unmarshal page %d of the items loaded by %v. Error: %v\n", page, load, err)
+			return retracted, err
+		}
+		for _, reference := range references.References {
+			err = d.retractItem(load, reference)
+			if err != nil {
+				return retracted, err
+			}
+			retracted++
+		}
+		_, err = d.db.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(d.tableName),
+			Key:       manifestPageKey(load, page),
+		})
+		if err != nil {
+			log.Printf("Couldn't delete page %d of the items loaded by %v. Error: %v\n", page, load, err)
+			return retracted, err
+		}
+	}
+
+	_, err = d.db.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(loadPrefix + load),
+	})
+	if err != nil {
+		log.Printf("Couldn't delete items loaded by %v. Error: %v\n", load, err)
+		return retracted, err
+	}
+	log.Printf("Retracted %d items loaded by %v\n", retracted, load)
+
+	return retracted, nil
+}
+
+func (d DataManager) retractItem(load string, reference string) error {
+	current, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       objectKey(reference),
+	})
+	if err != nil {
+		log.Printf("Couldn't get %v. Error: %v\n", reference, err)
+		return err
+	}
+	history, err := d.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       historyKey(load, reference),
+	})
+	if err != nil {
+		log.Printf("Couldn't get previous state of %v. Error: %v\n", reference, err)
+		return err
+	}
+
+	writtenBy, _ := current.Item["written_by"].(*types.AttributeValueMemberS)
+	previous, _ := history.Item["previous"].(*types.AttributeValueMemberM)
+	if previous != nil && writtenBy != nil && writtenBy.Value == load {
+		_, err = d.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName: aws.String(d.tableName),
+			Item:      previous.Value,
+		})
+		if err != nil {
+			log.Printf("Couldn't restore previous state of %v. Error: %v\n", reference, err)
+			return err
+		}
+		log.Printf("Restored previous state of %v\n", reference)
+	} else if current.Item != nil {
+		_, err = d.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+			TableName:        aws.String(d.tableName),
+			Key:              objectKey(reference),
+			UpdateExpression: aws.String("SET withdrawn_at = :now ADD withdrawn_sources :source"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now":    &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+				":source": &types.AttributeValueMemberSS{Value: []string{load}},
+			},
+		})
+		if err != nil {
+			log.Printf("Couldn't mark %v as withdrawn. Error: %v\n", reference, err)
+			return err
+		}
+		log.Printf("Marked %v as withdrawn\n", reference)
+	}
+
+	if history.Item != nil {
+		_, err = d.db.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(d.tableName),
+			Key:       historyKey(load, reference),
+		})
+		if err != nil {
+			log.Printf("Couldn't delete previous state of %v. Error: %v\n", reference, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package data
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// Rows iterates over the records of a file one at a time, so that files of any size can be processed in constant
+// memory. Next returns io.EOF after the last record. Rows are validated by the Validator passed to the function
+// opening them, nil validates like NewValidator.
+type Rows[T any] interface {
+	Next() (T, error)
+}
+
+// ErrEmptyFile is returned for files without a header.
+var ErrEmptyFile = errors.New("empty file")
+
+// csvRows reads records of type T from a CSV file with a header row. The header is matched against the schema of the
+// file type and columns are mapped to fields by the csv tags of their canonical names. The control totals of the rows
+// read are kept, so that they can be verified against a trailer row ending the file.
+type csvRows[T any] struct {
+	fileType   string
+	r          io.Reader
+	dialect    Dialect
+	validator  *Validator
+	reader     *csv.Reader
+	swapped    bool     // single and double quotes are swapped, see quoteSwapper
+	schema     Schema   // the schema matching the header
+	columns    []string // the header translated to canonical column names, nil until it has been read
+	hashColumn int      // the index of the hash column, -1 if the header lacks it
+	totals     ControlTotals
+	trailer    *ControlTotals
+	decoder    *decoder[T]
+}
+
+// NewCSVRows returns the records of a CSV file of the given file type written in the dialect. The file is transcoded
+// to UTF-8 and the header row is read on the first call to Next, which fails with a *SchemaError if the header
+// doesn't match the schema. Invalid rows are reported with a *RowError. A trailer row, see TrailerMarker, has to be
+// the last row and ends the file; if the rows read don't match its control totals Next returns a *ControlError
+// instead of io.EOF.
+func NewCSVRows[T any](r io.Reader, fileType string, dialect Dialect, validator *Validator) Rows[T] {
+	return &csvRows[T]{fileType: fileType, r: r, dialect: dialect, validator: validator}
+}
+
+// open sniffs the dialect from the start of the file and sets up the reader.
+func (r *csvRows[T]) open() error {
+	err := r.dialect.Validate()
+	if err != nil {
+		return err
+	}
+	decoded, err := NewDecodingReader(r.r, r.dialect.Encoding)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewReaderSize(decoded, sniffSize)
+	sample, _ := buffered.Peek(sniffSize)
+	delimiter, quote := r.dialect.sniff(sample)
+
+	var source io.Reader = buffered
+	if quote == '\'' {
+		source = quoteSwapper{buffered}
+		r.swapped = true
+	}
+	r.reader = csv.NewReader(source)
+	r.reader.Comma = delimiter
+	r.reader.FieldsPerRecord = -1 // rows with the wrong number of columns are reported as invalid rows
+	return nil
+}
+
+func (r *csvRows[T]) read() ([]string, error) {
+	row, err := r.reader.Read()
+	if r.swapped {
+		swapQuotes(row)
+	}
+	return row, err
+}
+
+// next returns the next data row and its line, reading the header first. The data rows are added to the control
+// totals and a trailer row is verified against them.
+func (r *csvRows[T]) next() ([]string, int, error) {
+	if r.reader == nil {
+		err := r.open()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if r.columns == nil {
+		header, err := r.read()
+		if errors.Is(err, io.EOF) {
+			return nil, 0, ErrEmptyFile
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		r.schema, r.columns, err = ResolveHeader(r.fileType, header)
+		if err != nil {
+			return nil, 0, err
+		}
+		r.hashColumn = slices.Index(r.columns, HashColumns[r.fileType])
+	}
+	if r.trailer != nil {
+		return nil, 0, io.EOF
+	}
+
+	row, err := r.read()
+	if err != nil {
+		return nil, 0, err
+	}
+	line, _ := r.reader.FieldPos(0)
+	if !isTrailer(row) {
+		r.totals.add(row, r.hashColumn, r.dialect)
+		return row, line, nil
+	}
+
+	trailer, err := parseTrailer(line, row, r.dialect)
+	if err != nil {
+		return nil, line, err
+	}
+	_, err = r.read()
+	if !errors.Is(err, io.EOF) {
+		next, _ := r.reader.FieldPos(0)
+		return nil, line, fmt.Errorf("trailer row at line %d isn't the last row, line %d follows", line, next)
+	}
+	r.trailer = trailer
+	err = VerifyControls("trailer", trailer, r.totals)
+	if err != nil {
+		return nil, line, err
+	}
+	return nil, line, io.EOF
+}
+
+func (r *csvRows[T]) Next() (T, error) {
+	var record T
+	row, line, err := r.next()
+	if err != nil {
+		return record, err
+	}
+	if r.decoder == nil {
+		r.decoder = newDecoder[T](r.schema, r.columns, r.validator)
+		r.decoder.dialect = r.dialect
+	}
+	return r.decoder.decode(line, row)
+}
+
+// randomAccess returns a reader for random access to the content of r and its size, as needed for formats like
+// Parquet and XLSX which are read from the end or by offset. Files and in-memory readers are used as they are, other
+// readers are buffered in a temporary file named after the pattern, which is returned so that it can be removed.
+func randomAccess(r io.Reader, pattern string) (io.ReaderAt, int64, *os.File, error) {
+	switch reader := r.(type) {
+	case *os.File:
+		info, err := reader.Stat()
+		if err == nil && info.Mode().IsRegular() {
+			return reader, info.Size(), nil, nil
+		}
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		return reader, reader.Size(), nil, nil
+	}
+
+	buffer, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("couldn't buffer file: %w", err)
+	}
+	size, err := io.Copy(buffer, r)
+	if err != nil {
+		return nil, 0, buffer, fmt.Errorf("couldn't buffer file: %w", err)
+	}
+	return buffer, size, buffer, nil
+}
+
+// collect reads all remaining records.
+func collect[T any](rows Rows[T]) ([]*T, error) {
+	records := []*T{}
+	for {
+		record, err := rows.Next()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, &record)
+	}
+}
@@ -0,0 +1,188 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Column is a column of a file, named like the csv tag of the field it is parsed into.
+type Column struct {
+	Name string
+	// Aliases are other names upstream uses for the column, e.g. because of a typo in the header.
+	Aliases []string
+	// Required columns have to be in the header and must not be empty.
+	Required bool
+	Checks   []Check
+	// References is the file type of the records the column refers to, e.g. clients for the client_reference of a
+	// portfolio. Values which aren't known but are close to a known reference are rejected as typos, see
+	// Validator.WithKnownReferences.
+	References string
+}
+
+// Schema is one version of the columns of a file type.
+type Schema struct {
+	FileType string
+	Version  int
+	Columns  []Column
+}
+
+// ReasonColumn is added to quarantined rows to explain why they were rejected. It is ignored when a file is read, so
+// that fixed rows can be submitted again as they are.
+const ReasonColumn = "rejection_reason"
+
+// businessDateColumn lets rows carry their own business date, see Provenance.
+var businessDateColumn = Column{Name: "business_date", Checks: []Check{BusinessDate()}}
+
+// Schemas lists the versions of the schema of every file type, oldest first. A header is matched against the latest
+// version first, so that files in an older layout keep being accepted while upstream migrates.
+var Schemas = map[string][]Schema{
+	"clients": {
+		{FileType: "clients", Version: 1, Columns: []Column{
+			{Name: "record_id", Required: true, Checks: []Check{Positive()}},
+			{Name: "first_name", Required: true},
+			{Name: "last_name", Required: true},
+			{Name: "client_reference", Required: true},
+			{Name: "tax_free_allowance", Required: true, Checks: []Check{NonNegative()}},
+			businessDateColumn,
+		}},
+	},
+	"portfolios": {
+		{FileType: "portfolios", Version: 1, Columns: []Column{
+			{Name: "record_id", Required: true, Checks: []Check{Positive()}},
+			{Name: "account_number", Aliases: []string{"accout_number"}, Required: true, Checks: []Check{Positive()}},
+			{Name: "portfolio_reference", Required: true},
+			{Name: "client_reference", Required: true, References: "clients"},
+			{Name: "agent_code", Required: true},
+			businessDateColumn,
+		}},
+	},
+	"accounts": {
+		{FileType: "accounts", Version: 1, Columns: []Column{
+			{Name: "record_id", Required: true, Checks: []Check{Positive()}},
+			{Name: "account_number", Aliases: []string{"accout_number"}, Required: true, Checks: []Check{Positive()}},
+			{Name: "cash_balance", Required: true},
+			{Name: "currency", Required: true, Checks: []Check{Currency()}},
+			{Name: "taxes_paid", Required: true, Checks: []Check{NonNegative()}},
+			businessDateColumn,
+		}},
+	},
+	"transactions": {
+		{FileType: "transactions", Version: 1, Columns: []Column{
+			{Name: "record_id", Required: true, Checks: []Check{Positive()}},
+			{Name: "account_number", Aliases: []string{"accout_number"}, Required: true, Checks: []Check{Positive()}, References: "accounts"},
+			{Name: "transaction_reference", Required: true},
+			{Name: "amount", Required: true},
+			{Name: "keyword", Required: true}, // checked by the Validator
+			businessDateColumn,
+		}},
+	},
+	"fxrates": {
+		{FileType: "fxrates", Version: 1, Columns: []Column{
+			{Name: "record_id", Required: true, Checks: []Check{Positive()}},
+			{Name: "currency", Required: true, Checks: []Check{Currency()}},
+			{Name: "base_currency", Required: true, Checks: []Check{Currency()}},
+			{Name: "rate", Required: true, Checks: []Check{Positive()}},
+			businessDateColumn,
+		}},
+	},
+}
+
+// SchemaError reports a header which does not match the schema of its file type.
+type SchemaError struct {
+	FileType   string
+	Version    int
+	Missing    []string // required columns which are not in the header
+	Unknown    []string // columns in the header which are not in the schema
+	Duplicates []string // columns which appear more than once, possibly under different aliases
+}
+
+func (e *SchemaError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing columns %v", e.Missing))
+	}
+	if len(e.Unknown) > 0 {
+		problems = append(problems, fmt.Sprintf("unknown columns %v", e.Unknown))
+	}
+	if len(e.Duplicates) > 0 {
+		problems = append(problems, fmt.Sprintf("duplicate columns %v", e.Duplicates))
+	}
+	return fmt.Sprintf("header doesn't match version %d of the %s schema: %s", e.Version, e.FileType, strings.Join(problems, ", "))
+}
+
+// ResolveHeader matches a header against the versions of the schema of a file type, latest first, and returns the
+// matching version together with the header translated to the canonical column names. If no version matches, the
+// error describes the differences to the latest version.
+func ResolveHeader(fileType string, header []string) (Schema, []string, error) {
+	versions := Schemas[fileType]
+	if len(versions) == 0 {
+		return Schema{}, nil, fmt.Errorf("no schema for file type %q", fileType)
+	}
+
+	var latestErr error
+	for i := len(versions) - 1; i >= 0; i-- {
+		resolved, err := versions[i].resolve(header)
+		if err == nil {
+			return versions[i], resolved, nil
+		}
+		if latestErr == nil {
+			latestErr = err
+		}
+	}
+	return Schema{}, nil, latestErr
+}
+
+// LatestSchema returns the latest version of the schema of a file type.
+func LatestSchema(fileType string) (Schema, error) {
+	versions := Schemas[fileType]
+	if len(versions) == 0 {
+		return Schema{}, fmt.Errorf("no schema for file type %q", fileType)
+	}
+	return versions[len(versions)-1], nil
+}
+
+// names maps the names and aliases of the columns to their canonical names.
+func (s Schema) names() map[string]string {
+	names := map[string]string{}
+	for _, column := range s.Columns {
+		names[column.Name] = column.Name
+		for _, alias := range column.Aliases {
+			names[alias] = column.Name
+		}
+	}
+	return names
+}
+
+func (s Schema) resolve(header []string) ([]string, error) {
+	names := s.names()
+
+	schemaErr := &SchemaError{FileType: s.FileType, Version: s.Version}
+	resolved := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, name := range header {
+		if strings.ToLower(strings.TrimSpace(name)) == ReasonColumn {
+			resolved[i] = ReasonColumn
+			continue
+		}
+		canonical, ok := names[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			schemaErr.Unknown = append(schemaErr.Unknown, name)
+			continue
+		}
+		if seen[canonical] {
+			schemaErr.Duplicates = append(schemaErr.Duplicates, canonical)
+		}
+		seen[canonical] = true
+		resolved[i] = canonical
+	}
+	for _, column := range s.Columns {
+		if column.Required && !seen[column.Name] {
+			schemaErr.Missing = append(schemaErr.Missing, column.Name)
+		}
+	}
+
+	if len(schemaErr.Missing) > 0 || len(schemaErr.Unknown) > 0 || len(schemaErr.Duplicates) > 0 {
+		return nil, schemaErr
+	}
+	return resolved, nil
+}
@@ -0,0 +1,161 @@
+package data
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store persists the records parsed from the input files. DataManager stores them in DynamoDB, MemoryStore keeps them
+// in memory e.g. for local runs.
+type Store interface {
+	InsertClient(client Client) error
+	InsertPortfolio(portfolio Portfolio) error
+	InsertAccount(account Account) error
+	InsertTransaction(transaction Transaction) error
+	InsertFXRate(rate FXRate) error
+	RateSource
+	// KnownReferences returns up to limit identifiers of a column which have been loaded, to suggest them for typos.
+	KnownReferences(column string, limit int) ([]string, error)
+	// GetClientTotals adds up the accounts of a client in a base currency at the rates valid on a business date.
+	GetClientTotals(clientReference string, base string, businessDate string) (ClientTotals, error)
+	// BeginLoad registers a load of a file before its records are inserted.
+	BeginLoad(load Load) error
+	// FinishLoad ends a load, whether it succeeded or not.
+	FinishLoad(load Load) error
+	// RetractLoad withdraws the records inserted by one load of a file and returns how many were affected.
+	RetractLoad(load Load) (int, error)
+	// RetractSource withdraws every record loaded from an object by any of its loads, including those of the entries of
+	// an archive, and returns how many were affected.
+	RetractSource(objectKey string) (int, error)
+	// GetLedgerEntry returns the ledger entry of a file or nil if the file has never been processed.
+	GetLedgerEntry(bucket string, key string) (*LedgerEntry, error)
+	PutLedgerEntry(entry LedgerEntry) error
+	AddBatchFile(businessDate string, file BatchFile) (*Batch, error)
+	PendingBatches() ([]Batch, error)
+	ClaimBatch(businessDate string, now time.Time, leaseUntil time.Time) (bool, error)
+	SetBatchStatus(businessDate string, from string, to string) (bool, error)
+}
+
+// MemoryStore keeps all records in memory, keyed by their reference.
+type MemoryStore struct {
+	mu           sync.Mutex
+	Clients      map[string]Client
+	Portfolios   map[string]Portfolio
+	Accounts     map[string]Account
+	Transactions map[string]Transaction
+	FXRates      map[string]FXRate
+
+	// undo holds, per load, the functions restoring the records overwritten by the load. loads lists the loads of
+	// every object.
+	undo    map[string][]func()
+	loads   map[string][]string
+	ledger  map[string]LedgerEntry
+	batches map[string]*Batch
+}
+
+// put stores a record and remembers how to undo it when its load is retracted.
+func put[T interface{ load() string }](m *MemoryStore, records map[string]T, reference string, record T) {
+	previous, existed := records[reference]
+	records[reference] = record
+	load := record.load()
+	m.undo[load] = append(m.undo[load], func() {
+		// Records which have been overwritten by another load since are left alone.
+		if records[reference].load() != load {
+			return
+		}
+		if existed {
+			records[reference] = previous
+		} else {
+			delete(records, reference)
+		}
+	})
+}
+
+func (m *MemoryStore) BeginLoad(load Load) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loads[load.ObjectKey] = append(m.loads[load.ObjectKey], load.ID())
+	return nil
+}
+
+func (m *MemoryStore) FinishLoad(load Load) error {
+	return nil
+}
+
+func (m *MemoryStore) RetractLoad(load Load) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	loads := m.loads[load.ObjectKey]
+	for i, id := range loads {
+		if id == load.ID() {
+			m.loads[load.ObjectKey] = append(loads[:i:i], loads[i+1:]...)
+			break
+		}
+	}
+	return m.retract(load.ID()), nil
+}
+
+func (m *MemoryStore) RetractSource(objectKey string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	retracted := 0
+	loads := m.loads[objectKey]
+	for i := len(loads) - 1; i >= 0; i-- {
+		retracted += m.retract(loads[i])
+	}
+	delete(m.loads, objectKey)
+	return retracted, nil
+}
+
+// retract undoes a load, latest record first.
+func (m *MemoryStore) retract(load string) int {
+	undo := m.undo[load]
+	for i := len(undo) - 1; i >= 0; i-- {
+		undo[i]()
+	}
+	delete(m.undo, load)
+	return len(undo)
+}
+
+func (m *MemoryStore) InsertClient(client Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	put(m, m.Clients, client.ClientReference, client)
+	return nil
+}
+
+func (m *MemoryStore) InsertPortfolio(portfolio Portfolio) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	put(m, m.Portfolios, portfolio.PortfolioReference, portfolio)
+	return nil
+}
+
+func (m *MemoryStore) InsertAccount(account Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	put(m, m.Accounts, strconv.Itoa(account.AccountNumber), account)
+	return nil
+}
+
+func (m *MemoryStore) InsertTransaction(transaction Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	put(m, m.Transactions, transaction.TransactionReference, transaction)
+	return nil
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		Clients:      map[string]Client{},
+		Portfolios:   map[string]Portfolio{},
+		Accounts:     map[string]Account{},
+		Transactions: map[string]Transaction{},
+		FXRates:      map[string]FXRate{},
+		undo:         map[string][]func(){},
+		loads:        map[string][]string{},
+		ledger:       map[string]LedgerEntry{},
+		batches:      map[string]*Batch{},
+	}
+}
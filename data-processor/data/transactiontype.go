@@ -0,0 +1,110 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BalanceEffect is how the amount of a transaction changes its account.
+type BalanceEffect string
+
+const (
+	// BalanceCash adds the amount to the balance of the account.
+	BalanceCash BalanceEffect = "cash"
+	// BalanceTax adds the amount to the balance and counts it, negated, towards the taxes paid on the account.
+	BalanceTax BalanceEffect = "tax"
+	// BalanceNone leaves the balance alone, e.g. for transfers of securities, whose amount is their value.
+	BalanceNone BalanceEffect = "none"
+)
+
+// TransactionType describes the transactions booked with a keyword.
+type TransactionType struct {
+	Keyword string
+	// Sign is the sign amounts must have: 1 for credits, -1 for debits and 0 if they can have either. Amounts of 0 are
+	// always accepted.
+	Sign int
+	// Taxable amounts are income subject to tax.
+	Taxable bool
+	Balance BalanceEffect
+}
+
+// TransactionTypes is the catalogue of transaction types by keyword. Amounts are signed as they change the balance,
+// e.g. withdrawals are negative.
+var TransactionTypes = map[string]TransactionType{
+	"DEPOSIT":    {Keyword: "DEPOSIT", Sign: 1, Balance: BalanceCash},
+	"WITHDRAWAL": {Keyword: "WITHDRAWAL", Sign: -1, Balance: BalanceCash},
+	"DIVIDEND":   {Keyword: "DIVIDEND", Sign: 1, Taxable: true, Balance: BalanceCash},
+	"INTEREST":   {Keyword: "INTEREST", Sign: 1, Taxable: true, Balance: BalanceCash},
+	"FEE":        {Keyword: "FEE", Sign: -1, Balance: BalanceCash},
+	"TAX":        {Keyword: "TAX", Sign: -1, Balance: BalanceTax},
+	"BUY":        {Keyword: "BUY", Sign: -1, Balance: BalanceCash},
+	"SELL":       {Keyword: "SELL", Sign: 1, Balance: BalanceCash},
+	"REVERSAL":   {Keyword: "REVERSAL", Sign: 0, Balance: BalanceCash},
+	"TRANSFER":   {Keyword: "TRANSFER", Sign: 0, Balance: BalanceNone},
+}
+
+// Policies for keywords which are not in TransactionTypes.
+const (
+	// UnknownKeywordsReject makes transactions with unknown keywords invalid rows.
+	UnknownKeywordsReject = "reject"
+	// UnknownKeywordsAccept books transactions with unknown keywords to the balance, as not taxable.
+	UnknownKeywordsAccept = "accept"
+)
+
+// keywordColumn is the column holding the keywords of transactions, which the Validator checks against
+// TransactionTypes.
+const keywordColumn = "keyword"
+
+// SetUnknownKeywords sets the policy for keywords which are not in TransactionTypes. An empty policy rejects them.
+func (v *Validator) SetUnknownKeywords(policy string) error {
+	switch policy {
+	case "":
+		v.UnknownKeywords = UnknownKeywordsReject
+	case UnknownKeywordsReject, UnknownKeywordsAccept:
+		v.UnknownKeywords = policy
+	default:
+		return fmt.Errorf("unknown policy for unknown keywords %q, must be %s or %s", policy, UnknownKeywordsReject, UnknownKeywordsAccept)
+	}
+	return nil
+}
+
+// LookupTransactionType returns the type of transactions booked with a keyword, ignoring case.
+func LookupTransactionType(keyword string) (TransactionType, bool) {
+	transactionType, ok := TransactionTypes[strings.ToUpper(strings.TrimSpace(keyword))]
+	return transactionType, ok
+}
+
+// Keywords returns the keywords of the catalogue in alphabetical order.
+func Keywords() []string {
+	keywords := make([]string, 0, len(TransactionTypes))
+	for keyword := range TransactionTypes {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+// Type returns the type of the transaction. Transactions with unknown keywords are booked to the balance, as not
+// taxable.
+func (t Transaction) Type() TransactionType {
+	transactionType, ok := LookupTransactionType(t.Keyword)
+	if !ok {
+		return TransactionType{Keyword: t.Keyword, Balance: BalanceCash}
+	}
+	return transactionType
+}
+
+// ValidateRow checks that the amount has the sign of the type of the transaction.
+func (t *Transaction) ValidateRow() []FieldError {
+	transactionType := t.Type()
+	sign := t.Amount.Sign()
+	if transactionType.Sign == 0 || sign == 0 || sign == transactionType.Sign {
+		return nil
+	}
+	message := "must not be negative for " + transactionType.Keyword
+	if transactionType.Sign < 0 {
+		message = "must not be positive for " + transactionType.Keyword
+	}
+	return []FieldError{{Column: "amount", Value: t.Amount.Amount().String(), Rule: RuleRange, Message: message}}
+}
@@ -0,0 +1,194 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Validation rules reported in a FieldError.
+const (
+	RuleColumns    = "columns"    // the row has a different number of columns than the header
+	RuleRequired   = "required"   // a required column is empty
+	RuleType       = "type"       // the value can't be parsed into the type of its field
+	RuleRange      = "range"      // the value is out of range
+	RuleFormat     = "format"     // the value doesn't have the expected format
+	RuleIdentifier = "identifier" // the value is not a valid identifier, see Validator
+	RuleCurrency   = "currency"   // the amount is in another currency than its record
+	RuleReference  = "reference"  // the value refers to no known record but is close to one, see Column.References
+)
+
+// FieldError is a problem with the value of a column in a row of a file. Errors in spreadsheets also carry the
+// reference of the cell, e.g. C5. Invalid identifiers can come with a known identifier the value is likely a typo of.
+type FieldError struct {
+	Line       int    `json:"line"`
+	Cell       string `json:"cell,omitempty"`
+	Column     string `json:"column,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Rule       string `json:"rule"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (e FieldError) Error() string {
+	if e.Suggestion != "" {
+		e.Message += fmt.Sprintf(", did you mean %s?", e.Suggestion)
+	}
+	if e.Cell != "" {
+		if e.Column == "" {
+			return fmt.Sprintf("cell %s: %s", e.Cell, e.Message)
+		}
+		return fmt.Sprintf("cell %s, column %s: %s", e.Cell, e.Column, e.Message)
+	}
+	if e.Column == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("line %d, column %s: %s", e.Line, e.Column, e.Message)
+}
+
+// RowError reports the problems of an invalid row. Rows return it from Next, the following rows can still be read.
+type RowError struct {
+	Line   int
+	Errors []FieldError
+	// Header holds the canonical names of the columns of the file and Record the values of the row.
+	Header []string
+	Record []string
+}
+
+func (e *RowError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		messages[i] = fieldErr.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validator holds the validation of rows which is configured per deployment rather than declared in Schemas: the
+// validators of identifier columns and the policy for unknown transaction keywords. Rows are validated by the
+// Validator they were opened with, so processors with different configurations don't affect each other.
+type Validator struct {
+	// Identifiers maps columns to the validator of their identifiers, which is applied to the column in every file
+	// type. Invalid identifiers are reported with RuleIdentifier. See ConfigureIdentifiers.
+	Identifiers map[string]IdentifierValidator
+	// UnknownKeywords is the policy for keywords which are not in TransactionTypes, see SetUnknownKeywords.
+	UnknownKeywords string
+	// known returns the known references of a column, see WithKnownReferences.
+	known func(column string) []string
+}
+
+// NewValidator returns a validator with the DefaultIdentifiers which rejects unknown keywords.
+func NewValidator() *Validator {
+	return &Validator{Identifiers: DefaultIdentifiers(), UnknownKeywords: UnknownKeywordsReject}
+}
+
+// validate applies the configured validation of a column to a value and returns the rule and message of a problem.
+// A nil validator validates like NewValidator.
+func (v *Validator) validate(column string, value string) (string, string, bool) {
+	if v == nil {
+		v = defaultValidator
+	}
+	if column == keywordColumn && v.UnknownKeywords != UnknownKeywordsAccept {
+		if _, ok := LookupTransactionType(value); !ok {
+			return RuleFormat, "must be a known transaction type", false
+		}
+	}
+	if validator := v.Identifiers[column]; validator != nil {
+		err := validator.Validate(value)
+		if err != nil {
+			return RuleIdentifier, err.Error(), false
+		}
+	}
+	return "", "", true
+}
+
+// WithKnownReferences returns a copy of the validator which checks the values of columns referring to other records,
+// see Column.References, against the references known returns for the column. known returns them sorted, or nil if
+// they aren't all known. A nil validator is copied from NewValidator.
+func (v *Validator) WithKnownReferences(known func(column string) []string) *Validator {
+	if v == nil {
+		v = defaultValidator
+	}
+	copied := *v
+	copied.known = known
+	return &copied
+}
+
+// unknownReference returns the known reference which the value of a column referring to other records is likely a
+// typo of, if the value itself is not known. Unknown values which aren't close to a known reference are accepted, as
+// their records may be loaded later.
+func (v *Validator) unknownReference(column Column, value string) (string, bool) {
+	if v == nil || v.known == nil || column.References == "" {
+		return "", false
+	}
+	known := v.known(column.Name)
+	if i := sort.SearchStrings(known, value); i < len(known) && known[i] == value {
+		return "", false
+	}
+	return Suggest(value, known)
+}
+
+// defaultValidator validates rows opened without a validator. It is never changed.
+var defaultValidator = NewValidator()
+
+// Check is a validation rule for the values of a column. Empty values are not checked, see Column.Required.
+type Check struct {
+	Rule    string
+	Message string
+	Valid   func(value string) bool
+}
+
+// NonNegative checks that a number or an amount, see ParseMoney, is not negative.
+func NonNegative() Check {
+	return Check{
+		Rule:    RuleRange,
+		Message: "must not be negative",
+		Valid: func(value string) bool {
+			sign, ok := signOf(value)
+			return ok && sign >= 0
+		},
+	}
+}
+
+// Positive checks that a number or an amount, see ParseMoney, is greater than zero.
+func Positive() Check {
+	return Check{
+		Rule:    RuleRange,
+		Message: "must be positive",
+		Valid: func(value string) bool {
+			sign, ok := signOf(value)
+			return ok && sign > 0
+		},
+	}
+}
+
+// signOf returns the sign of a number or an amount. Its currency is checked by the record, see RowValidator.
+func signOf(value string) (int, bool) {
+	amount, err := ParseMoney(value, "")
+	if err != nil {
+		return 0, false
+	}
+	return amount.Sign(), true
+}
+
+// Matches checks that a value matches a regular expression.
+func Matches(pattern string) Check {
+	re := regexp.MustCompile(pattern)
+	return Check{
+		Rule:    RuleFormat,
+		Message: fmt.Sprintf("must match %s", pattern),
+		Valid:   re.MatchString,
+	}
+}
+
+// BusinessDate checks that a value is a business date, see ParseBusinessDate.
+func BusinessDate() Check {
+	return Check{
+		Rule:    RuleFormat,
+		Message: "must be a date formatted as YYYYMMDD or YYYY-MM-DD",
+		Valid: func(value string) bool {
+			_, err := ParseBusinessDate(value)
+			return err == nil
+		},
+	}
+}
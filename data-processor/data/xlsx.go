@@ -0,0 +1,526 @@
+package data
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xlsxRows reads records of type T from a sheet of an XLSX workbook. The first non-empty row of the sheet is the
+// header and is matched against the schema of the file type like the header of a CSV file. Cell values are converted
+// to the text a CSV file would hold, dates as YYYY-MM-DD, so that they are validated and decoded the same way. The
+// sheet is read one row at a time, only the shared strings of the workbook are held in memory.
+//
+// Rows are numbered like in the sheet and field errors carry the reference of their cell, e.g. C5.
+type xlsxRows[T any] struct {
+	fileType  string
+	validator *Validator
+	sheet     string
+	r         io.Reader
+	temporary *os.File
+	content   io.ReadCloser
+	xml       *xml.Decoder
+	workbook  *xlsxWorkbook
+	decoder   *decoder[T]
+	first     int               // index of the first column of the header
+	width     int               // number of columns of the header
+	names     []string          // canonical names of the header columns
+	cells     map[string]string // column letters by canonical column name
+	line      int
+}
+
+// NewXLSXRows returns the records of the named sheet of an XLSX workbook, or of its first sheet if sheet is empty.
+// The workbook is opened on the first call to Next, buffering it in a temporary file unless r is a file or an
+// in-memory reader. Close removes the temporary file.
+func NewXLSXRows[T any](r io.Reader, fileType string, sheet string, validator *Validator) Rows[T] {
+	return &xlsxRows[T]{fileType: fileType, sheet: sheet, r: r, validator: validator}
+}
+
+func (r *xlsxRows[T]) Next() (T, error) {
+	var record T
+	if r.xml == nil {
+		err := r.open()
+		if err != nil {
+			return record, err
+		}
+	}
+	if r.decoder == nil {
+		err := r.readHeader()
+		if err != nil {
+			return record, err
+		}
+	}
+
+	for {
+		line, cells, err := r.readRow()
+		if err != nil {
+			return record, err
+		}
+		r.line = line
+		values, err := r.values(line, cells)
+		if err != nil {
+			return record, err
+		}
+		if values == nil {
+			continue
+		}
+		record, err = r.decoder.decode(line, values)
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			for i, fieldErr := range rowErr.Errors {
+				if cell, ok := r.cells[fieldErr.Column]; ok {
+					rowErr.Errors[i].Cell = cell + strconv.Itoa(line)
+				}
+			}
+		}
+		return record, err
+	}
+}
+
+// Close closes the sheet and removes the temporary file the workbook was buffered in.
+func (r *xlsxRows[T]) Close() error {
+	var errs []error
+	if r.content != nil {
+		errs = append(errs, r.content.Close())
+		r.content = nil
+	}
+	if r.temporary != nil {
+		errs = append(errs, r.temporary.Close(), os.Remove(r.temporary.Name()))
+		r.temporary = nil
+	}
+	return errors.Join(errs...)
+}
+
+func (r *xlsxRows[T]) open() error {
+	reader, size, temporary, err := randomAccess(r.r, "workbook-*.xlsx")
+	r.temporary = temporary
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return ErrEmptyFile
+	}
+	archive, err := zip.NewReader(reader, size)
+	if err != nil {
+		return fmt.Errorf("couldn't open XLSX workbook: %w", err)
+	}
+	r.workbook, err = openWorkbook(archive)
+	if err != nil {
+		return err
+	}
+	sheet, err := r.workbook.sheetPath(r.sheet)
+	if err != nil {
+		return err
+	}
+	r.content, err = openPart(archive, sheet)
+	if err != nil {
+		return err
+	}
+	r.xml = xml.NewDecoder(r.content)
+	return nil
+}
+
+// readHeader reads the first non-empty row as the header. Columns before the first header cell are ignored.
+func (r *xlsxRows[T]) readHeader() error {
+	var header []string
+	for header == nil {
+		r.first = 0
+		line, cells, err := r.readRow()
+		if errors.Is(err, io.EOF) {
+			return ErrEmptyFile
+		}
+		if err != nil {
+			return err
+		}
+		r.line = line
+		header = make([]string, 0, len(cells))
+		for column, cell := range cells {
+			value, err := r.workbook.value(cell)
+			if err != nil {
+				return fmt.Errorf("header cell %s %w", cell.Ref, err)
+			}
+			if value == "" && len(header) == 0 {
+				r.first = column + 1
+				continue
+			}
+			header = append(header, value)
+		}
+		for len(header) > 0 && header[len(header)-1] == "" {
+			header = header[:len(header)-1]
+		}
+		if len(header) == 0 {
+			header = nil
+		}
+	}
+
+	schema, columns, err := ResolveHeader(r.fileType, header)
+	if err != nil {
+		return err
+	}
+	r.decoder = newDecoder[T](schema, columns, r.validator)
+	r.width = len(header)
+	r.names = columns
+	r.cells = map[string]string{}
+	for i, name := range columns {
+		r.cells[name] = columnLetters(r.first + i)
+	}
+	return nil
+}
+
+// readRow reads the next row of the sheet and returns its number and its cells by column index. Missing cells are
+// empty.
+func (r *xlsxRows[T]) readRow() (int, []xlsxCell, error) {
+	for {
+		token, err := r.xml.Token()
+		if err != nil {
+			return 0, nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+		var row struct {
+			Number int        `xml:"r,attr"`
+			Cells  []xlsxCell `xml:"c"`
+		}
+		err = r.xml.DecodeElement(&row, &start)
+		if err != nil {
+			return 0, nil, fmt.Errorf("couldn't read row after line %d: %w", r.line, err)
+		}
+		if row.Number == 0 {
+			row.Number = r.line + 1
+		}
+
+		var cells []xlsxCell
+		for i, cell := range row.Cells {
+			column := i
+			if cell.Ref != "" {
+				column, ok = columnIndex(cell.Ref)
+				if !ok {
+					return 0, nil, fmt.Errorf("line %d: invalid cell reference %q", row.Number, cell.Ref)
+				}
+			} else {
+				cell.Ref = columnLetters(column) + strconv.Itoa(row.Number)
+			}
+			for len(cells) <= column {
+				cells = append(cells, xlsxCell{})
+			}
+			cells[column] = cell
+		}
+		return row.Number, cells, nil
+	}
+}
+
+// values returns the values of the header columns of a row, or nil if the row is empty. Values right of the header
+// make the row longer than the header, so that it is reported as invalid.
+func (r *xlsxRows[T]) values(line int, cells []xlsxCell) ([]string, error) {
+	values := make([]string, r.width)
+	empty := true
+	var errs []FieldError
+	for column := r.first; column < len(cells); column++ {
+		i := column - r.first
+		value, err := r.workbook.value(cells[column])
+		if err != nil {
+			fieldErr := FieldError{Line: line, Cell: cells[column].Ref, Rule: RuleType, Message: err.Error()}
+			if i < len(r.names) {
+				fieldErr.Column = r.names[i]
+			}
+			errs = append(errs, fieldErr)
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		empty = false
+		for len(values) <= i {
+			values = append(values, "")
+		}
+		values[i] = value
+	}
+	if len(errs) > 0 {
+		return nil, r.decoder.rowError(line, values, errs)
+	}
+	if empty {
+		return nil, nil
+	}
+	return values, nil
+}
+
+// xlsxCell is a cell of a sheet.
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Style  int    `xml:"s,attr"`
+	Value  string `xml:"v"`
+	Inline struct {
+		Text string     `xml:"t"`
+		Runs []xlsxText `xml:"r"`
+	} `xml:"is"`
+}
+
+// xlsxText is a run of rich text.
+type xlsxText struct {
+	Text string `xml:"t"`
+}
+
+// xlsxWorkbook holds what's needed to read the cells of the sheets of a workbook.
+type xlsxWorkbook struct {
+	sheets     []string          // sheet names in workbook order
+	paths      map[string]string // paths of the sheets by name
+	strings    []string          // shared strings
+	dateStyles map[int]bool      // cell styles formatting numbers as dates
+	date1904   bool              // dates count from 1904 instead of 1900
+}
+
+func openWorkbook(archive *zip.Reader) (*xlsxWorkbook, error) {
+	var workbook struct {
+		Properties struct {
+			Date1904 bool `xml:"date1904,attr"`
+		} `xml:"workbookPr"`
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	err := decodePart(archive, "xl/workbook.xml", &workbook)
+	if err != nil {
+		return nil, err
+	}
+	var relationships struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	err = decodePart(archive, "xl/_rels/workbook.xml.rels", &relationships)
+	if err != nil {
+		return nil, err
+	}
+	targets := map[string]string{}
+	for _, relationship := range relationships.Relationships {
+		target := relationship.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join("xl", target)
+		}
+		targets[relationship.ID] = target
+	}
+
+	w := &xlsxWorkbook{paths: map[string]string{}, date1904: workbook.Properties.Date1904}
+	for _, sheet := range workbook.Sheets {
+		w.sheets = append(w.sheets, sheet.Name)
+		w.paths[sheet.Name] = targets[sheet.ID]
+	}
+
+	var shared struct {
+		Items []struct {
+			Text string     `xml:"t"`
+			Runs []xlsxText `xml:"r"`
+		} `xml:"si"`
+	}
+	err = decodePart(archive, "xl/sharedStrings.xml", &shared)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, item := range shared.Items {
+		w.strings = append(w.strings, richText(item.Text, item.Runs))
+	}
+
+	var styles struct {
+		Formats []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		Cells []struct {
+			Format int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+	err = decodePart(archive, "xl/styles.xml", &styles)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	dateFormats := map[int]bool{}
+	for _, format := range styles.Formats {
+		dateFormats[format.ID] = isDateFormat(format.Code)
+	}
+	w.dateStyles = map[int]bool{}
+	for i, style := range styles.Cells {
+		date, ok := dateFormats[style.Format]
+		if !ok {
+			date = isBuiltinDateFormat(style.Format)
+		}
+		w.dateStyles[i] = date
+	}
+	return w, nil
+}
+
+// sheetPath returns the path of the named sheet in the archive, or of the first sheet if the name is empty.
+func (w *xlsxWorkbook) sheetPath(name string) (string, error) {
+	if len(w.sheets) == 0 {
+		return "", fmt.Errorf("XLSX workbook has no sheets")
+	}
+	if name == "" {
+		name = w.sheets[0]
+	}
+	sheet, ok := w.paths[name]
+	if !ok {
+		return "", fmt.Errorf("XLSX workbook has no sheet %q, its sheets are %q", name, w.sheets)
+	}
+	return sheet, nil
+}
+
+// value returns the text of a cell as it would appear in a CSV file.
+func (w *xlsxWorkbook) value(cell xlsxCell) (string, error) {
+	switch cell.Type {
+	case "s":
+		index, err := strconv.Atoi(cell.Value)
+		if err != nil || index < 0 || index >= len(w.strings) {
+			return "", fmt.Errorf("refers to the missing shared string %q", cell.Value)
+		}
+		return w.strings[index], nil
+	case "inlineStr":
+		return richText(cell.Inline.Text, cell.Inline.Runs), nil
+	case "str", "d":
+		return cell.Value, nil
+	case "b":
+		return strconv.FormatBool(cell.Value == "1"), nil
+	case "e":
+		return "", fmt.Errorf("contains the error %s", cell.Value)
+	}
+	if cell.Value == "" {
+		return "", nil
+	}
+	number, err := strconv.ParseFloat(cell.Value, 64)
+	if err != nil {
+		return cell.Value, nil
+	}
+	if w.dateStyles[cell.Style] {
+		return w.date(number), nil
+	}
+	// Excel writes numbers with up to 17 digits, e.g. 789.55999999999995, shorten them to what was entered.
+	return strconv.FormatFloat(number, 'f', -1, 64), nil
+}
+
+// date converts a serial date to YYYY-MM-DD, or to a timestamp if it has a time of day.
+func (w *xlsxWorkbook) date(serial float64) string {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if w.date1904 {
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	days, fraction := math.Modf(serial)
+	date := epoch.AddDate(0, 0, int(days))
+	if fraction == 0 {
+		return date.Format(time.DateOnly)
+	}
+	return date.Add(time.Duration(math.Round(fraction*24*60*60)) * time.Second).Format(time.RFC3339)
+}
+
+// isBuiltinDateFormat reports whether a built-in number format formats dates.
+func isBuiltinDateFormat(id int) bool {
+	return id >= 14 && id <= 22 || id >= 27 && id <= 36 || id >= 45 && id <= 47 || id >= 50 && id <= 58
+}
+
+// isDateFormat reports whether a custom number format formats dates, i.e. has day or year placeholders outside of
+// quoted text and brackets.
+func isDateFormat(code string) bool {
+	quoted, bracketed := false, false
+	for _, c := range strings.ToLower(code) {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			bracketed = true
+		case c == ']':
+			bracketed = false
+		case bracketed:
+		case c == 'd' || c == 'y':
+			return true
+		}
+	}
+	return false
+}
+
+func richText(text string, runs []xlsxText) string {
+	if len(runs) == 0 {
+		return text
+	}
+	var b strings.Builder
+	for _, run := range runs {
+		b.WriteString(run.Text)
+	}
+	return b.String()
+}
+
+func openPart(archive *zip.Reader, name string) (io.ReadCloser, error) {
+	part, err := archive.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open %s of XLSX workbook: %w", name, err)
+	}
+	return part, nil
+}
+
+func decodePart(archive *zip.Reader, name string, v any) error {
+	part, err := openPart(archive, name)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	err = xml.NewDecoder(part).Decode(v)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s of XLSX workbook: %w", name, err)
+	}
+	return nil
+}
+
+// columnIndex returns the index of the column of a cell reference, e.g. 2 for C5.
+func columnIndex(ref string) (int, bool) {
+	column := 0
+	letters := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		column = column*26 + int(c-'A') + 1
+		letters++
+	}
+	return column - 1, letters > 0
+}
+
+// columnLetters returns the letters of a column, e.g. C for 2 and AA for 26.
+func columnLetters(index int) string {
+	var letters []byte
+	for index++; index > 0; index = (index - 1) / 26 {
+		letters = append(letters, byte('A'+(index-1)%26))
+	}
+	for i, j := 0, len(letters)-1; i < j; i, j = i+1, j-1 {
+		letters[i], letters[j] = letters[j], letters[i]
+	}
+	return string(letters)
+}
+
+func ParseClientXLSX(data []byte, sheet string) ([]*Client, error) {
+	return collect(NewXLSXRows[Client](bytes.NewReader(data), "clients", sheet, nil))
+}
+
+func ParsePortfolioXLSX(data []byte, sheet string) ([]*Portfolio, error) {
+	return collect(NewXLSXRows[Portfolio](bytes.NewReader(data), "portfolios", sheet, nil))
+}
+
+func ParseAccountXLSX(data []byte, sheet string) ([]*Account, error) {
+	return collect(NewXLSXRows[Account](bytes.NewReader(data), "accounts", sheet, nil))
+}
+
+func ParseTransactionXLSX(data []byte, sheet string) ([]*Transaction, error) {
+	return collect(NewXLSXRows[Transaction](bytes.NewReader(data), "transactions", sheet, nil))
+}
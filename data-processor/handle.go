@@ -1,169 +1,447 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"strings"
 
-	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/joidegn/scalable-capital/data-processor/data"
+	"github.com/joidegn/scalable-capital/data-processor/processor"
 )
 
-type Event struct {
-	Records []Record `json:"records"`
+type handler struct {
+	d      *data.DataManager
+	p      *processor.Processor
+	router *processor.Router
+	// store is where the records processed by p are read from, e.g. for the totals of clients.
+	store data.Store
+	// batches is nil if files are processed as they arrive rather than in batches per business date.
+	batches *processor.Coordinator
 }
 
-type Record struct {
-	S3 S3 `json:"s3`
+// Record statuses reported in a RecordResult.
+const (
+	statusProcessed = "processed"
+	statusRetracted = "retracted"
+	statusSkipped   = "skipped"
+	statusDeferred  = "deferred"
+	statusFailed    = "failed"
+)
+
+// Report summarises the outcome of every record of an event.
+type Report struct {
+	Records   []RecordResult `json:"records"`
+	Processed int            `json:"processed"`
+	Skipped   int            `json:"skipped"`
+	Deferred  int            `json:"deferred"`
+	Failed    int            `json:"failed"`
 }
 
-type S3 struct {
-	Bucket Bucket `json:"bucket"`
-	Object Object `json:"object"`
+// RecordResult describes the outcome of processing a single S3 object or uploaded file.
+type RecordResult struct {
+	Bucket    string            `json:"bucket"`
+	Key       string            `json:"key"`
+	Entry     string            `json:"entry,omitempty"`
+	FileType  string            `json:"file_type"`
+	Params    map[string]string `json:"params,omitempty"`
+	Status    string            `json:"status"`
+	Parsed    int               `json:"rows_parsed"`
+	Inserted  int               `json:"rows_inserted"`
+	Invalid   int               `json:"rows_invalid,omitempty"`
+	Retracted int               `json:"rows_retracted,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	// ErrorReport is the key of the report listing the invalid rows of the file.
+	ErrorReport string `json:"error_report,omitempty"`
+	// Quarantine is the key of the invalid rows skipped by the error policy.
+	Quarantine string `json:"quarantine,omitempty"`
+	// RowErrors lists the invalid rows of an uploaded file, which has no place to store an error report.
+	RowErrors []data.FieldError `json:"row_errors,omitempty"`
+	// QuarantinedRows holds the rows of an uploaded file skipped by the error policy as CSV, which has no place to
+	// store them either, see processor.QuarantineFile.
+	QuarantinedRows string `json:"quarantined_rows,omitempty"`
 }
 
-type Bucket struct {
-	Name string
+func (r *Report) add(results ...RecordResult) {
+	for _, result := range results {
+		r.Records = append(r.Records, result)
+		switch result.Status {
+		case statusFailed:
+			r.Failed++
+		case statusSkipped:
+			r.Skipped++
+		case statusDeferred:
+			r.Deferred++
+		default:
+			r.Processed++
+		}
+	}
 }
 
-type Object struct {
-	Key string
+// handleEvent processes every object of an S3 notification, EventBridge event or SNS message wrapping either of them.
+// Scheduled events trigger loading the batches whose cutoff has passed.
+func (h handler) handleEvent(ctx context.Context, payload json.RawMessage) (Report, error) {
+	log.Printf("Event: %s", payload)
+
+	if scheduledEvent(payload) {
+		if h.batches == nil {
+			return Report{}, nil
+		}
+		return h.sweepBatches(), nil
+	}
+
+	objects, err := parseObjectEvents(payload)
+	if err != nil {
+		log.Printf("Error parsing event: %s", err)
+		return Report{}, err
+	}
+
+	// Every object is processed independently so that one broken file does not hide the results of the others.
+	var report Report
+	for _, object := range objects {
+		report.add(h.handleObject(object)...)
+	}
+	log.Printf("Processed %d records, %d failed", report.Processed, report.Failed)
+
+	return report, nil
 }
 
-type handler struct {
-	d *data.DataManager
+// handleObject retracts a removed object, adds a new object to the batch of its business date or processes it right
+// away if there is no batch for it. The error reports and quarantined rows written by the processor are ignored.
+// Control files are not processed themselves, their arrival triggers processing the file they belong to.
+func (h handler) handleObject(object objectEvent) []RecordResult {
+	if strings.HasPrefix(object.Key, processor.ReportPrefix) || strings.HasPrefix(object.Key, processor.QuarantinePrefix) {
+		log.Printf("Ignoring %s written by the processor", object.Key)
+		return nil
+	}
+	if processor.IsControlFile(object.Key) {
+		return h.handleControlFile(object)
+	}
+
+	if object.Removed {
+		return []RecordResult{h.retractObject(object)}
+	}
+
+	if h.batches != nil {
+		route, err := h.router.Route(object.Bucket, object.Key)
+		if err == nil && route.Params["business_date"] != "" {
+			businessDate, err := data.ParseBusinessDate(route.Params["business_date"])
+			if err == nil {
+				return h.batchObject(object, businessDate, route.FileType)
+			}
+		}
+	}
+
+	return h.processObject(object)
 }
 
-func (h handler) handleEvent(ctx context.Context, event events.S3Event) (string, error) {
-	log.Printf("Event: %+v", event)
-	eventJson, _ := json.Marshal(event)
-	var data Event
+// handleControlFile processes the object a new control file belongs to if its routing rule requires a control file.
+// The control file is expected to be uploaded after the object, which is deferred until then. A control file uploaded
+// before its object is only recorded, the event of the object picks it up. The object is processed in its current
+// version, so that the ledger skips it if the control file is delivered again.
+func (h handler) handleControlFile(object objectEvent) []RecordResult {
+	key := object.Key[:len(object.Key)-len(processor.ControlSuffix)]
+	route, err := h.router.Route(object.Bucket, processor.DecompressedName(key))
+	if object.Removed || err != nil || route.Controls != processor.ControlsSidecar {
+		log.Printf("Ignoring control file %s", object.Key)
+		return nil
+	}
+
+	version, err := h.d.HeadFile(object.Bucket, key)
+	if err != nil {
+		return []RecordResult{{Bucket: object.Bucket, Key: key, FileType: route.FileType, Status: statusFailed, Error: err.Error()}}
+	}
+	if version == nil {
+		log.Printf("Control file %s arrived before %s, which picks it up once it arrives", object.Key, key)
+		return []RecordResult{{Bucket: object.Bucket, Key: object.Key, FileType: route.FileType, Status: statusDeferred}}
+	}
+	return h.handleObject(objectEvent{Bucket: object.Bucket, Key: key, VersionID: version.VersionID, ETag: version.ETag})
+}
+
+// processObject downloads and processes a single object and reports the outcome. Compressed objects are decompressed
+// and the entries of archives are routed and processed as if they had been uploaded individually, in load order.
+// Objects whose routing rule requires a control file are deferred until it has been uploaded.
+func (h handler) processObject(object objectEvent) []RecordResult {
+	bucket, key := object.Bucket, object.Key
+
+	result := RecordResult{
+		Bucket: bucket,
+		Key:    key,
+		Status: statusFailed,
+	}
+
+	// Archives can only be routed entry by entry once they have been expanded.
+	var controls *data.ControlTotals
+	if !processor.IsArchive(key) {
+		route, err := h.router.Route(bucket, processor.DecompressedName(key))
+		if err != nil {
+			log.Printf("Error routing object: %s", err)
+			result.Error = err.Error()
+			return []RecordResult{result}
+		}
+		result.FileType, result.Params = route.FileType, route.Params
 
-	json.Unmarshal(eventJson, &data)
-	bucket := data.Records[0].S3.Bucket.Name
-	key := data.Records[0].S3.Object.Key
+		if route.Controls == processor.ControlsSidecar {
+			controls, err = h.readControlFile(bucket, key)
+			var noSuchKey *types.NoSuchKey
+			if errors.As(err, &noSuchKey) {
+				log.Printf("Deferring %s until its control file has been uploaded", key)
+				result.Status = statusDeferred
+				return []RecordResult{result}
+			}
+			if err != nil {
+				log.Printf("Error reading control file: %s", err)
+				result.Error = err.Error()
+				return []RecordResult{result}
+			}
+		}
+	}
 
-	fileType := strings.Split(key, "_")[0] // The file type is determined by the file name up until the first underscore.
-	log.Printf("File type: %s", fileType)
+	// Notifications are delivered at least once, versions of the object which have been processed already are skipped.
+	version := data.ObjectVersion{VersionID: object.VersionID, ETag: object.ETag}
+	duplicate, err := h.p.Duplicate(bucket, key, version)
+	if err != nil {
+		log.Printf("Error checking the ledger: %s", err)
+		result.Error = err.Error()
+		return []RecordResult{result}
+	}
+	if duplicate {
+		log.Printf("Skipping object %s in bucket %s which has been processed already", key, bucket)
+		result.Status = statusSkipped
+		return []RecordResult{result}
+	}
 
-	fileContent, err := h.d.DownloadFile(bucket, key)
+	body, contentType, err := h.d.DownloadFile(bucket, key)
 	if err != nil {
 		log.Printf("Error fetching file: %s", err)
-		return "", err
+		result.Error = err.Error()
+		h.d.SendErrorEvent(err)
+		return []RecordResult{result}
 	}
+	defer body.Close()
+	content := processor.NewChecksumReader(body)
 
-	log.Printf("File content: %s", fileContent)
-
-	err = h.processFile(fileType, fileContent)
+	files, cleanup, err := processor.Expand(key, content)
+	defer cleanup()
 	if err != nil {
-		log.Printf("Error processing file: %s", err)
+		log.Printf("Error expanding file: %s", err)
+		result.Error = err.Error()
 		h.d.SendErrorEvent(err)
-		return "", err
+		h.recordOutcome(bucket, key, version, data.LedgerFailed)
+		return []RecordResult{result}
 	}
 
-	msg := fmt.Sprintf("Processed object uploaded to bucket %s with key %s", bucket, key)
-	log.Print(msg)
+	results := h.processFiles(bucket, key, contentType, files, controls)
+	status := data.LedgerProcessed
+	for _, result := range results {
+		if result.Status == statusFailed {
+			status = data.LedgerFailed
+		}
+	}
+	if status == data.LedgerProcessed {
+		version.Checksum, err = content.Sum()
+		if err != nil {
+			log.Printf("Error computing checksum: %s", err)
+		}
+	}
+	h.recordOutcome(bucket, key, version, status)
 
-	return msg, nil
+	return results
 }
 
-func (h handler) processFile(fileType string, fileContent []byte) error {
-	var err error
-	switch fileType {
-	case "clients":
-		log.Printf("Processing clients file")
-		err = h.processClientFile(fileContent)
-	case "portfolios":
-		log.Printf("Processing portfolios file")
-		err = h.processPortfolioFile(fileContent)
-	case "accounts":
-		log.Printf("Processing accounts file")
-		err = h.processAccountsFile(fileContent)
-	case "transactions":
-		log.Printf("Processing transactions file")
-		h.processTransactionsFile(fileContent)
-	default:
-		log.Printf("Unknown file type")
-		err = fmt.Errorf("unknown file type")
+// processFiles routes and processes the files expanded from an object in load order. The records of every file are
+// attributed to the object. The content type of the object helps to detect the format of files which are not entries
+// of an archive. controls are the control totals of the object from its control file, entries of archives find theirs
+// among the other entries.
+func (h handler) processFiles(bucket string, key string, contentType string, files []processor.File, controls *data.ControlTotals) []RecordResult {
+	var results []RecordResult
+	var routed []processor.File
+	var routes []processor.Route
+	for _, file := range files {
+		if processor.IsControlFile(file.Name) {
+			continue
+		}
+		route, err := h.router.Route(bucket, file.Name)
+		if err != nil {
+			log.Printf("Error routing %s: %s", file.Name, err)
+			results = append(results, RecordResult{Bucket: bucket, Key: key, Entry: entryName(key, file), Status: statusFailed, Error: err.Error()})
+			continue
+		}
+		route.Key, route.Entry = key, entryName(key, file)
+		if route.Controls == processor.ControlsSidecar {
+			route.ControlTotals = controls
+			if entryName(key, file) != "" {
+				route.ControlTotals, err = processor.SidecarControls(files, file.Name)
+			}
+			if err != nil {
+				log.Printf("Error reading control file of %s: %s", file.Name, err)
+				results = append(results, RecordResult{Bucket: bucket, Key: key, Entry: entryName(key, file), FileType: route.FileType, Status: statusFailed, Error: err.Error()})
+				continue
+			}
+		}
+		switch {
+		case route.Format != "":
+			// the format of the rule
+		case entryName(key, file) == "":
+			route.Format = processor.DetectFormat(file.Name, contentType)
+		default:
+			route.Format = processor.DetectFormat(file.Name, "")
+		}
+		routed = append(routed, file)
+		routes = append(routes, route)
 	}
-	return err
-}
+	order := processor.SortByLoadOrder(routes)
 
-func (h handler) processClientFile(fileContent []byte) error {
-	clients, err := data.ParseClientCSV(fileContent)
-	if err != nil {
-		log.Printf("Error parsing clients file: %s", err)
-		return err
-	}
-	log.Printf("Clients: %+v", clients)
-	for _, client := range clients {
-		err = h.d.InsertClient(*client)
+	for _, i := range order {
+		file, route := routed[i], routes[i]
+		result := RecordResult{
+			Bucket:   bucket,
+			Key:      key,
+			Entry:    entryName(key, file),
+			FileType: route.FileType,
+			Params:   route.Params,
+			Status:   statusFailed,
+		}
+
+		counts, quarantined, err := h.processFile(bucket, route, file, result.Entry)
+		result.Parsed, result.Inserted, result.Invalid = counts.Parsed, counts.Inserted, counts.Invalid
+		result.Quarantine = quarantined
 		if err != nil {
-			log.Printf("Error inserting client: %s", err)
-			return err
+			log.Printf("Error processing file: %s", err)
+			result.Error = err.Error()
+			var validationErr *processor.ValidationError
+			if errors.As(err, &validationErr) {
+				result.ErrorReport = h.writeErrorReport(bucket, key, result.Entry, validationErr)
+			}
+			h.d.SendErrorEvent(err)
+			results = append(results, result)
+			continue
 		}
 
-		// Collect data for client message
-		//taxesPaid, err := h.d.GetTaxesPaidByClient(client.ClientReference)
-		//if err != nil {
-		//	log.Printf("Error getting taxes paid: %s", err)
-		//	return err
-		//}
+		result.Status = statusProcessed
+		log.Printf("Processed %s of object uploaded to bucket %s with key %s", file.Name, bucket, key)
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// processFile processes a file and writes the rows quarantined by the error policy of its route to the dead-letter
+// prefix of the bucket. It returns the key of the quarantined rows, if there are any.
+func (h handler) processFile(bucket string, route processor.Route, file processor.File, entry string) (processor.Counts, string, error) {
+	buffer, err := os.CreateTemp("", "quarantine-*.csv")
+	if err != nil {
+		return processor.Counts{}, "", err
+	}
+	defer os.Remove(buffer.Name())
+	defer buffer.Close()
 
+	quarantine := processor.NewQuarantineFile(buffer)
+	counts, err := openAndProcess(h.p, route, file, quarantine)
+	if err != nil || quarantine.Rows == 0 {
+		return counts, "", err
 	}
 
-	return nil
+	// The valid rows have been stored, so the file has to fail if the quarantined rows can't be kept.
+	quarantineKey := processor.QuarantineKey(route.Key, entry)
+	err = quarantine.Flush()
+	if err == nil {
+		_, err = buffer.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = h.d.UploadFile(bucket, quarantineKey, buffer, "text/csv")
+	}
+	if err != nil {
+		return counts, "", fmt.Errorf("couldn't quarantine %d invalid rows: %w", quarantine.Rows, err)
+	}
+	log.Printf("Quarantined %d invalid rows of %s to %s", quarantine.Rows, route.Key, quarantineKey)
+	return counts, quarantineKey, nil
 }
 
-func (h handler) processPortfolioFile(fileContent []byte) error {
-	portfolios, err := data.ParsePortfolioCSV(fileContent)
+// readControlFile reads the control totals of an object from its control file.
+func (h handler) readControlFile(bucket string, key string) (*data.ControlTotals, error) {
+	body, _, err := h.d.DownloadFile(bucket, processor.ControlFileName(key))
 	if err != nil {
-		log.Printf("Error parsing portfolios file: %s", err)
-		return err
+		return nil, err
 	}
-	log.Printf("Portfolios: %+v", portfolios)
-	for _, portfolio := range portfolios {
-		err = h.d.InsertPortfolio(*portfolio)
-		if err != nil {
-			log.Printf("Error inserting portfolio: %s", err)
-			return err
-		}
+	defer body.Close()
+	return data.ParseControlFile(body)
+}
+
+// openAndProcess processes a file. quarantine may be nil to discard the rows skipped by the error policy.
+func openAndProcess(p *processor.Processor, route processor.Route, file processor.File, quarantine *processor.QuarantineFile) (processor.Counts, error) {
+	r, err := file.Open()
+	if err != nil {
+		return processor.Counts{}, err
 	}
-	return nil
+	defer r.Close()
+	return p.ProcessFile(route, r, quarantine)
 }
 
-func (h handler) processAccountsFile(fileContent []byte) error {
-	accounts, err := data.ParseAccountCSV(fileContent)
+// writeErrorReport writes the JSON and CSV reports of the invalid rows of a file next to the object and returns the
+// key of the JSON report. A failure is only logged, the result of the file reports the first error either way.
+func (h handler) writeErrorReport(bucket string, key string, entry string, report *processor.ValidationError) string {
+	jsonKey, csvKey := processor.ReportKeys(key, entry)
+	content, err := report.JSON()
+	if err == nil {
+		err = h.d.UploadFile(bucket, jsonKey, bytes.NewReader(content), "application/json")
+	}
 	if err != nil {
-		log.Printf("Error parsing accounts file: %s", err)
-		return err
+		log.Printf("Error writing error report %s: %s", jsonKey, err)
+		return ""
 	}
-	log.Printf("Accounts: %+v", accounts)
-	for _, account := range accounts {
-		err = h.d.InsertAccount(*account)
-		if err != nil {
-			log.Printf("Error inserting account: %s", err)
-			return err
-		}
+	content, err = report.CSV()
+	if err == nil {
+		err = h.d.UploadFile(bucket, csvKey, bytes.NewReader(content), "text/csv")
+	}
+	if err != nil {
+		log.Printf("Error writing error report %s: %s", csvKey, err)
+	}
+	return jsonKey
+}
+
+// entryName returns the name of an archive entry, or nothing for files which are the object itself.
+func entryName(key string, file processor.File) string {
+	if file.Name == key || file.Name == processor.DecompressedName(key) {
+		return ""
 	}
-	return nil
+	return file.Name
 }
 
-func (h handler) processTransactionsFile(fileContent []byte) error {
-	transactions, err := data.ParseTransactionCSV(fileContent)
+// retractObject withdraws the records loaded from a removed object.
+func (h handler) retractObject(object objectEvent) RecordResult {
+	result := RecordResult{
+		Bucket: object.Bucket,
+		Key:    object.Key,
+		Status: statusFailed,
+	}
+
+	retracted, err := h.p.RetractFile(result.Bucket, result.Key)
+	result.Retracted = retracted
 	if err != nil {
-		log.Printf("Error parsing transactions file: %s", err)
-		return err
+		log.Printf("Error retracting file: %s", err)
+		result.Error = err.Error()
+		h.d.SendErrorEvent(err)
+		return result
 	}
-	log.Printf("Transactions: %+v", transactions)
-	for _, transaction := range transactions {
-		err = h.d.InsertTransaction(*transaction)
-		if err != nil {
-			log.Printf("Error inserting transaction: %s", err)
-			return err
-		}
+
+	result.Status = statusRetracted
+	log.Printf("Retracted %d records loaded from object %s in bucket %s", retracted, result.Key, result.Bucket)
+
+	return result
+}
+
+// recordOutcome records the outcome in the ledger. A failure is only logged: the object has been processed either way
+// and processing it again is harmless as records are stored idempotently.
+func (h handler) recordOutcome(bucket string, key string, version data.ObjectVersion, status string) {
+	err := h.p.Record(bucket, key, version, status)
+	if err != nil {
+		log.Printf("Error recording %s in the ledger: %s", key, err)
 	}
-	return nil
 }
@@ -2,18 +2,35 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/joidegn/scalable-capital/data-processor/data"
+	"github.com/joidegn/scalable-capital/data-processor/processor"
 )
 
+func testHandler(t *testing.T) handler {
+	router, err := processor.NewRouter(processor.DefaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler{router: router}
+}
+
 func TestHandler(t *testing.T) {
 
 	var tests = []struct {
 		name  string
 		input events.S3Event
-		want  string
+		want  Report
 	}{
 		{
 			name: "test1",
@@ -47,19 +64,192 @@ func TestHandler(t *testing.T) {
 					},
 				},
 			},
-			want: "Processed object uploaded to bucket test-bucket with key test-key",
+			want: Report{
+				Records: []RecordResult{
+					{
+						Bucket: "test-bucket",
+						Key:    "test-key",
+						Status: statusFailed,
+						Error:  `no routing rule matches object "test-key" in bucket "test-bucket"`,
+					},
+				},
+				Failed: 1,
+			},
 		}}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := lambdaHandler(context.Background(), tt.input)
+			payload, _ := json.Marshal(tt.input)
+			got, err := testHandler(t).handleEvent(context.Background(), payload)
 			if err != nil {
 				t.Errorf("Handler() error = %v", err)
 			}
-			if got != tt.want {
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Handler() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 
 }
+
+func TestSQSHandler(t *testing.T) {
+	s3Event := `{"Records":[{"s3":{"bucket":{"name":"test-bucket"},"object":{"key":"test-key"}}}]}`
+	testEvent := `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"test-bucket"}`
+
+	input := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{MessageId: "unknown-file-type", Body: s3Event},
+			{MessageId: "test-event", Body: testEvent},
+			{MessageId: "malformed", Body: "not json"},
+		},
+	}
+	want := events.SQSEventResponse{
+		BatchItemFailures: []events.SQSBatchItemFailure{
+			{ItemIdentifier: "unknown-file-type"},
+			{ItemIdentifier: "malformed"},
+		},
+	}
+
+	got, err := testHandler(t).handleSQSEvent(context.Background(), input)
+	if err != nil {
+		t.Errorf("handleSQSEvent() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handleSQSEvent() = %v, want %v", got, want)
+	}
+}
+
+func TestParseObjectEvents(t *testing.T) {
+	var tests = []struct {
+		name  string
+		input string
+		want  []objectEvent
+	}{
+		{
+			name:  "s3 notification",
+			input: `{"Records":[{"eventSource":"aws:s3","s3":{"bucket":{"name":"test-bucket"},"object":{"key":"clients_20230826.csv","size":42,"eTag":"abc","versionId":"v1"}}}]}`,
+			want:  []objectEvent{{Bucket: "test-bucket", Key: "clients_20230826.csv", VersionID: "v1", ETag: "abc", Size: 42}},
+		},
+		{
+			name:  "s3 notification with url-encoded key",
+			input: `{"Records":[{"eventSource":"aws:s3","s3":{"bucket":{"name":"test-bucket"},"object":{"key":"daily+uploads/clients_20230826.csv"}}}]}`,
+			want:  []objectEvent{{Bucket: "test-bucket", Key: "daily uploads/clients_20230826.csv"}},
+		},
+		{
+			name:  "s3 removal",
+			input: `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"test-bucket"},"object":{"key":"clients_20230826.csv"}}}]}`,
+			want:  []objectEvent{{Bucket: "test-bucket", Key: "clients_20230826.csv", Removed: true}},
+		},
+		{
+			name:  "eventbridge",
+			input: `{"version":"0","source":"aws.s3","detail-type":"Object Created","detail":{"bucket":{"name":"test-bucket"},"object":{"key":"clients_20230826.csv","size":42,"etag":"abc","version-id":"v1"}}}`,
+			want:  []objectEvent{{Bucket: "test-bucket", Key: "clients_20230826.csv", VersionID: "v1", ETag: "abc", Size: 42}},
+		},
+		{
+			name:  "sns wrapped s3 notification",
+			input: `{"Records":[{"EventSource":"aws:sns","Sns":{"MessageId":"1","Message":"{\"Records\":[{\"s3\":{\"bucket\":{\"name\":\"test-bucket\"},\"object\":{\"key\":\"clients_20230826.csv\"}}}]}"}}]}`,
+			want:  []objectEvent{{Bucket: "test-bucket", Key: "clients_20230826.csv"}},
+		},
+		{
+			name:  "s3 test event",
+			input: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"test-bucket"}`,
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseObjectEvents([]byte(tt.input))
+			if err != nil {
+				t.Errorf("parseObjectEvents() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseObjectEvents() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerSkipsDuplicates(t *testing.T) {
+	store := data.NewMemoryStore()
+	store.PutLedgerEntry(data.LedgerEntry{
+		Bucket:        "test-bucket",
+		Key:           "clients_20230826.csv",
+		ObjectVersion: data.ObjectVersion{ETag: "abc"},
+		Status:        data.LedgerProcessed,
+	})
+	h := testHandler(t)
+	h.p = processor.NewProcessor(store, nil)
+
+	got := h.processObject(objectEvent{Bucket: "test-bucket", Key: "clients_20230826.csv", ETag: "abc"})
+	if len(got) != 1 || got[0].Status != statusSkipped {
+		t.Errorf("processObject() = %+v, want status %s", got, statusSkipped)
+	}
+}
+
+func TestHandlerIgnoresErrorReports(t *testing.T) {
+	h := testHandler(t)
+	got := h.handleObject(objectEvent{Bucket: "test-bucket", Key: "reports/clients_20230826.csv.errors.json"})
+	if len(got) != 0 {
+		t.Errorf("handleObject() = %+v, want no results", got)
+	}
+}
+
+func TestHandlerIgnoresControlFiles(t *testing.T) {
+	h := testHandler(t)
+	got := h.handleObject(objectEvent{Bucket: "test-bucket", Key: "clients_20230826.csv.ctl"})
+	if len(got) != 0 {
+		t.Errorf("handleObject() = %+v, want no results", got)
+	}
+}
+
+func TestHandlerControlFile(t *testing.T) {
+	// The bucket holds the control file and, unless uploaded is false, accounts_20230826.csv in version v1.
+	uploaded := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/test-bucket/accounts_20230826.csv.ctl":
+			fmt.Fprint(w, "rows=1\nhash_total=1\n")
+		case r.URL.Path == "/test-bucket/accounts_20230826.csv" && uploaded:
+			w.Header().Set("ETag", `"abc"`)
+			w.Header().Set("x-amz-version-id", "v1")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	s3Client := s3.New(s3.Options{
+		Region:           "eu-central-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: s3.EndpointResolverFromURL(srv.URL),
+		UsePathStyle:     true,
+	})
+
+	router, err := processor.NewRouter([]processor.Rule{{Name: "accounts", Key: "accounts_*.csv", FileType: "accounts", Controls: processor.ControlsSidecar}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := data.NewMemoryStore()
+	h := handler{d: data.NewDataManager(s3Client, nil, ""), p: processor.NewProcessor(store, nil), router: router}
+	control := objectEvent{Bucket: "test-bucket", Key: "accounts_20230826.csv.ctl"}
+
+	// A control file arriving before its object succeeds, the object's own event picks it up.
+	got := h.handleObject(control)
+	if len(got) != 1 || got[0].Status != statusDeferred {
+		t.Errorf("handleObject() before the object = %+v, want it deferred", got)
+	}
+
+	// A control file delivered again once its object has been processed is skipped, as the current version of the
+	// object is in the ledger.
+	uploaded = true
+	store.PutLedgerEntry(data.LedgerEntry{
+		Bucket:        "test-bucket",
+		Key:           "accounts_20230826.csv",
+		ObjectVersion: data.ObjectVersion{VersionID: "v1", ETag: "abc"},
+		Status:        data.LedgerProcessed,
+	})
+	got = h.handleObject(control)
+	if len(got) != 1 || got[0].Status != statusSkipped {
+		t.Errorf("handleObject() after the object = %+v, want it skipped", got)
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"log"
+	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/joidegn/scalable-capital/data-processor/data"
+	"github.com/joidegn/scalable-capital/data-processor/processor"
 	_ "github.com/lib/pq"
 )
 
@@ -28,11 +31,64 @@ func main() {
 	tableName := "DataProcessorStack-databaseEBDE4557-NO1O8XI3QQDI" // TODO: Get from secrets manager
 	d := data.NewDataManager(s3Client, dbClient, tableName)
 
+	router, err := processor.LoadRouter(os.Getenv("ROUTING_RULES"))
+	if err != nil {
+		log.Fatalf("unable to load routing rules, %v", err)
+	}
+
+	// Transactions with keywords which aren't in the catalogue of transaction types are rejected unless configured
+	// otherwise.
+	validator := data.NewValidator()
+	err = validator.SetUnknownKeywords(os.Getenv("UNKNOWN_KEYWORDS"))
+	if err != nil {
+		log.Fatalf("unable to configure keywords, %v", err)
+	}
+
+	// Identifier validators can be changed per column, e.g. {"account_number": "luhn"}.
+	err = validator.ConfigureIdentifiers(os.Getenv("IDENTIFIER_VALIDATORS"))
+	if err != nil {
+		log.Fatalf("unable to configure identifier validators, %v", err)
+	}
+
+	// Amounts are rounded half-even where they are rounded implicitly, e.g. when converting currencies, unless
+	// configured otherwise.
+	err = data.SetDefaultRounding(os.Getenv("ROUNDING"))
+	if err != nil {
+		log.Fatalf("unable to configure rounding, %v", err)
+	}
+
 	h := handler{
-		d: d,
+		d:      d,
+		p:      processor.NewProcessor(d, validator),
+		router: router,
+		store:  d,
 	}
 
-	lambda.Start(h.handleEvent)
+	// With a cutoff the files of a business date are collected and loaded in dependency order. Files arriving while
+	// their batch is being loaded have to be retried, which only SQS does.
+	if cutoff := os.Getenv("BATCH_CUTOFF"); cutoff != "" {
+		if os.Getenv("EVENT_SOURCE") != "sqs" {
+			log.Fatalf("BATCH_CUTOFF requires EVENT_SOURCE=sqs, files arriving while their batch is loaded would be lost")
+		}
+		duration, err := time.ParseDuration(cutoff)
+		if err != nil {
+			log.Fatalf("invalid batch cutoff, %v", err)
+		}
+		h.batches = processor.NewCoordinator(d, duration)
+	}
+
+	// The lambda is either triggered by S3 directly or by an SQS queue buffering the S3 notifications. Alternatively
+	// the same image runs as an HTTP server accepting file uploads.
+	switch os.Getenv("EVENT_SOURCE") {
+	case "http":
+		server := newServer(h, ":5000")
+		log.Printf("Listening on %s", server.Addr)
+		log.Fatal(server.ListenAndServe())
+	case "sqs":
+		lambda.Start(h.handleSQSEvent)
+	default:
+		lambda.Start(h.handleEvent)
+	}
 }
 
 func NewS3Client() (*s3.Client, error) {
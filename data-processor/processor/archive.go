@@ -0,0 +1,259 @@
+package processor
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxArchiveSize limits the size of a decompressed zip archive, which is buffered in a temporary file to read its
+// entries, protecting against decompression bombs.
+const maxArchiveSize = 2 << 30
+
+// File is a file to be processed, either an object itself or an entry of an archive.
+type File struct {
+	Name string
+	open func() (io.ReadCloser, error)
+}
+
+// Open returns a reader for the decompressed content of the file. Files which are not entries of an archive are
+// streamed and can only be opened once.
+func (f File) Open() (io.ReadCloser, error) {
+	return f.open()
+}
+
+// compression is a compression format detected by file extension or magic number.
+type compression struct {
+	extension string
+	magic     []byte
+	reader    func(io.Reader) (io.ReadCloser, error)
+}
+
+var compressions = []compression{
+	{
+		extension: ".gz",
+		magic:     []byte{0x1f, 0x8b},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		extension: ".bz2",
+		magic:     []byte("BZh"),
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+	{
+		extension: ".zst",
+		magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+}
+
+var zipMagic = []byte("PK\x03\x04")
+
+// IsArchive reports whether the file is an archive whose entries are processed individually.
+func IsArchive(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".zip")
+}
+
+func isWorkbook(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".xlsx")
+}
+
+// DecompressedName strips the compression extension from a file name, e.g. clients_20230826.csv.gz becomes
+// clients_20230826.csv.
+func DecompressedName(name string) string {
+	for _, c := range compressions {
+		if strings.EqualFold(path.Ext(name), c.extension) {
+			return strings.TrimSuffix(name, path.Ext(name))
+		}
+	}
+	return name
+}
+
+// Expand decompresses a gzip, bzip2 or zstd compressed file and expands a zip archive into its entries, which may be
+// compressed themselves. The format is detected by the file's extension or the magic number at its start. Each
+// returned file is named like the compressed file without the compression extension or like the archive entry.
+//
+// Compressed files are decompressed while they are read. Archives are buffered in a temporary file, which is removed
+// by the returned function once the files have been processed.
+func Expand(name string, r io.Reader) ([]File, func(), error) {
+	var e expansion
+	files, err := e.expand(name, r)
+	if err != nil {
+		e.cleanup()
+		return nil, func() {}, err
+	}
+	return files, e.cleanup, nil
+}
+
+// expansion keeps track of the temporary files and decompressors of an expansion.
+type expansion struct {
+	temporary []*os.File
+	closers   []io.Closer
+}
+
+func (e *expansion) expand(name string, r io.Reader) ([]File, error) {
+	decompressed, name, err := decompress(name, io.NopCloser(r))
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, decompressed)
+
+	// XLSX workbooks are zip archives too, but are read as a whole
+	if IsArchive(name) || bytes.HasPrefix(decompressed.peek(), zipMagic) && !isWorkbook(name) {
+		return e.expandZip(name, decompressed)
+	}
+
+	opened := false
+	return []File{{
+		Name: name,
+		open: func() (io.ReadCloser, error) {
+			if opened {
+				return nil, fmt.Errorf("%s has been read already", name)
+			}
+			opened = true
+			return io.NopCloser(decompressed), nil
+		},
+	}}, nil
+}
+
+func (e *expansion) expandZip(name string, r io.Reader) ([]File, error) {
+	buffer, err := os.CreateTemp("", "archive-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't buffer archive %s: %w", name, err)
+	}
+	e.temporary = append(e.temporary, buffer)
+	size, err := io.Copy(buffer, io.LimitReader(r, maxArchiveSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't buffer archive %s: %w", name, err)
+	}
+	if size > maxArchiveSize {
+		return nil, fmt.Errorf("archive %s exceeds %d bytes", name, maxArchiveSize)
+	}
+
+	archive, err := zip.NewReader(buffer, size)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open archive %s: %w", name, err)
+	}
+
+	var files []File
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		if IsArchive(DecompressedName(entry.Name)) {
+			expanded, err := e.expandEntry(name, entry)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, expanded...)
+			continue
+		}
+
+		entry := entry
+		files = append(files, File{
+			Name: DecompressedName(entry.Name),
+			open: func() (io.ReadCloser, error) {
+				reader, err := entry.Open()
+				if err != nil {
+					return nil, fmt.Errorf("couldn't open %s in archive %s: %w", entry.Name, name, err)
+				}
+				decompressed, _, err := decompress(entry.Name, reader)
+				return decompressed, err
+			},
+		})
+	}
+	return files, nil
+}
+
+// expandEntry expands an archive nested in an archive.
+func (e *expansion) expandEntry(name string, entry *zip.File) ([]File, error) {
+	reader, err := entry.Open()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open %s in archive %s: %w", entry.Name, name, err)
+	}
+	defer reader.Close()
+	return e.expand(entry.Name, reader)
+}
+
+func (e *expansion) cleanup() {
+	for _, closer := range e.closers {
+		closer.Close()
+	}
+	for _, file := range e.temporary {
+		file.Close()
+		os.Remove(file.Name())
+	}
+}
+
+// decompress wraps a reader with the decompressors of the file's compression formats and returns it with the name of
+// the decompressed file. Closing the returned reader closes the decompressors and the underlying reader.
+func decompress(name string, r io.ReadCloser) (*chainedReader, string, error) {
+	decompressed := &chainedReader{buffered: bufio.NewReader(r), closers: []io.Closer{r}}
+	for {
+		c, ok := detectCompression(name, decompressed.peek())
+		if !ok {
+			return decompressed, name, nil
+		}
+		reader, err := c.reader(decompressed.buffered)
+		if err != nil {
+			decompressed.Close()
+			return nil, name, fmt.Errorf("couldn't decompress %s: %w", name, err)
+		}
+		decompressed.buffered = bufio.NewReader(reader)
+		decompressed.closers = append(decompressed.closers, reader)
+		name = DecompressedName(name)
+	}
+}
+
+func detectCompression(name string, start []byte) (compression, bool) {
+	for _, c := range compressions {
+		if strings.EqualFold(path.Ext(name), c.extension) || bytes.HasPrefix(start, c.magic) {
+			return c, true
+		}
+	}
+	return compression{}, false
+}
+
+// chainedReader reads from the last of a chain of decompressors and closes all of them.
+type chainedReader struct {
+	buffered *bufio.Reader
+	closers  []io.Closer
+}
+
+func (c *chainedReader) Read(p []byte) (int, error) {
+	return c.buffered.Read(p)
+}
+
+// peek returns the first bytes of the content without consuming them.
+func (c *chainedReader) peek() []byte {
+	start, _ := c.buffered.Peek(len(zipMagic))
+	return start
+}
+
+func (c *chainedReader) Close() error {
+	var errs []error
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		errs = append(errs, c.closers[i].Close())
+	}
+	return errors.Join(errs...)
+}
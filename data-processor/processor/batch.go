@@ -0,0 +1,203 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+)
+
+// BatchOrder is the order in which the files of a business date are loaded. Every file type depends on the ones
+// before it, e.g. portfolios reference clients and transactions reference accounts.
+var BatchOrder = []string{"clients", "portfolios", "accounts", "transactions"}
+
+// OptionalBatchFiles are file types which are loaded with the batch of their business date if they have arrived, after
+// the files in BatchOrder, but which the batch doesn't wait for. FX rates are only needed to report figures.
+var OptionalBatchFiles = []string{"fxrates"}
+
+// DefaultBatchLease is how long a processor may take to load a batch before another one takes it over. It exceeds the
+// timeout of the lambda function, but has to expire well before SQS gives up redelivering a file which arrived while
+// the batch was being loaded, see ErrBatchProcessing: deploy.go redelivers messages 5 times, every 3 minutes.
+const DefaultBatchLease = 5 * time.Minute
+
+// ErrBatchProcessing is returned for files arriving while their batch is being loaded. The file has been added to the
+// batch, the caller has to retry, e.g. by having SQS redeliver the message, to load it once the batch has been loaded.
+// Batches therefore need an event source which retries.
+var ErrBatchProcessing = errors.New("batch is being processed")
+
+// Release is a set of files of a batch which are ready to be loaded, in load order.
+type Release struct {
+	BusinessDate string
+	Files        []data.BatchFile
+	Missing      []string // file types which had not arrived when the batch was released
+
+	// claimed is set if the release loads the batch for the first time, which has to be finished afterwards.
+	claimed bool
+}
+
+// Coordinator collects the files of a business date and releases them in BatchOrder once all of them have arrived,
+// or once the cutoff has passed since the first file arrived.
+type Coordinator struct {
+	store  data.Store
+	cutoff time.Duration
+	lease  time.Duration
+	now    func() time.Time
+}
+
+// Arrive registers a file with the batch of its business date. It returns nil while the batch is waiting for files.
+// Once the batch is complete, all of its files are released. Files arriving while the batch is being loaded return
+// ErrBatchProcessing, unless the lease of the processor loading it has expired, which releases the batch again. Files
+// arriving after the batch has been loaded release the whole batch again, files which have been processed already are
+// then skipped thanks to the ledger.
+func (c *Coordinator) Arrive(businessDate string, file data.BatchFile) (*Release, error) {
+	file.ArrivedAt = c.now().UTC()
+	batch, err := c.store.AddBatchFile(businessDate, file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch batch.Status {
+	case data.BatchOpen:
+		missing := missingFiles(*batch)
+		if len(missing) > 0 {
+			log.Printf("Batch %s is waiting for %v", businessDate, missing)
+			return nil, nil
+		}
+		claimed, err := c.claim(businessDate)
+		if err != nil || !claimed {
+			return nil, err
+		}
+		return &Release{BusinessDate: businessDate, Files: orderedFiles(*batch), claimed: true}, nil
+	case data.BatchProcessing:
+		claimed, err := c.claim(businessDate)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			log.Printf("Batch %s is being processed", businessDate)
+			return nil, fmt.Errorf("%w: %s", ErrBatchProcessing, businessDate)
+		}
+		log.Printf("Lease on batch %s expired, taking it over", businessDate)
+		return &Release{BusinessDate: businessDate, Files: orderedFiles(*batch), Missing: missingFiles(*batch), claimed: true}, nil
+	}
+	return &Release{BusinessDate: businessDate, Files: orderedFiles(*batch), Missing: missingFiles(*batch)}, nil
+}
+
+// Due claims the open batches whose cutoff has passed and the batches whose lease has expired before they were loaded,
+// and releases whatever files they have.
+func (c *Coordinator) Due() ([]Release, error) {
+	batches, err := c.store.PendingBatches()
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []Release
+	for _, batch := range batches {
+		switch batch.Status {
+		case data.BatchOpen:
+			if c.now().Sub(batch.OpenedAt) < c.cutoff {
+				continue
+			}
+		case data.BatchProcessing:
+			if !batch.LeaseUntil.Before(c.now()) {
+				continue
+			}
+		}
+		claimed, err := c.claim(batch.BusinessDate)
+		if err != nil {
+			return releases, err
+		}
+		if !claimed {
+			continue
+		}
+		releases = append(releases, Release{
+			BusinessDate: batch.BusinessDate,
+			Files:        orderedFiles(batch),
+			Missing:      missingFiles(batch),
+			claimed:      true,
+		})
+	}
+	return releases, nil
+}
+
+// claim claims a batch for the duration of the lease.
+func (c *Coordinator) claim(businessDate string) (bool, error) {
+	now := c.now().UTC()
+	return c.store.ClaimBatch(businessDate, now, now.Add(c.lease))
+}
+
+// Finish marks a batch as loaded after its release has been processed.
+func (c *Coordinator) Finish(release Release) error {
+	if !release.claimed {
+		return nil
+	}
+	status := data.BatchProcessed
+	if len(release.Missing) > 0 {
+		status = data.BatchIncomplete
+	}
+	_, err := c.store.SetBatchStatus(release.BusinessDate, data.BatchProcessing, status)
+	return err
+}
+
+// Reopen opens a batch again after its release has been processed with some of its files deferred, e.g. because their
+// control file hadn't been uploaded yet, so that the batch is released again once they arrive or at the next sweep.
+func (c *Coordinator) Reopen(release Release) error {
+	if !release.claimed {
+		return nil
+	}
+	_, err := c.store.SetBatchStatus(release.BusinessDate, data.BatchProcessing, data.BatchOpen)
+	return err
+}
+
+// SortByLoadOrder returns the indices of the routes sorted by the load order of their file types. Routes of the same
+// file type keep their order.
+func SortByLoadOrder(routes []Route) []int {
+	order := make([]int, len(routes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return loadOrder(routes[order[i]].FileType) < loadOrder(routes[order[j]].FileType)
+	})
+	return order
+}
+
+func loadOrder(fileType string) int {
+	for i, t := range BatchOrder {
+		if t == fileType {
+			return i
+		}
+	}
+	return len(BatchOrder)
+}
+
+// orderedFiles returns the files of a batch in load order, files of the same type in the order they arrived.
+func orderedFiles(batch data.Batch) []data.BatchFile {
+	var files []data.BatchFile
+	for _, fileType := range append(BatchOrder[:len(BatchOrder):len(BatchOrder)], OptionalBatchFiles...) {
+		files = append(files, batch.Files[fileType]...)
+	}
+	return files
+}
+
+func missingFiles(batch data.Batch) []string {
+	var missing []string
+	for _, fileType := range BatchOrder {
+		if len(batch.Files[fileType]) == 0 {
+			missing = append(missing, fileType)
+		}
+	}
+	return missing
+}
+
+func NewCoordinator(store data.Store, cutoff time.Duration) *Coordinator {
+	return &Coordinator{
+		store:  store,
+		cutoff: cutoff,
+		lease:  DefaultBatchLease,
+		now:    time.Now,
+	}
+}
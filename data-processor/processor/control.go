@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+)
+
+// Control totals a routing rule can require of its files. Files without them, or not matching them, are rejected as a
+// whole before any record is stored.
+const (
+	// ControlsTrailer requires a trailer row at the end of the file, see data.TrailerMarker.
+	ControlsTrailer = "trailer"
+	// ControlsSidecar requires a control file shipped next to the file, see ControlFileName and data.ParseControlFile.
+	ControlsSidecar = "sidecar"
+)
+
+// ControlSuffix is appended to the name of a file to name its control file. Control files are not processed
+// themselves.
+const ControlSuffix = ".ctl"
+
+// ControlFileName returns the name of the control file of a file.
+func ControlFileName(name string) string {
+	return name + ControlSuffix
+}
+
+// IsControlFile reports whether a file is the control file of another file.
+func IsControlFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ControlSuffix)
+}
+
+func validateControls(controls string, format string) error {
+	switch controls {
+	case "":
+		return nil
+	case ControlsTrailer, ControlsSidecar:
+		if format != "" && format != FormatCSV {
+			return fmt.Errorf("control totals are only supported for CSV files, not %s", format)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown control totals %q, must be %s or %s", controls, ControlsTrailer, ControlsSidecar)
+}
+
+// verifyControls reads a file once to verify the control totals required by its route, before it is read again to be
+// stored. The file is buffered in a temporary file, which is returned to be read from the start and has to be
+// removed by the caller. A file failing the control totals is reported with a *data.ControlError.
+func verifyControls(route Route, r io.Reader) (*os.File, error) {
+	err := validateControls(route.Controls, route.Format)
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := os.CreateTemp("", "controls-*")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't buffer file: %w", err)
+	}
+	_, err = io.Copy(buffer, r)
+	if err == nil {
+		_, err = buffer.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return buffer, fmt.Errorf("couldn't buffer file: %w", err)
+	}
+
+	read, trailer, err := data.ReadControls(buffer, route.FileType, route.CSV)
+	if err != nil {
+		return buffer, err
+	}
+	switch route.Controls {
+	case ControlsTrailer:
+		err = data.VerifyControls("trailer", trailer, read)
+	case ControlsSidecar:
+		err = data.VerifyControls("control file", route.ControlTotals, read)
+	}
+	if err != nil {
+		return buffer, err
+	}
+	log.Printf("Verified the control totals of %s: %s", route.Key, read)
+
+	_, err = buffer.Seek(0, io.SeekStart)
+	return buffer, err
+}
+
+// SidecarControls returns the control totals of a file read from its control file among the files expanded with it,
+// e.g. the entries of the same archive, or nil if there is none.
+func SidecarControls(files []File, name string) (*data.ControlTotals, error) {
+	for _, file := range files {
+		if file.Name != ControlFileName(name) {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return data.ParseControlFile(r)
+	}
+	return nil, nil
+}
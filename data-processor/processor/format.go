@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// Input formats
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl" // JSON Lines, one object per line
+	FormatJSON    = "json"  // an array of objects
+	FormatParquet = "parquet"
+	FormatXLSX    = "xlsx" // the first or a named sheet of an Excel workbook
+	// FormatFixedWidth is laid out as in data.Layouts or as in the layout of a routing rule. It has no extension of its
+	// own and is set by routing rules.
+	FormatFixedWidth = "fixed_width"
+)
+
+// KnownFormat reports whether files in the format can be processed. The empty format is CSV.
+func KnownFormat(format string) bool {
+	switch format {
+	case "", FormatCSV, FormatJSONL, FormatJSON, FormatParquet, FormatXLSX, FormatFixedWidth:
+		return true
+	}
+	return false
+}
+
+// DetectFormat determines the format of a file from its extension or, if the extension is unknown, its content type.
+// Files in an unknown format are taken to be CSV.
+func DetectFormat(name string, contentType string) string {
+	switch strings.ToLower(path.Ext(DecompressedName(name))) {
+	case ".csv":
+		return FormatCSV
+	case ".jsonl", ".ndjson":
+		return FormatJSONL
+	case ".json":
+		return FormatJSON
+	case ".parquet", ".parq":
+		return FormatParquet
+	case ".xlsx":
+		return FormatXLSX
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/jsonl", "application/x-jsonlines", "application/x-ndjson", "application/ndjson":
+		return FormatJSONL
+	case "application/json":
+		return FormatJSON
+	case "application/vnd.apache.parquet", "application/x-parquet":
+		return FormatParquet
+	case "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
+		return FormatXLSX
+	}
+	return FormatCSV
+}
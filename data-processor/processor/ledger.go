@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+)
+
+// ChecksumReader computes the hex encoded SHA-256 checksum of a file, as recorded in the ledger, while it is read.
+type ChecksumReader struct {
+	r    io.Reader
+	hash hash.Hash
+}
+
+func NewChecksumReader(r io.Reader) *ChecksumReader {
+	c := &ChecksumReader{hash: sha256.New()}
+	c.r = io.TeeReader(r, c.hash)
+	return c
+}
+
+func (c *ChecksumReader) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Sum reads whatever is left of the file and returns its checksum.
+func (c *ChecksumReader) Sum() (string, error) {
+	_, err := io.Copy(io.Discard, c.r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(c.hash.Sum(nil)), nil
+}
+
+// Duplicate reports whether the ledger shows this version of the file as processed already. S3 notifications are
+// delivered at least once, so processing duplicates is skipped.
+func (p *Processor) Duplicate(bucket string, key string, version data.ObjectVersion) (bool, error) {
+	entry, err := p.store.GetLedgerEntry(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	return entry != nil && entry.Status == data.LedgerProcessed && entry.Matches(version), nil
+}
+
+// Record stores the outcome of processing a version of a file in the ledger.
+func (p *Processor) Record(bucket string, key string, version data.ObjectVersion, status string) error {
+	log.Printf("Recording %s as %s in the ledger", key, status)
+	return p.store.PutLedgerEntry(data.LedgerEntry{
+		Bucket:        bucket,
+		Key:           key,
+		ObjectVersion: version,
+		Status:        status,
+		UpdatedAt:     p.now().UTC(),
+	})
+}
@@ -0,0 +1,115 @@
+package processor
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+)
+
+// QuarantinePrefix is the dead-letter prefix the rows skipped under the quarantine and threshold error policies are
+// written to. Objects with this prefix are not processed.
+const QuarantinePrefix = "quarantine/"
+
+// Error policy modes
+const (
+	// FailFast fails a file with invalid rows. Nothing of the file is kept.
+	FailFast = "fail_fast"
+	// Quarantine stores the valid rows of a file and quarantines the invalid ones.
+	Quarantine = "quarantine"
+	// Threshold quarantines invalid rows like Quarantine, but fails the file if more than MaxInvalidPercent of its
+	// rows are invalid.
+	Threshold = "threshold"
+)
+
+// ErrorPolicy decides what happens to a file with invalid rows. The zero value fails fast.
+type ErrorPolicy struct {
+	Mode              string  `json:"mode,omitempty"`
+	MaxInvalidPercent float64 `json:"max_invalid_percent,omitempty"`
+}
+
+func (policy ErrorPolicy) validate() error {
+	switch policy.Mode {
+	case "", FailFast, Quarantine:
+		return nil
+	case Threshold:
+		if policy.MaxInvalidPercent < 0 || policy.MaxInvalidPercent > 100 {
+			return fmt.Errorf("max_invalid_percent must be between 0 and 100")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown error policy %q", policy.Mode)
+}
+
+// skips reports whether invalid rows are skipped rather than failing the file.
+func (policy ErrorPolicy) skips() bool {
+	return policy.Mode == Quarantine || policy.Mode == Threshold
+}
+
+// exceeded reports whether a file with the given counts fails under the policy.
+func (policy ErrorPolicy) exceeded(counts Counts) bool {
+	switch policy.Mode {
+	case Quarantine:
+		return false
+	case Threshold:
+		return float64(counts.Invalid) > policy.MaxInvalidPercent/100*float64(counts.Parsed)
+	}
+	return counts.Invalid > 0
+}
+
+// QuarantineFile writes the rows skipped under the quarantine and threshold error policies as CSV. The header has the
+// canonical column names of the file type followed by data.ReasonColumn, so that the rows can be fixed and submitted
+// again as they are. The errors of the rows are kept as well.
+type QuarantineFile struct {
+	w      *csv.Writer
+	header []string
+	// written is set once the header has been written, which may be empty for rows which didn't get as far as the
+	// header of their file.
+	written bool
+	Rows    int
+	Errors  []data.FieldError
+}
+
+func NewQuarantineFile(w io.Writer) *QuarantineFile {
+	return &QuarantineFile{w: csv.NewWriter(w)}
+}
+
+func (q *QuarantineFile) add(rowErr *data.RowError) error {
+	if !q.written {
+		q.header, q.written = rowErr.Header, true
+		err := q.w.Write(append(append([]string{}, q.header...), data.ReasonColumn))
+		if err != nil {
+			return err
+		}
+	}
+	q.Rows++
+	q.Errors = append(q.Errors, rowErr.Errors...)
+	record := append([]string{}, rowErr.Record...)
+	for len(record) < len(q.header) {
+		record = append(record, "")
+	}
+	return q.w.Write(append(record, rowErr.Error()))
+}
+
+// Flush writes any buffered rows.
+func (q *QuarantineFile) Flush() error {
+	q.w.Flush()
+	return q.w.Error()
+}
+
+// QuarantineKey returns the key the quarantined rows of an object, or of an entry of an archive, are written to. The
+// rows are written as uncompressed CSV, so the key is given a .csv extension instead of any other.
+func QuarantineKey(key string, entry string) string {
+	quarantineKey := QuarantinePrefix + key
+	if entry != "" {
+		quarantineKey += "/" + entry
+	}
+	quarantineKey = DecompressedName(quarantineKey)
+	if !strings.EqualFold(path.Ext(quarantineKey), ".csv") {
+		quarantineKey += ".csv"
+	}
+	return quarantineKey
+}
@@ -0,0 +1,307 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+)
+
+// Processor parses input files and persists their records in a store.
+type Processor struct {
+	store     data.Store
+	validator *data.Validator
+	now       func() time.Time
+}
+
+// chunkSize is the number of records read ahead of the store.
+const chunkSize = 500
+
+// Counts holds the number of rows parsed from a file, how many of them got stored and how many were invalid.
+type Counts struct {
+	Parsed   int
+	Inserted int
+	Invalid  int
+}
+
+// KnownFileType reports whether there is a processor for the file type.
+func KnownFileType(fileType string) bool {
+	switch fileType {
+	case "clients", "portfolios", "accounts", "transactions", "fxrates":
+		return true
+	}
+	return false
+}
+
+// ProcessFile parses a file routed to one of the processors and stores its records. Every record is stamped with the
+// business date taken from the route, the key of the file and the time it was loaded. The file is read as a stream in
+// the format of the route, CSV by default.
+// Invalid rows are handled according to the error policy of the route: skipped rows are written to quarantine, which
+// may be nil to discard them, and a file failing the policy is reported with a *ValidationError after the records
+// stored by this load of the file have been retracted again. Earlier loads of the file and other entries of the same
+// archive are left alone.
+// Files whose route requires control totals are verified against them before any record is stored. A trailer row is
+// verified even if the route doesn't require it, but only once the file has been read, so the records stored from a
+// file failing it are retracted again. Either way a file failing its control totals is reported with a
+// *data.ControlError.
+func (p *Processor) ProcessFile(route Route, r io.Reader, quarantine *QuarantineFile) (Counts, error) {
+	log.Printf("Route: %+v", route)
+	businessDate, err := data.ParseBusinessDate(route.Params["business_date"])
+	if err != nil {
+		return Counts{}, err
+	}
+	if !KnownFormat(route.Format) {
+		return Counts{}, fmt.Errorf("unknown format %q", route.Format)
+	}
+	if route.Controls != "" {
+		buffer, err := verifyControls(route, r)
+		if buffer != nil {
+			defer os.Remove(buffer.Name())
+			defer buffer.Close()
+		}
+		if err != nil {
+			return Counts{}, err
+		}
+		r = buffer
+	}
+	load := data.Load{ObjectKey: route.Key, SourceKey: data.EntryKey(route.Key, route.Entry), LoadedAt: p.now().UTC()}
+	err = p.store.BeginLoad(load)
+	if err != nil {
+		return Counts{}, err
+	}
+	defer p.store.FinishLoad(load)
+	suggester := newSuggester(p.store)
+	in := input{
+		r:       r,
+		format:  route.Format,
+		sheet:   route.Sheet,
+		dialect: route.CSV,
+		layout:  route.Layout,
+		provenance: data.Provenance{
+			BusinessDate: businessDate,
+			SourceKey:    load.SourceKey,
+			LoadedAt:     load.LoadedAt,
+		},
+		policy:     route.ErrorPolicy,
+		quarantine: quarantine,
+		validator:  p.validator.WithKnownReferences(suggester.references),
+		suggester:  suggester,
+	}
+
+	var counts Counts
+	switch route.FileType {
+	case "clients":
+		log.Printf("Processing clients file")
+		counts, err = p.processClientFile(in)
+	case "portfolios":
+		log.Printf("Processing portfolios file")
+		counts, err = p.processPortfolioFile(in)
+	case "accounts":
+		log.Printf("Processing accounts file")
+		counts, err = p.processAccountsFile(in)
+	case "transactions":
+		log.Printf("Processing transactions file")
+		counts, err = p.processTransactionsFile(in)
+	case "fxrates":
+		log.Printf("Processing FX rates file")
+		counts, err = p.processFXRatesFile(in)
+	default:
+		log.Printf("Unknown file type")
+		err = fmt.Errorf("unknown file type")
+	}
+
+	var validationErr *ValidationError
+	var controlErr *data.ControlError
+	if errors.As(err, &validationErr) {
+		validationErr.FileType = route.FileType
+	}
+	if (validationErr != nil || errors.As(err, &controlErr)) && counts.Inserted > 0 {
+		retracted, retractErr := p.store.RetractLoad(load)
+		if retractErr != nil {
+			log.Printf("Error retracting the records of failed file %s: %s", load.SourceKey, retractErr)
+			return counts, retractErr
+		}
+		log.Printf("Retracted %d records of failed file %s", retracted, load.SourceKey)
+		counts.Inserted = 0
+	}
+	return counts, err
+}
+
+// RetractFile withdraws everything that was loaded from the object with the given key, including the entries of an
+// archive, e.g. because it was deleted.
+func (p *Processor) RetractFile(bucket string, key string) (int, error) {
+	log.Printf("Retracting records loaded from %s", key)
+	retracted, err := p.store.RetractSource(key)
+	if err != nil {
+		return retracted, err
+	}
+	return retracted, p.Record(bucket, key, data.ObjectVersion{}, data.LedgerRetracted)
+}
+
+func (p *Processor) processClientFile(in input) (Counts, error) {
+	counts, err := load(openRows[data.Client](in, "clients"), in, p.store.InsertClient)
+	if err != nil {
+		log.Printf("Error processing clients file: %s", err)
+	}
+	return counts, err
+}
+
+func (p *Processor) processPortfolioFile(in input) (Counts, error) {
+	counts, err := load(openRows[data.Portfolio](in, "portfolios"), in, p.store.InsertPortfolio)
+	if err != nil {
+		log.Printf("Error processing portfolios file: %s", err)
+	}
+	return counts, err
+}
+
+func (p *Processor) processAccountsFile(in input) (Counts, error) {
+	counts, err := load(openRows[data.Account](in, "accounts"), in, p.store.InsertAccount)
+	if err != nil {
+		log.Printf("Error processing accounts file: %s", err)
+	}
+	return counts, err
+}
+
+func (p *Processor) processTransactionsFile(in input) (Counts, error) {
+	counts, err := load(openRows[data.Transaction](in, "transactions"), in, p.store.InsertTransaction)
+	if err != nil {
+		log.Printf("Error processing transactions file: %s", err)
+	}
+	return counts, err
+}
+
+func (p *Processor) processFXRatesFile(in input) (Counts, error) {
+	counts, err := load(openRows[data.FXRate](in, "fxrates"), in, p.store.InsertFXRate)
+	if err != nil {
+		log.Printf("Error processing FX rates file: %s", err)
+	}
+	return counts, err
+}
+
+// input is a file being processed.
+type input struct {
+	r          io.Reader
+	format     string
+	sheet      string
+	dialect    data.Dialect
+	layout     []data.Field
+	provenance data.Provenance
+	policy     ErrorPolicy
+	quarantine *QuarantineFile
+	validator  *data.Validator
+	suggester  *suggester
+}
+
+// openRows returns the records of a file in its format.
+func openRows[T any](in input, fileType string) data.Rows[T] {
+	switch in.format {
+	case FormatJSONL:
+		return data.NewJSONLRows[T](in.r, fileType, in.validator)
+	case FormatJSON:
+		return data.NewJSONRows[T](in.r, fileType, in.validator)
+	case FormatParquet:
+		return data.NewParquetRows[T](in.r, fileType, in.validator)
+	case FormatXLSX:
+		return data.NewXLSXRows[T](in.r, fileType, in.sheet, in.validator)
+	case FormatFixedWidth:
+		return data.NewFixedWidthRows[T](in.r, fileType, in.layout, in.dialect.Encoding, in.validator)
+	}
+	return data.NewCSVRows[T](in.r, fileType, in.dialect, in.validator)
+}
+
+// record is a pointer to a record type which can be stamped with its provenance.
+type record[T any] interface {
+	*T
+	Stamp(file data.Provenance) error
+}
+
+// load reads the records of a file, stamps them and inserts them into the store in chunks of chunkSize, so that only
+// one chunk is held in memory no matter how large the file is. Every row is validated. Invalid rows are skipped and
+// quarantined if the error policy allows it, otherwise no more records are stored once an invalid row has been found.
+// Either way the whole file is validated, so that a file failing the policy reports all invalid rows in a
+// *ValidationError. Invalid identifiers are reported with the known identifier they are most likely a typo of. Chunks
+// read before an error have been stored already. Rows holding resources are closed.
+func load[T any, R record[T]](rows data.Rows[T], in input, insert func(T) error) (Counts, error) {
+	if closer, ok := rows.(io.Closer); ok {
+		defer closer.Close()
+	}
+	var counts Counts
+	report := &ValidationError{File: in.provenance.SourceKey}
+	chunk := make([]T, 0, chunkSize)
+	flush := func() error {
+		for _, record := range chunk {
+			err := insert(record)
+			if err != nil {
+				return err
+			}
+			counts.Inserted++
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+
+	for {
+		record, err := rows.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *data.RowError
+		if errors.As(err, &rowErr) {
+			counts.Parsed++
+			counts.Invalid++
+			if in.suggester != nil {
+				in.suggester.suggest(rowErr)
+			}
+			report.add(rowErr)
+			if in.policy.skips() && in.quarantine != nil {
+				err = in.quarantine.add(rowErr)
+				if err != nil {
+					return counts, err
+				}
+			}
+			continue
+		}
+		var controlErr *data.ControlError
+		if errors.As(err, &controlErr) {
+			return counts, err
+		}
+		if err != nil {
+			return counts, fmt.Errorf("row %d: %w", counts.Parsed+1, err)
+		}
+		counts.Parsed++
+		if counts.Invalid > 0 && !in.policy.skips() {
+			continue
+		}
+
+		err = R(&record).Stamp(in.provenance)
+		if err != nil {
+			return counts, fmt.Errorf("row %d: %w", counts.Parsed, err)
+		}
+		chunk = append(chunk, record)
+		if len(chunk) == chunkSize {
+			err = flush()
+			if err != nil {
+				return counts, err
+			}
+		}
+	}
+
+	if in.policy.exceeded(counts) {
+		return counts, report
+	}
+	return counts, flush()
+}
+
+// NewProcessor returns a processor storing records in the store. Rows are validated by the validator or, if it is
+// nil, by data.NewValidator.
+func NewProcessor(store data.Store, validator *data.Validator) *Processor {
+	return &Processor{
+		store:     store,
+		validator: validator,
+		now:       time.Now,
+	}
+}
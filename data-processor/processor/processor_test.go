@@ -0,0 +1,1229 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestProcessFile(t *testing.T) {
+	// The first portfolio has malformed references, the client reference is a typo of the reference of Frida Müller.
+	var tests = []struct {
+		file    string
+		want    Counts
+		wantErr []data.FieldError
+	}{
+		{file: "clients_20230826.csv", want: Counts{Parsed: 2, Inserted: 2}},
+		{
+			file: "portfolios_20230826.csv",
+			want: Counts{Parsed: 2, Invalid: 1},
+			wantErr: []data.FieldError{
+				{Line: 2, Column: "portfolio_reference", Value: "90755e32-7438-4354-ad37-ad900e29-7844", Rule: data.RuleIdentifier, Message: "must be a UUID, it has 37 characters instead of 36"},
+				{Line: 2, Column: "client_reference", Value: "9e40659b-8b9f-4fc4-814b-5a7b-5a23b64d", Rule: data.RuleIdentifier, Message: "must be a UUID, it has 37 characters instead of 36", Suggestion: "9e40659b-8b9f-4fc4-814b-5a7b5a23b64d"},
+			},
+		},
+		{file: "accounts_20230826.csv", want: Counts{Parsed: 2, Inserted: 2}},
+		{file: "transactions_20230826.csv", want: Counts{Parsed: 1, Inserted: 1}},
+	}
+
+	router, err := NewRouter(DefaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+	loadedAt := time.Date(2023, 8, 27, 6, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return loadedAt }
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			fileContent, err := os.ReadFile(filepath.Join("..", "data", "testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			route, err := router.Route("test-bucket", "incoming/"+tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if route.Params["business_date"] != "20230826" {
+				t.Errorf("Route() params = %v, want business_date 20230826", route.Params)
+			}
+			got, err := p.ProcessFile(route, bytes.NewReader(fileContent), nil)
+			var report *ValidationError
+			if errors.As(err, &report) {
+				if !reflect.DeepEqual(report.Errors, tt.wantErr) {
+					t.Errorf("ProcessFile() errors = %+v, want %+v", report.Errors, tt.wantErr)
+				}
+			} else if err != nil || tt.wantErr != nil {
+				t.Errorf("ProcessFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ProcessFile() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	want := data.Provenance{
+		BusinessDate: "2023-08-26",
+		SourceKey:    "incoming/clients_20230826.csv",
+		LoadedAt:     loadedAt,
+	}
+	if got := store.Clients["f4a0cc2c-d0b4-4f14-b202-c8a5e45e90e7"].Provenance; got != want {
+		t.Errorf("client provenance = %+v, want %+v", got, want)
+	}
+	// The testdata spells the account number column accout_number, which is an alias of account_number.
+	if _, ok := store.Accounts["12345678"]; !ok {
+		t.Errorf("accounts = %v, want account 12345678", store.Accounts)
+	}
+}
+
+func TestProcessFileFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    Counts
+		wantErr []data.FieldError
+	}{
+		{
+			name:   "json lines",
+			format: DetectFormat("accounts_20230826.jsonl", ""),
+			content: `{"record_id": 1, "accout_number": 12345678, "cash_balance": 15000.00, "currency": "EUR", "taxes_paid": 0}
+
+{"record_id": 2, "account_number": "12345679", "cash_balance": -56.00, "currency": "EUR", "taxes_paid": 789.56, "business_date": null}
+`,
+			want: Counts{Parsed: 2, Inserted: 2},
+		},
+		{
+			name:   "json array",
+			format: DetectFormat("accounts_20230826", "application/json; charset=utf-8"),
+			content: `[
+				{"record_id": 1, "accout_number": 12345678, "cash_balance": 15000.00, "currency": "EUR", "taxes_paid": 0},
+				{"record_id": 2, "account_number": 12345679, "cash_balance": -56.00, "currency": "EUR", "taxes_paid": 789.56}
+			]`,
+			want: Counts{Parsed: 2, Inserted: 2},
+		},
+		{
+			name:   "invalid json lines",
+			format: FormatJSONL,
+			content: `{"record_id": 1, "account_number": 12345678, "cash_balance": 1, "currency": "EUR", "taxes_paid": 0, "iban": "DE00"}
+not json
+{"record_id": 3, "account_number": [1], "cash_balance": 1, "currency": "EUR", "taxes_paid": 0}
+`,
+			want: Counts{Parsed: 3, Invalid: 3},
+			wantErr: []data.FieldError{
+				{Line: 1, Column: "iban", Value: `"DE00"`, Rule: data.RuleColumns, Message: "is not a column of the schema"},
+				{Line: 2, Value: "not json", Rule: data.RuleFormat, Message: "is not a JSON object"},
+				{Line: 3, Column: "account_number", Value: "[1]", Rule: data.RuleType, Message: "must be a string, number or boolean"},
+			},
+		},
+		{
+			name:    "invalid json array",
+			format:  FormatJSON,
+			content: `[{"record_id": 1, "account_number": 12345678, "cash_balance": 1, "currency": "EUR", "taxes_paid": "none"}, 2]`,
+			want:    Counts{Parsed: 2, Invalid: 2},
+			wantErr: []data.FieldError{
+				{Line: 1, Column: "taxes_paid", Value: "none", Rule: data.RuleType, Message: "must be a number"},
+				{Line: 2, Rule: data.RuleFormat, Message: "is not a JSON object"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := data.NewMemoryStore()
+			p := NewProcessor(store, nil)
+			route := Route{Key: "accounts_20230826", FileType: "accounts", Format: tt.format}
+			got, err := p.ProcessFile(route, strings.NewReader(tt.content), nil)
+			if got != tt.want {
+				t.Errorf("ProcessFile() = %+v, want %+v", got, tt.want)
+			}
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("ProcessFile() error = %v", err)
+				}
+				if _, ok := store.Accounts["12345679"]; !ok {
+					t.Errorf("accounts = %v, want account 12345679", store.Accounts)
+				}
+				return
+			}
+			var report *ValidationError
+			if !errors.As(err, &report) {
+				t.Fatalf("ProcessFile() error = %v, want a validation error", err)
+			}
+			if !reflect.DeepEqual(report.Errors, tt.wantErr) {
+				t.Errorf("ProcessFile() errors = %+v, want %+v", report.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessFileParquet(t *testing.T) {
+	type account struct {
+		RecordID      int64  `parquet:"record_id"`
+		AccountNumber int64  `parquet:"accout_number"`
+		CashBalance   int64  `parquet:"cash_balance,decimal(2:18)"`
+		Currency      string `parquet:"currency"`
+		TaxesPaid     string `parquet:"taxes_paid"`
+		BusinessDate  int32  `parquet:"business_date,date"`
+	}
+	businessDate := int32(time.Date(2023, 8, 26, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+	var buffer bytes.Buffer
+	writer := parquet.NewGenericWriter[account](&buffer, parquet.MaxRowsPerRowGroup(2))
+	_, err := writer.Write([]account{
+		{RecordID: 1, AccountNumber: 12345678, CashBalance: 1500000, Currency: "EUR", TaxesPaid: "0", BusinessDate: businessDate},
+		{RecordID: 2, AccountNumber: 12345679, CashBalance: -5600, Currency: "EUR", TaxesPaid: "789.56", BusinessDate: businessDate},
+		{RecordID: 3, AccountNumber: 12345680, CashBalance: 5, Currency: "EUR", TaxesPaid: "-1", BusinessDate: businessDate},
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+	route := Route{
+		Key:         "accounts_20230826.parquet",
+		FileType:    "accounts",
+		Format:      DetectFormat("accounts_20230826.parquet", ""),
+		ErrorPolicy: ErrorPolicy{Mode: Quarantine},
+	}
+	// hide bytes.Reader's ReaderAt so that the file is buffered like a download
+	got, err := p.ProcessFile(route, struct{ io.Reader }{bytes.NewReader(buffer.Bytes())}, nil)
+	if err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if want := (Counts{Parsed: 3, Inserted: 2, Invalid: 1}); got != want {
+		t.Errorf("ProcessFile() = %+v, want %+v", got, want)
+	}
+	stored, ok := store.Accounts["12345679"]
+	if !ok {
+		t.Fatalf("accounts = %v, want account 12345679", store.Accounts)
+	}
+	if stored.CashBalance.String() != "-56.00 EUR" || stored.TaxesPaid.String() != "789.56 EUR" || stored.BusinessDate != "2023-08-26" {
+		t.Errorf("account = %+v, want cash balance -56.00 EUR, taxes paid 789.56 EUR and business date 2023-08-26", stored)
+	}
+}
+
+func TestProcessFileXLSX(t *testing.T) {
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>
+			<sheet name="Notes" sheetId="1" r:id="rId1"/><sheet name="Corrections" sheetId="2" r:id="rId2"/>
+		</sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships>
+			<Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Target="/xl/worksheets/sheet2.xml"/>
+		</Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>record_id</t></si><si><r><t>accout_</t></r><r><t>number</t></r></si>
+			<si><t>cash_balance</t></si><si><t>currency</t></si><si><t>taxes_paid</t></si><si><t>business_date</t></si>
+			<si><t>EUR</t></si></sst>`,
+		"xl/styles.xml":            `<styleSheet><cellXfs><xf numFmtId="0"/><xf numFmtId="14"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row r="1"><c r="A1" t="inlineStr"><is><t>note</t></is></c></row></sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet><sheetData>
+			<row r="2"><c r="B2" t="s"><v>0</v></c><c r="C2" t="s"><v>1</v></c><c r="D2" t="s"><v>2</v></c><c r="E2" t="s"><v>3</v></c><c r="F2" t="s"><v>4</v></c><c r="G2" t="s"><v>5</v></c></row>
+			<row r="3"><c r="B3"><v>1</v></c><c r="C3"><v>12345679</v></c><c r="D3"><v>-56</v></c><c r="E3" t="s"><v>6</v></c><c r="F3"><v>789.55999999999995</v></c><c r="G3" s="1"><v>45164</v></c></row>
+			<row r="4"><c r="B4" t="str"><v></v></c></row>
+			<row r="5"><c r="B5"><v>2</v></c><c r="C5"><v>12345680</v></c><c r="D5"><v>1</v></c><c r="E5" t="inlineStr"><is><t>EUR</t></is></c><c r="F5"><v>-1</v></c></row>
+			<row r="6"><c r="B6"><v>3</v></c><c r="C6"><v>12345681</v></c><c r="D6"><v>1</v></c><c r="E6" t="e"><v>#N/A</v></c><c r="F6"><v>0</v></c></row>
+		</sheetData></worksheet>`,
+	}
+	var workbook bytes.Buffer
+	zw := zip.NewWriter(&workbook)
+	for name, content := range parts {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	zw.Close()
+
+	files, cleanup, err := Expand("accounts_20230826.xlsx", bytes.NewReader(workbook.Bytes()))
+	defer cleanup()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expand() = %v, %v, want the workbook", files, err)
+	}
+
+	route := Route{
+		Key:         "accounts_20230826.xlsx",
+		FileType:    "accounts",
+		Format:      DetectFormat("accounts_20230826.xlsx", ""),
+		ErrorPolicy: ErrorPolicy{Mode: Quarantine},
+		Sheet:       "Corrections",
+	}
+	store := data.NewMemoryStore()
+	got, err := NewProcessor(store, nil).ProcessFile(route, struct{ io.Reader }{bytes.NewReader(workbook.Bytes())}, nil)
+	if err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if want := (Counts{Parsed: 3, Inserted: 1, Invalid: 2}); got != want {
+		t.Errorf("ProcessFile() = %+v, want %+v", got, want)
+	}
+	stored, ok := store.Accounts["12345679"]
+	if !ok {
+		t.Fatalf("accounts = %v, want account 12345679", store.Accounts)
+	}
+	if stored.CashBalance.String() != "-56 EUR" || stored.TaxesPaid.String() != "789.56 EUR" || stored.BusinessDate != "2023-08-26" {
+		t.Errorf("account = %+v, want cash balance -56 EUR, taxes paid 789.56 EUR and business date 2023-08-26", stored)
+	}
+
+	route.ErrorPolicy = ErrorPolicy{}
+	_, err = NewProcessor(data.NewMemoryStore(), nil).ProcessFile(route, bytes.NewReader(workbook.Bytes()), nil)
+	var report *ValidationError
+	if !errors.As(err, &report) {
+		t.Fatalf("ProcessFile() error = %v, want a validation error", err)
+	}
+	wantErr := []data.FieldError{
+		{Line: 5, Cell: "F5", Column: "taxes_paid", Value: "-1", Rule: data.RuleRange, Message: "must not be negative"},
+		{Line: 6, Cell: "E6", Column: "currency", Rule: data.RuleType, Message: "contains the error #N/A"},
+	}
+	if !reflect.DeepEqual(report.Errors, wantErr) {
+		t.Errorf("ProcessFile() errors = %+v, want %+v", report.Errors, wantErr)
+	}
+
+	route.Sheet = "Sheet1"
+	_, err = NewProcessor(data.NewMemoryStore(), nil).ProcessFile(route, bytes.NewReader(workbook.Bytes()), nil)
+	if err == nil || !strings.Contains(err.Error(), `no sheet "Sheet1"`) {
+		t.Errorf("ProcessFile() error = %v, want a missing sheet", err)
+	}
+}
+
+func TestProcessFileFixedWidth(t *testing.T) {
+	router, err := NewRouter([]Rule{{Name: "custodian", Key: "CUST.ACCOUNTS.*", FileType: "accounts", Format: FormatFixedWidth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := router.Route("", "CUST.ACCOUNTS.D230826")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Format != FormatFixedWidth {
+		t.Errorf("Route() format = %q, want %q", route.Format, FormatFixedWidth)
+	}
+	if _, err := NewRouter([]Rule{{Name: "custodian", FileType: "accounts", Format: "cobol"}}); err == nil {
+		t.Errorf("NewRouter() accepted an unknown format")
+	}
+
+	content := fmt.Sprintf("%010d%010d%15s%-3s%13s%8s\r\n", 1, 12345679, "00000000005600-", "EUR", "0000000078956", "20230826") +
+		fmt.Sprintf("%010d%010d%15s%-3s%13s%8s\r\n", 2, 12345680, "000000000000100", "EUR", "00000000000ab", "00000000") +
+		"\r\n" +
+		fmt.Sprintf("%010d%010d%15s%-3s%13s", 3, 12345681, "+12", "USD", "0")
+	route.Key = "CUST.ACCOUNTS.D230826"
+	route.ErrorPolicy = ErrorPolicy{Mode: Quarantine}
+	store := data.NewMemoryStore()
+	got, err := NewProcessor(store, nil).ProcessFile(route, strings.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if want := (Counts{Parsed: 3, Inserted: 2, Invalid: 1}); got != want {
+		t.Errorf("ProcessFile() = %+v, want %+v", got, want)
+	}
+	stored := store.Accounts["12345679"]
+	if stored.CashBalance.String() != "-56.00 EUR" || stored.TaxesPaid.String() != "789.56 EUR" || stored.BusinessDate != "2023-08-26" {
+		t.Errorf("account = %+v, want cash balance -56.00 EUR, taxes paid 789.56 EUR and business date 2023-08-26", stored)
+	}
+	if stored := store.Accounts["12345681"]; stored.CashBalance.String() != "0.12 USD" {
+		t.Errorf("account = %+v, want cash balance 0.12 USD", stored)
+	}
+
+	route.ErrorPolicy = ErrorPolicy{}
+	_, err = NewProcessor(data.NewMemoryStore(), nil).ProcessFile(route, strings.NewReader(content), nil)
+	var report *ValidationError
+	if !errors.As(err, &report) {
+		t.Fatalf("ProcessFile() error = %v, want a validation error", err)
+	}
+	wantErr := []data.FieldError{{Line: 2, Column: "taxes_paid", Value: "00000000000ab", Rule: data.RuleType, Message: "must be a number"}}
+	if !reflect.DeepEqual(report.Errors, wantErr) {
+		t.Errorf("ProcessFile() errors = %+v, want %+v", report.Errors, wantErr)
+	}
+}
+
+func TestProcessFileFixedWidthLayout(t *testing.T) {
+	layout := []data.Field{
+		{Name: "account_number", Start: 1, Length: 8, Type: data.FieldNumber},
+		{Name: "currency", Start: 9, Length: 3, Type: data.FieldText},
+		{Name: "cash_balance", Start: 12, Length: 10, Type: data.FieldNumber, Decimals: 3},
+		{Name: "taxes_paid", Start: 22, Length: 8, Type: data.FieldNumber, Decimals: 2},
+		{Name: "record_id", Start: 30, Length: 4, Type: data.FieldNumber},
+	}
+	var rules []Rule
+	err := json.Unmarshal([]byte(`[{"name": "other custodian", "key": "OTHER.ACCOUNTS.*", "file_type": "accounts", "format": "fixed_width",
+		"layout": [{"name": "account_number", "start": 1, "length": 8, "type": "number"},
+			{"name": "currency", "start": 9, "length": 3, "type": "text"},
+			{"name": "cash_balance", "start": 12, "length": 10, "type": "number", "decimals": 3},
+			{"name": "taxes_paid", "start": 22, "length": 8, "type": "number", "decimals": 2},
+			{"name": "record_id", "start": 30, "length": 4, "type": "number"}]}]`), &rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := router.Route("", "OTHER.ACCOUNTS.D230826")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(route.Layout, layout) {
+		t.Errorf("Route() layout = %+v, want %+v", route.Layout, layout)
+	}
+
+	store := data.NewMemoryStore()
+	_, err = NewProcessor(store, nil).ProcessFile(route, strings.NewReader("12345679EUR0000056250000789560001\n"), nil)
+	if err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if stored := store.Accounts["12345679"]; stored.CashBalance.String() != "56.250 EUR" || stored.TaxesPaid.String() != "789.56 EUR" {
+		t.Errorf("account = %+v, want cash balance 56.250 EUR and taxes paid 789.56 EUR", stored)
+	}
+
+	invalid := []struct {
+		name string
+		rule Rule
+	}{
+		{"not fixed-width", Rule{Name: "csv", FileType: "accounts", Layout: layout}},
+		{"overlapping fields", Rule{Name: "overlap", FileType: "accounts", Format: FormatFixedWidth, Layout: append(slices.Clone(layout), data.Field{Name: "business_date", Start: 30, Length: 8, Type: data.FieldDate})}},
+		{"unknown column", Rule{Name: "unknown", FileType: "accounts", Format: FormatFixedWidth, Layout: append(slices.Clone(layout), data.Field{Name: "iban", Start: 34, Length: 22, Type: data.FieldText})}},
+	}
+	for _, tt := range invalid {
+		if _, err := NewRouter([]Rule{tt.rule}); err == nil {
+			t.Errorf("NewRouter() accepted a layout with %s", tt.name)
+		}
+	}
+}
+
+func TestProcessFileDialect(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  data.Dialect
+		content  string
+		wantName string
+	}{
+		{
+			name:     "semicolons in windows-1252",
+			content:  "record_id;first_name;last_name;client_reference;tax_free_allowance\r\n1;J\xfcrgen;M\xfcller;9e40659b-8b9f-4fc4-814b-5a7b5a23b64d;801\r\n",
+			wantName: "Jürgen Müller",
+		},
+		{
+			name:     "tabs with byte order mark",
+			content:  "\xef\xbb\xbfrecord_id\tfirst_name\tlast_name\tclient_reference\ttax_free_allowance\n1\tJürgen\tMüller\t9e40659b-8b9f-4fc4-814b-5a7b5a23b64d\t801\n",
+			wantName: "Jürgen Müller",
+		},
+		{
+			name:     "single quotes",
+			content:  "'record_id'|'first_name'|'last_name'|'client_reference'|'tax_free_allowance'\n1|'Seán \"Jack\"'|'O''Brien'|'9e40659b-8b9f-4fc4-814b-5a7b5a23b64d'|801\n",
+			wantName: `Seán "Jack" O'Brien`,
+		},
+		{
+			name:     "overrides",
+			dialect:  data.Dialect{Delimiter: ",", Quote: `"`, Encoding: "utf-8"},
+			content:  "record_id,first_name,last_name,client_reference,tax_free_allowance\n1,J\xfcrgen,\"M\xfcller; Schmidt\",9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n",
+			wantName: "J\ufffdrgen M\ufffdller; Schmidt",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := data.NewMemoryStore()
+			route := Route{Key: "clients_20230826.csv", FileType: "clients", CSV: tt.dialect}
+			got, err := NewProcessor(store, nil).ProcessFile(route, strings.NewReader(tt.content), nil)
+			if err != nil {
+				t.Fatalf("ProcessFile() error = %v", err)
+			}
+			if got.Inserted != 1 {
+				t.Fatalf("ProcessFile() = %+v, want 1 inserted", got)
+			}
+			client := store.Clients["9e40659b-8b9f-4fc4-814b-5a7b5a23b64d"]
+			if name := client.FirstName + " " + client.LastName; name != tt.wantName {
+				t.Errorf("name = %q, want %q", name, tt.wantName)
+			}
+		})
+	}
+
+	if _, err := NewRouter([]Rule{{Name: "clients", FileType: "clients", CSV: data.Dialect{Encoding: "ebcdic"}}}); err == nil {
+		t.Errorf("NewRouter() accepted an unknown encoding")
+	}
+	if _, err := NewRouter([]Rule{{Name: "clients", FileType: "clients", CSV: data.Dialect{Decimal: "'"}}}); err == nil {
+		t.Errorf("NewRouter() accepted an unknown decimal separator")
+	}
+}
+
+func TestProcessFileFXRates(t *testing.T) {
+	router, err := NewRouter(DefaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+
+	// Rates are published on Friday, the figures are reported for the following Monday.
+	rates := "record_id,currency,base_currency,rate\n" +
+		"1,USD,EUR,0.9215\n" +
+		"2,EUR,GBP,0.8571\n" +
+		"3,EUR,EUX,1.0\n"
+	route, err := router.Route("test-bucket", "incoming/fxrates_20230825.csv")
+	if err != nil || route.FileType != "fxrates" {
+		t.Fatalf("Route() = %+v, %v, want the fxrates processor", route, err)
+	}
+	route.ErrorPolicy = ErrorPolicy{Mode: Quarantine}
+	got, err := p.ProcessFile(route, strings.NewReader(rates), nil)
+	if want := (Counts{Parsed: 3, Inserted: 2, Invalid: 1}); err != nil || got != want {
+		t.Fatalf("ProcessFile() = %+v, %v, want %+v", got, err, want)
+	}
+
+	files := map[string]string{
+		"clients_20230828.csv": "record_id,first_name,last_name,client_reference,tax_free_allowance\n" +
+			"1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n",
+		"portfolios_20230828.csv": "record_id,account_number,portfolio_reference,client_reference,agent_code\n" +
+			"1,1001,90755e32-7438-4354-ad37-ad900e297844,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,EREZBT\n2,1002,439695b4-508d-4562-8576-670e70024627,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,EREZBT\n3,1003,5d7c1b8e-2f0a-4c3e-9b6d-1e8f2a3c4b5d,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,EREZBT\n",
+		"accounts_20230828.csv": "record_id,account_number,cash_balance,currency,taxes_paid\n" +
+			"1,1001,100.00,EUR,10.00\n2,1002,200.00,USD,20.00\n3,1003,300.00,GBP,0.00\n",
+		"transactions_20230828.csv": "record_id,account_number,transaction_reference,amount,keyword\n" +
+			"1,1002,t1,50.00,DEPOSIT\n",
+	}
+	for _, name := range []string{"clients_20230828.csv", "portfolios_20230828.csv", "accounts_20230828.csv", "transactions_20230828.csv"} {
+		route, err := router.Route("test-bucket", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.ProcessFile(route, strings.NewReader(files[name]), nil)
+		if err != nil {
+			t.Fatalf("ProcessFile(%s) error = %v", name, err)
+		}
+	}
+
+	totals, err := store.GetClientTotals("9e40659b-8b9f-4fc4-814b-5a7b5a23b64d", "EUR", "2023-08-28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// USD are multiplied by the USD rate, GBP divided by the rate of EUR in GBP, both rounded half-even to cents.
+	figures := fmt.Sprint(totals.CashBalance, " ", totals.Balance, " ", totals.TaxesPaid, " ", totals.TaxFreeAllowance)
+	if want := "634.32 EUR 680.40 EUR 28.43 EUR 801 EUR"; figures != want {
+		t.Errorf("GetClientTotals() = %s, want %s", figures, want)
+	}
+
+	// There is no rate between GBP and USD, and no rates at all more than a week after they were published.
+	_, err = store.GetClientTotals("9e40659b-8b9f-4fc4-814b-5a7b5a23b64d", "USD", "2023-08-28")
+	if !errors.Is(err, data.ErrNoFXRate) {
+		t.Errorf("GetClientTotals(USD) error = %v, want %v", err, data.ErrNoFXRate)
+	}
+	_, err = store.GetClientTotals("9e40659b-8b9f-4fc4-814b-5a7b5a23b64d", "EUR", "2023-09-04")
+	if !errors.Is(err, data.ErrNoFXRate) {
+		t.Errorf("GetClientTotals(2023-09-04) error = %v, want %v", err, data.ErrNoFXRate)
+	}
+	_, err = store.GetClientTotals("9e40659b-8b9f-4fc4-814b-5a7b5a23b64d", "EUX", "2023-08-28")
+	if err == nil {
+		t.Errorf("GetClientTotals(EUX) didn't fail")
+	}
+}
+
+func TestProcessFileTransactionTypes(t *testing.T) {
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+	files := []struct {
+		route   Route
+		content string
+	}{
+		{Route{Key: "clients_20230828.csv", FileType: "clients"}, "record_id,first_name,last_name,client_reference,tax_free_allowance\n" +
+			"1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n"},
+		{Route{Key: "portfolios_20230828.csv", FileType: "portfolios"}, "record_id,account_number,portfolio_reference,client_reference,agent_code\n" +
+			"1,1001,90755e32-7438-4354-ad37-ad900e297844,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,EREZBT\n"},
+		{Route{Key: "accounts_20230828.csv", FileType: "accounts"}, "record_id,account_number,cash_balance,currency,taxes_paid\n" +
+			"1,1001,1000.00,EUR,5.00\n"},
+	}
+	for _, file := range files {
+		_, err := p.ProcessFile(file.route, strings.NewReader(file.content), nil)
+		if err != nil {
+			t.Fatalf("ProcessFile(%s) error = %v", file.route.Key, err)
+		}
+	}
+
+	content := "record_id,account_number,transaction_reference,amount,keyword\n" +
+		"1,1001,t1,100.00,DEPOSIT\n" +
+		"2,1001,t2,-30.00,withdrawal\n" +
+		"3,1001,t3,20.00,DIVIDEND\n" +
+		"4,1001,t4,-10.00,TAX\n" +
+		"5,1001,t5,500.00,TRANSFER\n" +
+		"6,1001,t6,5.00,FEE\n" +
+		"7,1001,t7,1.00,BONUS\n"
+	route := Route{Key: "transactions_20230828.csv", FileType: "transactions", ErrorPolicy: ErrorPolicy{Mode: Quarantine}}
+	got, err := p.ProcessFile(route, strings.NewReader(content), nil)
+	if want := (Counts{Parsed: 7, Inserted: 5, Invalid: 2}); err != nil || got != want {
+		t.Errorf("ProcessFile() = %+v, %v, want %+v", got, err, want)
+	}
+	for _, reference := range []string{"t6", "t7"} {
+		if _, ok := store.Transactions[reference]; ok {
+			t.Errorf("invalid transaction %s has been stored", reference)
+		}
+	}
+
+	// The transfer of securities doesn't change the balance, the tax is added to the taxes paid.
+	totals, err := store.GetClientTotals("9e40659b-8b9f-4fc4-814b-5a7b5a23b64d", "EUR", "2023-08-28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	figures := fmt.Sprint(totals.Balance, " ", totals.TaxesPaid, " ", totals.TaxableIncome)
+	if want := "1080.00 EUR 15.00 EUR 20.00 EUR"; figures != want {
+		t.Errorf("GetClientTotals() = %s, want %s", figures, want)
+	}
+
+	validator := data.NewValidator()
+	err = validator.SetUnknownKeywords(data.UnknownKeywordsAccept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = NewProcessor(store, validator).ProcessFile(route, strings.NewReader(content), nil)
+	if want := (Counts{Parsed: 7, Inserted: 6, Invalid: 1}); err != nil || got != want {
+		t.Errorf("ProcessFile() accepting unknown keywords = %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestProcessFileSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *data.SchemaError
+	}{
+		{
+			name:    "alias",
+			content: "record_id,accout_number,cash_balance,currency,taxes_paid\n1,12345678,1.00,EUR,0.00\n",
+		},
+		{
+			name:    "optional column",
+			content: "Record_ID,account_number,cash_balance,currency,taxes_paid,business_date\n1,12345678,1.00,EUR,0.00,20230826\n",
+		},
+		{
+			name:    "missing column",
+			content: "record_id,account_number,cash_balance,taxes_paid\n1,12345678,1.00,0.00\n",
+			want:    &data.SchemaError{FileType: "accounts", Version: 1, Missing: []string{"currency"}},
+		},
+		{
+			name:    "unknown column",
+			content: "record_id,account_no,cash_balance,currency,taxes_paid\n1,12345678,1.00,EUR,0.00\n",
+			want:    &data.SchemaError{FileType: "accounts", Version: 1, Missing: []string{"account_number"}, Unknown: []string{"account_no"}},
+		},
+		{
+			name:    "duplicate column",
+			content: "record_id,account_number,accout_number,cash_balance,currency,taxes_paid\n1,12345678,12345678,1.00,EUR,0.00\n",
+			want:    &data.SchemaError{FileType: "accounts", Version: 1, Duplicates: []string{"account_number"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := data.NewMemoryStore()
+			p := NewProcessor(store, nil)
+			_, err := p.ProcessFile(Route{Key: "accounts_20230826.csv", FileType: "accounts"}, strings.NewReader(tt.content), nil)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("ProcessFile() error = %v", err)
+				}
+				if _, ok := store.Accounts["12345678"]; !ok {
+					t.Errorf("accounts = %v, want account 12345678", store.Accounts)
+				}
+				return
+			}
+			var schemaErr *data.SchemaError
+			if !errors.As(err, &schemaErr) {
+				t.Fatalf("ProcessFile() error = %v, want a schema error", err)
+			}
+			if !reflect.DeepEqual(schemaErr, tt.want) {
+				t.Errorf("ProcessFile() error = %+v, want %+v", schemaErr, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessFileInChunks(t *testing.T) {
+	const rows = 2*chunkSize + 1
+	var file strings.Builder
+	file.WriteString("record_id,account_number,transaction_reference,amount,keyword\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&file, "%d,1000,ref-%d,1.5,DEPOSIT\n", i+1, i)
+	}
+
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+	got, err := p.ProcessFile(Route{Key: "transactions_20230826.csv", FileType: "transactions"}, strings.NewReader(file.String()), nil)
+	if err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if want := (Counts{Parsed: rows, Inserted: rows}); got != want {
+		t.Errorf("ProcessFile() = %+v, want %+v", got, want)
+	}
+	if len(store.Transactions) != rows {
+		t.Errorf("stored %d transactions, want %d", len(store.Transactions), rows)
+	}
+}
+
+func TestProcessFileControlTotals(t *testing.T) {
+	const rows = 2*chunkSize + 1
+	header := "record_id,account_number,transaction_reference,amount,keyword\n"
+	var complete, truncated strings.Builder
+	for i := 0; i < rows; i++ {
+		line := fmt.Sprintf("%d,1000,ref-%d,1.5,DEPOSIT\n", i+1, i)
+		complete.WriteString(line)
+		if i < rows-1 {
+			truncated.WriteString(line)
+		}
+	}
+	trailer := fmt.Sprintf("TRAILER,%d,1501.50\n", rows)
+	totals := &data.ControlTotals{Rows: rows, HashTotal: data.NewDecimal(150150, 2)}
+
+	tests := []struct {
+		name     string
+		controls string
+		totals   *data.ControlTotals
+		content  string
+		want     Counts
+		wantErr  bool
+	}{
+		{name: "trailer", controls: ControlsTrailer, content: header + complete.String() + trailer, want: Counts{Parsed: rows, Inserted: rows}},
+		{name: "truncated", controls: ControlsTrailer, content: header + truncated.String(), wantErr: true},
+		{name: "wrong trailer", controls: ControlsTrailer, content: header + truncated.String() + trailer, wantErr: true},
+		{name: "optional trailer", content: header + complete.String() + trailer, want: Counts{Parsed: rows, Inserted: rows}},
+		{name: "no trailer", content: header + complete.String(), want: Counts{Parsed: rows, Inserted: rows}},
+		// Without controls in the route the trailer is verified at the end, the chunks stored before are retracted.
+		{name: "wrong optional trailer", content: header + truncated.String() + trailer, want: Counts{Parsed: rows - 1}, wantErr: true},
+		{name: "control file", controls: ControlsSidecar, totals: totals, content: header + complete.String(), want: Counts{Parsed: rows, Inserted: rows}},
+		{name: "control file of truncated file", controls: ControlsSidecar, totals: totals, content: header + truncated.String(), wantErr: true},
+		{name: "no control file", controls: ControlsSidecar, content: header + complete.String(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := data.NewMemoryStore()
+			p := NewProcessor(store, nil)
+			route := Route{Key: "transactions_20230826.csv", FileType: "transactions", Controls: tt.controls, ControlTotals: tt.totals}
+			got, err := p.ProcessFile(route, strings.NewReader(tt.content), nil)
+			var controlErr *data.ControlError
+			if tt.wantErr != errors.As(err, &controlErr) || got != tt.want {
+				t.Errorf("ProcessFile() = %+v, %v, want %+v and control error %t", got, err, tt.want, tt.wantErr)
+			}
+			if len(store.Transactions) != tt.want.Inserted {
+				t.Errorf("stored %d transactions, want %d", len(store.Transactions), tt.want.Inserted)
+			}
+		})
+	}
+}
+
+func TestProcessFileValidation(t *testing.T) {
+	content := "record_id,account_number,cash_balance,currency,taxes_paid\n" +
+		"1,12345678,15000.00,EUR,0.00\n" +
+		"2,abc,15000.00,EUR,-1\n" +
+		"3,12345680,1.00,EUR,0.00\n" +
+		"4,12345681,1.00,,0.00\n" +
+		"5,12345682\n"
+
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+	got, err := p.ProcessFile(Route{Key: "accounts_20230826.csv", FileType: "accounts"}, strings.NewReader(content), nil)
+	if want := (Counts{Parsed: 5, Inserted: 0, Invalid: 3}); got != want {
+		t.Errorf("ProcessFile() = %+v, want %+v", got, want)
+	}
+	var report *ValidationError
+	if !errors.As(err, &report) {
+		t.Fatalf("ProcessFile() error = %v, want a validation error", err)
+	}
+	want := &ValidationError{
+		File:     "accounts_20230826.csv",
+		FileType: "accounts",
+		Invalid:  3,
+		Errors: []data.FieldError{
+			{Line: 3, Column: "account_number", Value: "abc", Rule: data.RuleType, Message: "must be an integer"},
+			{Line: 3, Column: "taxes_paid", Value: "-1", Rule: data.RuleRange, Message: "must not be negative"},
+			{Line: 5, Column: "currency", Rule: data.RuleRequired, Message: "is required"},
+			{Line: 6, Rule: data.RuleColumns, Message: "has 2 columns, the header has 5"},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("ProcessFile() error = %+v, want %+v", report, want)
+	}
+	// Files failing fast are not loaded at all.
+	if len(store.Accounts) != 0 {
+		t.Errorf("accounts = %v, want none", store.Accounts)
+	}
+
+	csv, err := report.CSV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "file,line,cell,column,value,rule,message,suggestion\n" +
+		"accounts_20230826.csv,3,,account_number,abc,type,must be an integer,\n" +
+		"accounts_20230826.csv,3,,taxes_paid,-1,range,must not be negative,\n" +
+		"accounts_20230826.csv,5,,currency,,required,is required,\n" +
+		"accounts_20230826.csv,6,,,,columns,\"has 2 columns, the header has 5\",\n"
+	if string(csv) != wantCSV {
+		t.Errorf("CSV() = %s, want %s", csv, wantCSV)
+	}
+
+	jsonKey, csvKey := ReportKeys("incoming/accounts.zip", "accounts_20230826.csv")
+	if jsonKey != "reports/incoming/accounts.zip/accounts_20230826.csv.errors.json" || csvKey != "reports/incoming/accounts.zip/accounts_20230826.csv.errors.csv" {
+		t.Errorf("ReportKeys() = %s, %s", jsonKey, csvKey)
+	}
+}
+
+// countingStore counts the requests for known references.
+type countingStore struct {
+	*data.MemoryStore
+	requests int
+	limit    int
+}
+
+func (s *countingStore) KnownReferences(column string, limit int) ([]string, error) {
+	s.requests++
+	s.limit = limit
+	return s.MemoryStore.KnownReferences(column, limit)
+}
+
+func TestProcessFileSuggestions(t *testing.T) {
+	content := "record_id,first_name,last_name,client_reference,tax_free_allowance\n" +
+		"1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b-5a23b64d,801\n" +
+		"2,Fritz,Maier,f4a0cc2c-d0b4-4f14-b202-c8a5e45e90e,0\n" +
+		"3,Franz,Huber,not a reference,0\n"
+
+	store := &countingStore{MemoryStore: data.NewMemoryStore()}
+	_, err := NewProcessor(store, nil).ProcessFile(Route{Key: "clients_20230826.csv", FileType: "clients"}, strings.NewReader(content), nil)
+	var report *ValidationError
+	if !errors.As(err, &report) || report.Invalid != 3 {
+		t.Fatalf("ProcessFile() error = %v, want three invalid rows", err)
+	}
+	// The known references are loaded once per file, not once per invalid row.
+	if store.requests != 1 || store.limit != maxCandidates {
+		t.Errorf("KnownReferences() requested %d times with limit %d, want once with limit %d", store.requests, store.limit, maxCandidates)
+	}
+}
+
+func TestProcessFileUnknownReferences(t *testing.T) {
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+	_, err := p.ProcessFile(Route{Key: "clients_20230826.csv", FileType: "clients"}, strings.NewReader("record_id,first_name,last_name,client_reference,tax_free_allowance\n"+
+		"1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second portfolio refers to a client which isn't known but is a typo of a known one. The third refers to a
+	// client which may be loaded later.
+	content := "record_id,account_number,portfolio_reference,client_reference,agent_code\n" +
+		"1,1001,90755e32-7438-4354-ad37-ad900e297844,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,EREZBT\n" +
+		"2,1002,439695b4-508d-4562-8576-670e70024627,9e40659b-8b9f-4fc4-814b-5a7b5a23b64e,EREZBT\n" +
+		"3,1003,5d7c1b8e-2f0a-4c3e-9b6d-1e8f2a3c4b5d,f4a0cc2c-d0b4-4f14-b202-c8a5e45e90ea,EREZBT\n"
+	got, err := p.ProcessFile(Route{Key: "portfolios_20230826.csv", FileType: "portfolios"}, strings.NewReader(content), nil)
+	var report *ValidationError
+	if !errors.As(err, &report) {
+		t.Fatalf("ProcessFile() error = %v, want a validation error", err)
+	}
+	want := []data.FieldError{{
+		Line:       3,
+		Column:     "client_reference",
+		Value:      "9e40659b-8b9f-4fc4-814b-5a7b5a23b64e",
+		Rule:       data.RuleReference,
+		Message:    "matches none of the clients loaded",
+		Suggestion: "9e40659b-8b9f-4fc4-814b-5a7b5a23b64d",
+	}}
+	if !reflect.DeepEqual(report.Errors, want) {
+		t.Errorf("ProcessFile() errors = %+v, want %+v", report.Errors, want)
+	}
+	if got != (Counts{Parsed: 3, Invalid: 1}) {
+		t.Errorf("ProcessFile() = %+v, want one invalid row", got)
+	}
+}
+
+func TestProcessFileErrorPolicy(t *testing.T) {
+	content := "record_id,account_number,cash_balance,currency,taxes_paid\n" +
+		"1,12345678,15000.00,EUR,0.00\n" +
+		"2,abc,15000.00,EUR,0.00\n" +
+		"3,12345680,1.00,EUR,0.00\n" +
+		"4,12345681\n"
+
+	tests := []struct {
+		name           string
+		policy         ErrorPolicy
+		want           Counts
+		wantErr        bool
+		wantQuarantine string
+	}{
+		{
+			name:    "fail fast",
+			want:    Counts{Parsed: 4, Invalid: 2},
+			wantErr: true,
+		},
+		{
+			name:   "quarantine",
+			policy: ErrorPolicy{Mode: Quarantine},
+			want:   Counts{Parsed: 4, Inserted: 2, Invalid: 2},
+			wantQuarantine: "record_id,account_number,cash_balance,currency,taxes_paid,rejection_reason\n" +
+				"2,abc,15000.00,EUR,0.00,\"line 3, column account_number: must be an integer\"\n" +
+				"4,12345681,,,,\"line 5: has 2 columns, the header has 5\"\n",
+		},
+		{
+			name:   "below threshold",
+			policy: ErrorPolicy{Mode: Threshold, MaxInvalidPercent: 50},
+			want:   Counts{Parsed: 4, Inserted: 2, Invalid: 2},
+			wantQuarantine: "record_id,account_number,cash_balance,currency,taxes_paid,rejection_reason\n" +
+				"2,abc,15000.00,EUR,0.00,\"line 3, column account_number: must be an integer\"\n" +
+				"4,12345681,,,,\"line 5: has 2 columns, the header has 5\"\n",
+		},
+		{
+			name:    "above threshold",
+			policy:  ErrorPolicy{Mode: Threshold, MaxInvalidPercent: 25},
+			want:    Counts{Parsed: 4, Invalid: 2},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := data.NewMemoryStore()
+			p := NewProcessor(store, nil)
+			var quarantined bytes.Buffer
+			quarantine := NewQuarantineFile(&quarantined)
+			route := Route{Key: "accounts_20230826.csv", FileType: "accounts", ErrorPolicy: tt.policy}
+			got, err := p.ProcessFile(route, strings.NewReader(content), quarantine)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProcessFile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ProcessFile() = %+v, want %+v", got, tt.want)
+			}
+			if len(store.Accounts) != tt.want.Inserted {
+				t.Errorf("accounts = %v, want %d", store.Accounts, tt.want.Inserted)
+			}
+			if tt.wantErr {
+				return
+			}
+			quarantine.Flush()
+			if quarantined.String() != tt.wantQuarantine {
+				t.Errorf("quarantined rows = %q, want %q", quarantined.String(), tt.wantQuarantine)
+			}
+
+			// Fixed rows can be submitted again as they are.
+			fixed := strings.Replace(quarantined.String(), "abc", "12345679", 1)
+			fixed = strings.Replace(fixed, "12345681,,,,", "12345681,1.00,EUR,0.00,", 1)
+			got, err = p.ProcessFile(route, strings.NewReader(fixed), nil)
+			if err != nil || got.Inserted != 2 {
+				t.Errorf("ProcessFile() of fixed rows = %+v, %v, want 2 rows inserted", got, err)
+			}
+		})
+	}
+
+	_, err := NewRouter([]Rule{{Name: "accounts", FileType: "accounts", ErrorPolicy: ErrorPolicy{Mode: "ignore"}}})
+	if err == nil {
+		t.Errorf("NewRouter() with unknown error policy succeeded")
+	}
+}
+
+func TestQuarantineFileHeader(t *testing.T) {
+	var quarantined bytes.Buffer
+	quarantine := NewQuarantineFile(&quarantined)
+	// Rows rejected before the header of their file was read have no header, which is written only once anyway.
+	for line := 1; line <= 2; line++ {
+		err := quarantine.add(&data.RowError{Line: line, Errors: []data.FieldError{{Line: line, Rule: data.RuleColumns, Message: "is broken"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	quarantine.Flush()
+	want := "rejection_reason\nline 1: is broken\nline 2: is broken\n"
+	if quarantined.String() != want {
+		t.Errorf("quarantined rows = %q, want %q", quarantined.String(), want)
+	}
+}
+
+func TestRetractFile(t *testing.T) {
+	router, err := NewRouter(DefaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+
+	original := "record_id,first_name,last_name,client_reference,tax_free_allowance\n1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n"
+	wrong := "record_id,first_name,last_name,client_reference,tax_free_allowance\n1,Frida,Meier,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n2,Fritz,Maier,f4a0cc2c-d0b4-4f14-b202-c8a5e45e90e7,0\n"
+	for _, file := range []struct{ key, content string }{
+		{"clients_20230826.csv", original},
+		{"clients_20230827.csv", wrong},
+	} {
+		route, _ := router.Route("", file.key)
+		_, err = p.ProcessFile(route, strings.NewReader(file.content), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	retracted, err := p.RetractFile("", "clients_20230827.csv")
+	if err != nil {
+		t.Fatalf("RetractFile() error = %v", err)
+	}
+	if retracted != 2 {
+		t.Errorf("RetractFile() = %d, want 2", retracted)
+	}
+	if got := store.Clients["9e40659b-8b9f-4fc4-814b-5a7b5a23b64d"]; got.LastName != "Müller" || got.SourceKey != "clients_20230826.csv" {
+		t.Errorf("client c1 = %+v, want the originally loaded client", got)
+	}
+	if _, ok := store.Clients["f4a0cc2c-d0b4-4f14-b202-c8a5e45e90e7"]; ok {
+		t.Errorf("client c2 still exists after retraction")
+	}
+}
+
+func TestProcessFileArchiveEntries(t *testing.T) {
+	router, err := NewRouter(DefaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := data.NewMemoryStore()
+	p := NewProcessor(store, nil)
+	loadedAt := time.Date(2023, 8, 26, 6, 0, 0, 0, time.UTC)
+	p.now = func() time.Time {
+		loadedAt = loadedAt.Add(time.Minute)
+		return loadedAt
+	}
+
+	zipped := func(entries map[string]string) []byte {
+		var archive bytes.Buffer
+		zw := zip.NewWriter(&archive)
+		for name, content := range entries {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(content))
+		}
+		zw.Close()
+		return archive.Bytes()
+	}
+	process := func(key string, archive []byte) map[string]error {
+		files, cleanup, err := Expand(key, bytes.NewReader(archive))
+		defer cleanup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var routes []Route
+		for _, file := range files {
+			route, err := router.Route("", file.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			route.Key, route.Entry = key, file.Name
+			routes = append(routes, route)
+		}
+		errs := map[string]error{}
+		for _, i := range SortByLoadOrder(routes) {
+			r, err := files[i].Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, errs[routes[i].Entry] = p.ProcessFile(routes[i], r, nil)
+			r.Close()
+		}
+		return errs
+	}
+
+	clients := "record_id,first_name,last_name,client_reference,tax_free_allowance\n" +
+		"1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n"
+	var accounts strings.Builder
+	accounts.WriteString("record_id,account_number,cash_balance,currency,taxes_paid\n")
+	for i := 1; i <= chunkSize+100; i++ {
+		fmt.Fprintf(&accounts, "%d,%d,1.00,EUR,0.00\n", i, 1000+i)
+	}
+	accounts.WriteString("601,2000,abc,EUR,0.00\n")
+
+	// The accounts entry fails after a chunk has been stored, the clients entry loaded before it is kept.
+	errs := process("batch_20230826.zip", zipped(map[string]string{
+		"clients_20230826.csv":  clients,
+		"accounts_20230826.csv": accounts.String(),
+	}))
+	var validationErr *ValidationError
+	if errs["clients_20230826.csv"] != nil || !errors.As(errs["accounts_20230826.csv"], &validationErr) {
+		t.Fatalf("ProcessFile() errors = %v, want the accounts entry to fail", errs)
+	}
+	client, ok := store.Clients["9e40659b-8b9f-4fc4-814b-5a7b5a23b64d"]
+	if !ok || client.SourceKey != "batch_20230826.zip!clients_20230826.csv" {
+		t.Errorf("client = %+v, want it loaded from the clients entry", client)
+	}
+	if len(store.Accounts) != 0 {
+		t.Errorf("stored %d accounts of the failed entry, want 0", len(store.Accounts))
+	}
+
+	// A later version of the same archive fails after overwriting the client, which is restored to the earlier version.
+	var changed strings.Builder
+	changed.WriteString("record_id,first_name,last_name,client_reference,tax_free_allowance\n" +
+		"1,Frida,Meier,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n")
+	for i := 2; i <= chunkSize+1; i++ {
+		fmt.Fprintf(&changed, "%d,Fritz,Maier,%08d-0000-4000-8000-000000000000,0\n", i, i)
+	}
+	changed.WriteString("502,Fritz,Maier,f4a0cc2c-d0b4-4f14-b202-c8a5e45e90e7,abc\n")
+	errs = process("batch_20230826.zip", zipped(map[string]string{"clients_20230826.csv": changed.String()}))
+	if !errors.As(errs["clients_20230826.csv"], &validationErr) {
+		t.Fatalf("ProcessFile() errors = %v, want the clients entry to fail", errs)
+	}
+	if got := store.Clients["9e40659b-8b9f-4fc4-814b-5a7b5a23b64d"]; got.LastName != "Müller" || got.LoadedAt != client.LoadedAt {
+		t.Errorf("client = %+v, want the client of the earlier version", got)
+	}
+	if len(store.Clients) != 1 {
+		t.Errorf("stored %d clients, want only the client of the earlier version", len(store.Clients))
+	}
+
+	// Deleting the archive retracts every entry of every version.
+	retracted, err := p.RetractFile("", "batch_20230826.zip")
+	if err != nil || retracted != 1 || len(store.Clients) != 0 {
+		t.Errorf("RetractFile() = %d, %v, leaving %d clients, want 1 retracted and none left", retracted, err, len(store.Clients))
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	now := time.Date(2023, 8, 27, 6, 0, 0, 0, time.UTC)
+	c := NewCoordinator(data.NewMemoryStore(), 6*time.Hour)
+	c.now = func() time.Time { return now }
+
+	// The files arrive out of order, the batch is only released once all of them are there.
+	for _, fileType := range []string{"transactions", "accounts", "clients"} {
+		release, err := c.Arrive("2023-08-26", data.BatchFile{FileType: fileType, Key: fileType + "_20230826.csv"})
+		if err != nil || release != nil {
+			t.Fatalf("Arrive(%s) = %+v, %v, want nil", fileType, release, err)
+		}
+	}
+	release, err := c.Arrive("2023-08-26", data.BatchFile{FileType: "portfolios", Key: "portfolios_20230826.csv"})
+	if err != nil || release == nil {
+		t.Fatalf("Arrive(portfolios) = %+v, %v, want a release", release, err)
+	}
+	var order []string
+	for _, file := range release.Files {
+		order = append(order, file.FileType)
+	}
+	if !reflect.DeepEqual(order, BatchOrder) {
+		t.Errorf("released files in order %v, want %v", order, BatchOrder)
+	}
+	c.Finish(*release)
+
+	// A second file of a type arriving after the batch has been loaded releases both files of the type.
+	release, err = c.Arrive("2023-08-26", data.BatchFile{FileType: "accounts", Key: "accounts_20230826_2.csv"})
+	if err != nil || release == nil {
+		t.Fatalf("Arrive(accounts) = %+v, %v, want a release", release, err)
+	}
+	var keys []string
+	for _, file := range release.Files {
+		keys = append(keys, file.Key)
+	}
+	want := []string{"clients_20230826.csv", "portfolios_20230826.csv", "accounts_20230826.csv", "accounts_20230826_2.csv", "transactions_20230826.csv"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("released files %v, want %v", keys, want)
+	}
+
+	// An incomplete batch is released once the cutoff has passed.
+	c.Arrive("2023-08-27", data.BatchFile{FileType: "clients", Key: "clients_20230827.csv"})
+	releases, _ := c.Due()
+	if len(releases) != 0 {
+		t.Errorf("Due() before the cutoff = %+v, want none", releases)
+	}
+	now = now.Add(7 * time.Hour)
+	releases, _ = c.Due()
+	if len(releases) != 1 || !reflect.DeepEqual(releases[0].Missing, []string{"portfolios", "accounts", "transactions"}) {
+		t.Errorf("Due() after the cutoff = %+v, want the incomplete batch of 2023-08-27", releases)
+	}
+
+	// Files arriving while the batch is being loaded are retried, until the lease of the processor loading it expires.
+	_, err = c.Arrive("2023-08-27", data.BatchFile{FileType: "portfolios", Key: "portfolios_20230827.csv"})
+	if !errors.Is(err, ErrBatchProcessing) {
+		t.Errorf("Arrive() while processing = %v, want %v", err, ErrBatchProcessing)
+	}
+	if releases, _ = c.Due(); len(releases) != 0 {
+		t.Errorf("Due() during the lease = %+v, want none", releases)
+	}
+	now = now.Add(DefaultBatchLease + time.Minute)
+	releases, _ = c.Due()
+	if len(releases) != 1 || len(releases[0].Files) != 2 {
+		t.Errorf("Due() after the lease expired = %+v, want the batch of 2023-08-27 with both files", releases)
+	}
+
+	// A batch whose files were deferred is released again once another file arrives.
+	if len(releases) == 1 {
+		c.Reopen(releases[0])
+	}
+	release, err = c.Arrive("2023-08-27", data.BatchFile{FileType: "accounts", Key: "accounts_20230827.csv"})
+	if err != nil {
+		t.Errorf("Arrive() after reopening = %v", err)
+	}
+	if releases, _ = c.Due(); release != nil || len(releases) != 1 || !releases[0].claimed {
+		t.Errorf("Arrive() after reopening = %+v and Due() = %+v, want the batch of 2023-08-27 released by Due", release, releases)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	content := []byte("client_reference,tax_number\n1,2\n")
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(content)
+	gw.Close()
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"accounts_20230826.csv", "clients_20230826.csv.gz"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, ".gz") {
+			w.Write(gzipped.Bytes())
+		} else {
+			w.Write(content)
+		}
+	}
+	zw.Close()
+
+	tests := []struct {
+		name      string
+		file      string
+		content   []byte
+		wantNames []string
+	}{
+		{"plain", "clients_20230826.csv", content, []string{"clients_20230826.csv"}},
+		{"gzip", "clients_20230826.csv.gz", gzipped.Bytes(), []string{"clients_20230826.csv"}},
+		{"gzip without extension", "clients_20230826.csv", gzipped.Bytes(), []string{"clients_20230826.csv"}},
+		{"zip", "upload.zip", archive.Bytes(), []string{"accounts_20230826.csv", "clients_20230826.csv"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, cleanup, err := Expand(tt.file, bytes.NewReader(tt.content))
+			defer cleanup()
+			if err != nil {
+				t.Fatalf("Expand() error = %v", err)
+			}
+			var names []string
+			for _, file := range files {
+				names = append(names, file.Name)
+				r, err := file.Open()
+				if err != nil {
+					t.Fatalf("Open() error = %v", err)
+				}
+				got, err := io.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("ReadAll() error = %v", err)
+				}
+				if !bytes.Equal(got, content) {
+					t.Errorf("Expand() %s = %q, want %q", file.Name, got, content)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("Expand() names = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+
+	routes := []Route{{FileType: "transactions"}, {FileType: "clients"}, {FileType: "accounts"}}
+	if got, want := SortByLoadOrder(routes), []int{1, 2, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SortByLoadOrder() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+)
+
+// ReportPrefix is the prefix of the error reports written next to the processed objects. Objects with this prefix are
+// not processed.
+const ReportPrefix = "reports/"
+
+// maxReportedErrors limits the number of errors kept in a report, so that the report of a file in which every row is
+// invalid still fits in memory. All invalid rows are counted.
+const maxReportedErrors = 10000
+
+// ValidationError reports the invalid rows of a file. It serves as the machine-readable error report of the file.
+type ValidationError struct {
+	File      string            `json:"file"`
+	FileType  string            `json:"file_type"`
+	Invalid   int               `json:"rows_invalid"`
+	Errors    []data.FieldError `json:"errors"`
+	Truncated bool              `json:"truncated,omitempty"` // more errors were found than are listed
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%d invalid rows, the first at %s", e.Invalid, e.Errors[0])
+}
+
+func (e *ValidationError) add(rowErr *data.RowError) {
+	e.Invalid++
+	for _, fieldErr := range rowErr.Errors {
+		if len(e.Errors) == maxReportedErrors {
+			e.Truncated = true
+			return
+		}
+		e.Errors = append(e.Errors, fieldErr)
+	}
+}
+
+// JSON returns the report as JSON.
+func (e *ValidationError) JSON() ([]byte, error) {
+	return json.MarshalIndent(e, "", "  ")
+}
+
+// CSV returns the errors of the report as CSV, one line per invalid value.
+func (e *ValidationError) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"file", "line", "cell", "column", "value", "rule", "message", "suggestion"})
+	for _, fieldErr := range e.Errors {
+		w.Write([]string{e.File, strconv.Itoa(fieldErr.Line), fieldErr.Cell, fieldErr.Column, fieldErr.Value, fieldErr.Rule, fieldErr.Message, fieldErr.Suggestion})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// ReportKeys returns the keys of the JSON and CSV error reports of an object, or of an entry of an archive.
+func ReportKeys(key string, entry string) (string, string) {
+	base := ReportPrefix + key
+	if entry != "" {
+		base += "/" + entry
+	}
+	return base + ".errors.json", base + ".errors.csv"
+}
@@ -0,0 +1,197 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+)
+
+// Rule routes objects whose bucket and key match the rule to the processor for FileType. Bucket and Key are glob
+// patterns as understood by path.Match, KeyRegex is a regular expression whose named capture groups (e.g.
+// business_date) are passed on to processing. Empty patterns match everything. ErrorPolicy decides what happens to
+// files with invalid rows. Format overrides the format detected from the name and content type of an object, e.g. for
+// fixed-width files. Sheet names the sheet read from XLSX workbooks, by default the first one. CSV overrides the
+// delimiter, quote character and encoding sniffed from CSV files, the encoding also applies to fixed-width files, and
+// sets the decimal separator of their amounts. Layout lays out the fields of fixed-width files, by default as in
+// data.Layouts. Controls requires CSV files to come with control totals, see ControlsTrailer and ControlsSidecar.
+type Rule struct {
+	Name        string       `json:"name"`
+	Bucket      string       `json:"bucket,omitempty"`
+	Key         string       `json:"key,omitempty"`
+	KeyRegex    string       `json:"key_regex,omitempty"`
+	FileType    string       `json:"file_type"`
+	ErrorPolicy ErrorPolicy  `json:"error_policy"`
+	Format      string       `json:"format,omitempty"`
+	Sheet       string       `json:"sheet,omitempty"`
+	CSV         data.Dialect `json:"csv"`
+	Layout      []data.Field `json:"layout,omitempty"`
+	Controls    string       `json:"controls,omitempty"`
+
+	keyRegex *regexp.Regexp
+}
+
+// Route is the outcome of routing an object: the processor it goes to and the parameters captured from its key.
+type Route struct {
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key"`
+	Rule   string `json:"rule,omitempty"`
+	// Entry names the file if it is an entry of the archive Key. Its records are attributed to the entry, see
+	// data.EntryKey.
+	Entry       string            `json:"entry,omitempty"`
+	FileType    string            `json:"file_type"`
+	Params      map[string]string `json:"params,omitempty"`
+	ErrorPolicy ErrorPolicy       `json:"error_policy"`
+	// Format is the format of the file, see DetectFormat. The router sets the format of the rule, if any.
+	Format string       `json:"format,omitempty"`
+	Sheet  string       `json:"sheet,omitempty"`
+	CSV    data.Dialect `json:"csv"`
+	Layout []data.Field `json:"layout,omitempty"`
+	// Controls is the control totals the file is required to have. ControlTotals are the totals of its control file,
+	// which the caller reads for ControlsSidecar, see ControlFileName.
+	Controls      string              `json:"controls,omitempty"`
+	ControlTotals *data.ControlTotals `json:"control_totals,omitempty"`
+}
+
+// RoutingError is returned for objects which no rule matches.
+type RoutingError struct {
+	Bucket string
+	Key    string
+}
+
+func (e *RoutingError) Error() string {
+	return fmt.Sprintf("no routing rule matches object %q in bucket %q", e.Key, e.Bucket)
+}
+
+// Router maps objects to processors using an ordered list of rules. The first matching rule wins.
+type Router struct {
+	rules []Rule
+}
+
+// Route finds the first rule matching the object.
+func (r *Router) Route(bucket string, key string) (Route, error) {
+	for _, rule := range r.rules {
+		params, ok := rule.match(bucket, key)
+		if ok {
+			return Route{Bucket: bucket, Key: key, Rule: rule.Name, FileType: rule.FileType, Params: params, ErrorPolicy: rule.ErrorPolicy, Format: rule.Format, Sheet: rule.Sheet, CSV: rule.CSV, Layout: rule.Layout, Controls: rule.Controls}, nil
+		}
+	}
+	return Route{}, &RoutingError{Bucket: bucket, Key: key}
+}
+
+func (rule Rule) match(bucket string, key string) (map[string]string, bool) {
+	if rule.Bucket != "" {
+		if ok, _ := path.Match(rule.Bucket, bucket); !ok {
+			return nil, false
+		}
+	}
+	if rule.Key != "" {
+		if ok, _ := path.Match(rule.Key, key); !ok {
+			return nil, false
+		}
+	}
+	if rule.keyRegex == nil {
+		return nil, true
+	}
+
+	match := rule.keyRegex.FindStringSubmatch(key)
+	if match == nil {
+		return nil, false
+	}
+	var params map[string]string
+	for i, name := range rule.keyRegex.SubexpNames() {
+		if name != "" && match[i] != "" {
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[name] = match[i]
+		}
+	}
+	return params, true
+}
+
+// DefaultRules route objects named like <type>_<YYYYMMDD>.csv, in any folder, to the processor for <type>.
+func DefaultRules() []Rule {
+	var rules []Rule
+	for _, fileType := range []string{"clients", "portfolios", "accounts", "transactions", "fxrates"} {
+		rules = append(rules, Rule{
+			Name:     fileType,
+			KeyRegex: `(?:^|/)` + fileType + `_(?:(?P<business_date>\d{8})\b)?[^/]*$`,
+			FileType: fileType,
+		})
+	}
+	return rules
+}
+
+// LoadRouter reads the routing rules from a JSON file containing a list of rules. Without a path the default rules
+// are used.
+func LoadRouter(configPath string) (*Router, error) {
+	if configPath == "" {
+		return NewRouter(DefaultRules())
+	}
+
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read routing rules: %w", err)
+	}
+	var rules []Rule
+	err = json.Unmarshal(config, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse routing rules from %s: %w", configPath, err)
+	}
+	return NewRouter(rules)
+}
+
+func NewRouter(rules []Rule) (*Router, error) {
+	for i := range rules {
+		rule := &rules[i]
+		if !KnownFileType(rule.FileType) {
+			return nil, fmt.Errorf("routing rule %q: unknown file type %q", rule.Name, rule.FileType)
+		}
+		if err := rule.ErrorPolicy.validate(); err != nil {
+			return nil, fmt.Errorf("routing rule %q: %w", rule.Name, err)
+		}
+		if !KnownFormat(rule.Format) {
+			return nil, fmt.Errorf("routing rule %q: unknown format %q", rule.Name, rule.Format)
+		}
+		if err := rule.CSV.Validate(); err != nil {
+			return nil, fmt.Errorf("routing rule %q: %w", rule.Name, err)
+		}
+		if err := validateLayout(rule.FileType, rule.Layout, rule.Format); err != nil {
+			return nil, fmt.Errorf("routing rule %q: %w", rule.Name, err)
+		}
+		if err := validateControls(rule.Controls, rule.Format); err != nil {
+			return nil, fmt.Errorf("routing rule %q: %w", rule.Name, err)
+		}
+		for _, pattern := range []string{rule.Bucket, rule.Key} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("routing rule %q: invalid pattern %q: %w", rule.Name, pattern, err)
+			}
+		}
+		if rule.KeyRegex != "" {
+			keyRegex, err := regexp.Compile(rule.KeyRegex)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %q: %w", rule.Name, err)
+			}
+			rule.keyRegex = keyRegex
+		}
+	}
+
+	return &Router{
+		rules: rules,
+	}, nil
+}
+
+// validateLayout checks the fixed-width layout of a rule, which only fixed-width rules can have.
+func validateLayout(fileType string, fields []data.Field, format string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	if format != FormatFixedWidth {
+		return fmt.Errorf("a layout is only supported for %s files, not %q", FormatFixedWidth, format)
+	}
+	return data.Layout{FileType: fileType, Fields: fields}.Validate()
+}
@@ -0,0 +1,60 @@
+package processor
+
+import (
+	"log"
+	"strings"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+)
+
+// maxCandidates limits the known identifiers of a column which are loaded to suggest them, so that files with many
+// invalid identifiers don't compare every one of them with every identifier ever loaded.
+const maxCandidates = 10000
+
+// suggester suggests known identifiers for the invalid identifiers of a file, so that typos stand out in the error
+// report. The known identifiers of a column are loaded from the store once per file, the first time they are needed,
+// up to maxCandidates of them. They also serve to check the references of the file, see data.Column.References.
+type suggester struct {
+	store data.Store
+	known map[string][]string
+}
+
+func newSuggester(store data.Store) *suggester {
+	return &suggester{store: store, known: map[string][]string{}}
+}
+
+// candidates returns the known identifiers of a column, sorted.
+func (s *suggester) candidates(column string) []string {
+	known, ok := s.known[column]
+	if !ok {
+		var err error
+		known, err = s.store.KnownReferences(column, maxCandidates)
+		if err != nil {
+			log.Printf("Error loading known %s for suggestions: %s", column, err)
+		}
+		s.known[column] = known
+	}
+	return known
+}
+
+// references returns the known identifiers of a column to check references against, or nil if there are more than
+// maxCandidates of them, in which case a reference which isn't among them might still be known.
+func (s *suggester) references(column string) []string {
+	known := s.candidates(column)
+	if len(known) >= maxCandidates {
+		return nil
+	}
+	return known
+}
+
+// suggest sets the suggestions of the invalid identifiers of a row. Unknown references have theirs already.
+func (s *suggester) suggest(rowErr *data.RowError) {
+	for i, fieldErr := range rowErr.Errors {
+		if fieldErr.Rule != data.RuleIdentifier {
+			continue
+		}
+		if suggestion, ok := data.Suggest(strings.TrimSpace(fieldErr.Value), s.candidates(fieldErr.Column)); ok {
+			rowErr.Errors[i].Suggestion = suggestion
+		}
+	}
+}
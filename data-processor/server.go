@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+	"github.com/joidegn/scalable-capital/data-processor/processor"
+)
+
+// maxUploadSize limits the size of a single upload request.
+const maxUploadSize = 100 << 20
+
+// newServer returns the HTTP server which accepts file uploads at POST /files/{type}, either as the raw request
+// body or as one or more multipart form files in the "file" field. The sheet query parameter selects the sheet read
+// from XLSX workbooks. The totals of a client are served at GET /clients/{reference}/totals.
+func newServer(h handler, addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/", h.handleUpload)
+	mux.HandleFunc("/clients/", h.handleClientTotals)
+
+	return &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+}
+
+func (h handler) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileType := strings.TrimPrefix(r.URL.Path, "/files/")
+	if !processor.KnownFileType(fileType) {
+		http.Error(w, fmt.Sprintf("unknown file type %q", fileType), http.StatusNotFound)
+		return
+	}
+
+	sheet := r.URL.Query().Get("sheet")
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	var report Report
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		err := r.ParseMultipartForm(maxUploadSize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("couldn't parse multipart form: %v", err), http.StatusBadRequest)
+			return
+		}
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			http.Error(w, `no files in form field "file"`, http.StatusBadRequest)
+			return
+		}
+		for _, header := range files {
+			file, err := header.Open()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("couldn't open uploaded file %s: %v", header.Filename, err), http.StatusBadRequest)
+				return
+			}
+			report.add(h.processUpload(fileType, sheet, header.Filename, header.Header.Get("Content-Type"), file)...)
+			file.Close()
+		}
+	} else {
+		report.add(h.processUpload(fileType, sheet, "", r.Header.Get("Content-Type"), r.Body)...)
+	}
+
+	status := http.StatusOK
+	if report.Failed > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("Error writing response: %s", err)
+	}
+}
+
+// handleClientTotals responds with the figures of a client added up over its accounts in the currency query parameter,
+// by default the tax currency, at the rates valid on the date query parameter, see data.ClientTotals.
+func (h handler) handleClientTotals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientReference, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/clients/"), "/totals")
+	if !ok || clientReference == "" || strings.Contains(clientReference, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	currency := r.URL.Query().Get("currency")
+	if currency == "" {
+		currency = data.TaxCurrency
+	}
+	if !data.KnownCurrency(currency) {
+		http.Error(w, fmt.Sprintf("unknown currency %q", currency), http.StatusBadRequest)
+		return
+	}
+	businessDate := r.URL.Query().Get("date")
+	if _, err := time.Parse(time.DateOnly, businessDate); err != nil {
+		http.Error(w, fmt.Sprintf("invalid date %q, must be YYYY-MM-DD", businessDate), http.StatusBadRequest)
+		return
+	}
+
+	totals, err := h.store.GetClientTotals(clientReference, currency, businessDate)
+	if errors.Is(err, data.ErrNoFXRate) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding up the totals of client %s: %s", clientReference, err)
+		http.Error(w, "couldn't add up the totals of the client", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(totals)
+	if err != nil {
+		log.Printf("Error writing response: %s", err)
+	}
+}
+
+// processUpload processes the content of an uploaded file and reports the outcome. Compressed uploads are
+// decompressed and the entries of an archive are processed in load order. Parameters such as the business date are
+// taken from the file name if it matches a routing rule for the same file type; entries of an archive whose names match
+// a routing rule for another file type are processed as that type, the others as the given type. The format is
+// detected from the file name or the content type of the upload. A sheet overrides the sheet of the routing rule.
+// Control files among the entries of an archive are not processed, they provide the control totals of the entries they
+// belong to.
+func (h handler) processUpload(fileType string, sheet string, name string, contentType string, r io.Reader) []RecordResult {
+	result := RecordResult{
+		Key:      name,
+		FileType: fileType,
+		Status:   statusFailed,
+	}
+
+	files, cleanup, err := processor.Expand(name, r)
+	defer cleanup()
+	if err != nil {
+		log.Printf("Error expanding uploaded file: %s", err)
+		result.Error = err.Error()
+		return []RecordResult{result}
+	}
+
+	var results []RecordResult
+	var routed []processor.File
+	var routes []processor.Route
+	for _, file := range files {
+		if processor.IsControlFile(file.Name) {
+			continue
+		}
+		route := h.uploadRoute(fileType, sheet, name, contentType, file)
+		if route.Controls == processor.ControlsSidecar {
+			route.ControlTotals, err = processor.SidecarControls(files, file.Name)
+			if err != nil {
+				log.Printf("Error reading control file of %s: %s", file.Name, err)
+				results = append(results, RecordResult{Key: name, Entry: route.Entry, FileType: route.FileType, Status: statusFailed, Error: err.Error()})
+				continue
+			}
+		}
+		routed = append(routed, file)
+		routes = append(routes, route)
+	}
+
+	for _, i := range processor.SortByLoadOrder(routes) {
+		results = append(results, h.processUploadedFile(routes[i], routed[i]))
+	}
+	return results
+}
+
+// uploadRoute returns the route of an uploaded file or an entry of an uploaded archive, see processUpload.
+func (h handler) uploadRoute(fileType string, sheet string, name string, contentType string, file processor.File) processor.Route {
+	entry := entryName(name, file)
+	route := processor.Route{FileType: fileType}
+	if file.Name != "" {
+		routed, err := h.router.Route("", file.Name)
+		if err == nil && (routed.FileType == fileType || entry != "") {
+			route = routed
+		}
+	}
+	route.Key, route.Entry = name, entry
+	if entry != "" {
+		contentType = ""
+	}
+	if route.Format == "" {
+		route.Format = processor.DetectFormat(file.Name, contentType)
+	}
+	if sheet != "" {
+		route.Sheet = sheet
+	}
+	return route
+}
+
+// processUploadedFile processes an uploaded file and returns the rows skipped by its error policy with the result.
+func (h handler) processUploadedFile(route processor.Route, file processor.File) RecordResult {
+	result := RecordResult{
+		Key:      route.Key,
+		Entry:    route.Entry,
+		FileType: route.FileType,
+		Params:   route.Params,
+		Status:   statusFailed,
+	}
+
+	// Rows skipped by the error policy are returned in the response, so that they can be fixed and uploaded again.
+	var skipped bytes.Buffer
+	quarantine := processor.NewQuarantineFile(&skipped)
+	counts, err := openAndProcess(h.p, route, file, quarantine)
+	result.Parsed, result.Inserted, result.Invalid = counts.Parsed, counts.Inserted, counts.Invalid
+	if err == nil && quarantine.Rows > 0 {
+		err = quarantine.Flush()
+		result.RowErrors, result.QuarantinedRows = quarantine.Errors, skipped.String()
+	}
+	if err != nil {
+		log.Printf("Error processing uploaded file: %s", err)
+		result.Error = err.Error()
+		var validationErr *processor.ValidationError
+		if errors.As(err, &validationErr) {
+			result.RowErrors = validationErr.Errors
+		}
+		h.d.SendErrorEvent(err)
+		return result
+	}
+
+	result.Status = statusProcessed
+	log.Printf("Processed uploaded %s file %s", route.FileType, file.Name)
+
+	return result
+}
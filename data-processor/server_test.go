@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/joidegn/scalable-capital/data-processor/data"
+	"github.com/joidegn/scalable-capital/data-processor/processor"
+)
+
+func TestUpload(t *testing.T) {
+	clients, err := os.ReadFile("data/testdata/clients_20230826.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("file", "clients_20230826.csv")
+	part.Write(clients)
+	writer.Close()
+
+	var tests = []struct {
+		name        string
+		path        string
+		contentType string
+		body        []byte
+		wantStatus  int
+		wantKey     string
+	}{
+		{name: "raw body", path: "/files/clients", contentType: "text/csv", body: clients, wantStatus: http.StatusOK},
+		{name: "multipart", path: "/files/clients", contentType: writer.FormDataContentType(), body: form.Bytes(), wantStatus: http.StatusOK, wantKey: "clients_20230826.csv"},
+		{name: "json lines", path: "/files/clients", contentType: "application/x-ndjson", body: []byte(`{"record_id": 1, "client_reference": "9e40659b-8b9f-4fc4-814b-5a7b5a23b64d", "first_name": "Frida", "last_name": "Müller", "tax_free_allowance": 801}
+{"record_id": 2, "client_reference": "f4a0cc2c-d0b4-4f14-b202-c8a5e45e90e7", "first_name": "Fritz", "last_name": "Maier", "tax_free_allowance": 0}
+`), wantStatus: http.StatusOK},
+		{name: "unknown file type", path: "/files/unknown", contentType: "text/csv", body: clients, wantStatus: http.StatusNotFound},
+	}
+
+	h := testHandler(t)
+	h.d = &data.DataManager{}
+	h.p = processor.NewProcessor(data.NewMemoryStore(), nil)
+	server := newServer(h, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var report Report
+			err := json.Unmarshal(rec.Body.Bytes(), &report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Processed != 1 || report.Records[0].Key != tt.wantKey || report.Records[0].Inserted != 2 {
+				t.Errorf("report = %+v", report)
+			}
+		})
+	}
+}
+
+func TestUploadQuarantine(t *testing.T) {
+	router, err := processor.NewRouter([]processor.Rule{
+		{Name: "accounts", Key: "accounts_*.csv", FileType: "accounts", ErrorPolicy: processor.ErrorPolicy{Mode: processor.Quarantine}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handler{router: router, d: &data.DataManager{}, p: processor.NewProcessor(data.NewMemoryStore(), nil)}
+
+	content := "record_id,account_number,cash_balance,currency,taxes_paid\n" +
+		"1,12345678,15000.00,EUR,0.00\n" +
+		"2,12345679,-56.00,EUR,-1\n"
+	results := h.processUpload("accounts", "", "accounts_20230826.csv", "text/csv", strings.NewReader(content))
+	if len(results) != 1 {
+		t.Fatalf("processUpload() = %+v, want one result", results)
+	}
+	result := results[0]
+	if result.Status != statusProcessed || result.Inserted != 1 || result.Invalid != 1 {
+		t.Errorf("processUpload() = %+v, want one account inserted and one skipped", result)
+	}
+	if len(result.RowErrors) != 1 || result.RowErrors[0].Column != "taxes_paid" {
+		t.Errorf("row errors = %+v, want the error of the skipped row", result.RowErrors)
+	}
+	wantRows := "record_id,account_number,cash_balance,currency,taxes_paid,rejection_reason\n" +
+		"2,12345679,-56.00,EUR,-1,\"line 3, column taxes_paid: must not be negative\"\n"
+	if result.QuarantinedRows != wantRows {
+		t.Errorf("quarantined rows = %q, want %q", result.QuarantinedRows, wantRows)
+	}
+}
+
+func TestUploadArchiveLoadOrder(t *testing.T) {
+	h := testHandler(t)
+	h.d = &data.DataManager{}
+	h.p = processor.NewProcessor(data.NewMemoryStore(), nil)
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"accounts_20230826.csv", "clients_20230826.csv"} {
+		content, err := os.ReadFile("data/testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+	}
+	zw.Close()
+
+	// The entries are processed as the file types they are routed to, clients before accounts.
+	results := h.processUpload("clients", "", "batch_20230826.zip", "application/zip", &archive)
+	var entries []string
+	for _, result := range results {
+		if result.Status != statusProcessed {
+			t.Errorf("%s: %s", result.Entry, result.Error)
+		}
+		entries = append(entries, result.FileType+":"+result.Entry)
+	}
+	want := []string{"clients:clients_20230826.csv", "accounts:accounts_20230826.csv"}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("processed %v, want %v", entries, want)
+	}
+}
+
+func TestClientTotals(t *testing.T) {
+	store := data.NewMemoryStore()
+	h := handler{router: testHandler(t).router, d: &data.DataManager{}, p: processor.NewProcessor(store, nil), store: store}
+	files := []struct{ fileType, name, content string }{
+		{"fxrates", "fxrates_20230825.csv", "record_id,currency,base_currency,rate\n1,USD,EUR,0.9215\n"},
+		{"clients", "clients_20230828.csv", "record_id,first_name,last_name,client_reference,tax_free_allowance\n" +
+			"1,Frida,Müller,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,801\n"},
+		{"portfolios", "portfolios_20230828.csv", "record_id,account_number,portfolio_reference,client_reference,agent_code\n" +
+			"1,1001,90755e32-7438-4354-ad37-ad900e297844,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,EREZBT\n" +
+			"2,1002,439695b4-508d-4562-8576-670e70024627,9e40659b-8b9f-4fc4-814b-5a7b5a23b64d,EREZBT\n"},
+		{"accounts", "accounts_20230828.csv", "record_id,account_number,cash_balance,currency,taxes_paid\n" +
+			"1,1001,100.00,EUR,10.00\n2,1002,200.00,USD,20.00\n"},
+	}
+	for _, file := range files {
+		results := h.processUpload(file.fileType, "", file.name, "text/csv", strings.NewReader(file.content))
+		if len(results) != 1 || results[0].Status != statusProcessed {
+			t.Fatalf("processUpload(%s) = %+v", file.name, results)
+		}
+	}
+
+	var tests = []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "totals in EUR",
+			method:     http.MethodGet,
+			path:       "/clients/9e40659b-8b9f-4fc4-814b-5a7b5a23b64d/totals?date=2023-08-28",
+			wantStatus: http.StatusOK,
+			wantBody:   `"currency":"EUR","cash_balance":284.30,"balance":284.30,"taxes_paid":28.43`,
+		},
+		{
+			name:       "no rate",
+			method:     http.MethodGet,
+			path:       "/clients/9e40659b-8b9f-4fc4-814b-5a7b5a23b64d/totals?currency=USD&date=2023-09-28",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "unknown currency",
+			method:     http.MethodGet,
+			path:       "/clients/9e40659b-8b9f-4fc4-814b-5a7b5a23b64d/totals?currency=EUX&date=2023-08-28",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no date",
+			method:     http.MethodGet,
+			path:       "/clients/9e40659b-8b9f-4fc4-814b-5a7b5a23b64d/totals",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown path",
+			method:     http.MethodGet,
+			path:       "/clients/9e40659b-8b9f-4fc4-814b-5a7b5a23b64d",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "wrong method",
+			method:     http.MethodPost,
+			path:       "/clients/9e40659b-8b9f-4fc4-814b-5a7b5a23b64d/totals?date=2023-08-28",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	server := newServer(h, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %s", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// handleSQSEvent processes S3 notifications which have been buffered in an SQS queue. Only the messages whose
+// files failed to process are reported back as batch item failures so that SQS redelivers just those. Scheduled
+// events sent to the queue trigger loading the batches whose cutoff has passed.
+func (h handler) handleSQSEvent(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	var response events.SQSEventResponse
+	var report Report
+
+	for _, message := range event.Records {
+		if scheduledEvent([]byte(message.Body)) {
+			if h.batches != nil {
+				report.add(h.sweepBatches().Records...)
+			}
+			continue
+		}
+
+		objects, err := parseObjectEvents([]byte(message.Body))
+		if err != nil {
+			log.Printf("Couldn't parse event from message %s. Error: %v", message.MessageId, err)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+			continue
+		}
+
+		failed := false
+		for _, object := range objects {
+			results := h.handleObject(object)
+			report.add(results...)
+			for _, result := range results {
+				if result.Status == statusFailed {
+					failed = true
+				}
+			}
+		}
+		if failed {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+		}
+	}
+	log.Printf("Processed %d records from %d messages, %d failed", report.Processed, len(event.Records), report.Failed)
+
+	return response, nil
+}
@@ -5,11 +5,17 @@ import (
 	"path/filepath"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3notifications"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
 
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
@@ -40,17 +46,72 @@ func NewDataProcessorStack(scope constructs.Construct, id string, props *DataPro
 		Runtime:      awslambda.Runtime_FROM_IMAGE(),
 		FunctionName: jsii.String("dataProcessor"),
 		Timeout:      awscdk.Duration_Seconds(jsii.Number(30)),
+		// zip archives are buffered in /tmp to read their entries
+		EphemeralStorageSize: awscdk.Size_Gibibytes(jsii.Number(4)),
+		Environment: &map[string]*string{
+			"EVENT_SOURCE": jsii.String("sqs"),
+			"BATCH_CUTOFF": jsii.String("6h"), // load the files of a business date at the latest 6 hours after the first
+		},
+	})
+
+	// Create the queue buffering the S3 notifications. Messages which fail repeatedly end up in the dead-letter queue.
+
+	deadLetterQueue := awssqs.NewQueue(stack, jsii.String("deadLetterQueue"), &awssqs.QueueProps{
+		RetentionPeriod: awscdk.Duration_Days(jsii.Number(14)),
+	})
+
+	queue := awssqs.NewQueue(stack, jsii.String("queue"), &awssqs.QueueProps{
+		VisibilityTimeout: awscdk.Duration_Seconds(jsii.Number(180)), // AWS recommends six times the lambda timeout
+		DeadLetterQueue: &awssqs.DeadLetterQueue{
+			MaxReceiveCount: jsii.Number(5),
+			Queue:           deadLetterQueue,
+		},
+	})
+
+	dataProcessor.AddEventSource(awslambdaeventsources.NewSqsEventSource(queue, &awslambdaeventsources.SqsEventSourceProps{
+		BatchSize:               jsii.Number(10),
+		MaxBatchingWindow:       awscdk.Duration_Seconds(jsii.Number(5)),
+		ReportBatchItemFailures: jsii.Bool(true),
+	}))
+
+	// Regularly load the batches of files whose cutoff has passed, even if files are missing.
+
+	awsevents.NewRule(stack, jsii.String("batchCutoffSchedule"), &awsevents.RuleProps{
+		Schedule: awsevents.Schedule_Rate(awscdk.Duration_Minutes(jsii.Number(15))),
+		Targets: &[]awsevents.IRuleTarget{
+			awseventstargets.NewSqsQueue(queue, nil),
+		},
+	})
+
+	// Alert on batches which had to be loaded with files missing.
+
+	incompleteBatches := awslogs.NewMetricFilter(stack, jsii.String("incompleteBatchesMetricFilter"), &awslogs.MetricFilterProps{
+		LogGroup:        dataProcessor.LogGroup(),
+		FilterPattern:   awslogs.FilterPattern_AllTerms(jsii.String("Incomplete batch")),
+		MetricNamespace: jsii.String("DataProcessor"),
+		MetricName:      jsii.String("IncompleteBatches"),
+		MetricValue:     jsii.String("1"),
+	})
+	incompleteBatches.Metric(nil).CreateAlarm(stack, jsii.String("incompleteBatchesAlarm"), &awscloudwatch.CreateAlarmOptions{
+		AlarmDescription:   jsii.String("A batch of files was loaded after its cutoff with files missing"),
+		Threshold:          jsii.Number(1),
+		EvaluationPeriods:  jsii.Number(1),
+		ComparisonOperator: awscloudwatch.ComparisonOperator_GREATER_THAN_OR_EQUAL_TO_THRESHOLD,
+		TreatMissingData:   awscloudwatch.TreatMissingData_NOT_BREACHING,
 	})
 
 	// Create s3 bucket and event notification.
 
 	s3 := awss3.NewBucket(stack, jsii.String("s3bucket"), &awss3.BucketProps{})
 
-	notification := awss3notifications.NewLambdaDestination(dataProcessor)
+	notification := awss3notifications.NewSqsDestination(queue)
 
 	s3.AddEventNotification(awss3.EventType_OBJECT_CREATED, notification)
+	s3.AddEventNotification(awss3.EventType_OBJECT_REMOVED, notification) // retracts the data loaded from the object
 
-	s3.GrantRead(dataProcessor, nil) // grant the lambda role read access to the bucket
+	s3.GrantRead(dataProcessor, nil)                        // grant the lambda role read access to the bucket
+	s3.GrantPut(dataProcessor, jsii.String("reports/*"))    // and let it write the error reports
+	s3.GrantPut(dataProcessor, jsii.String("quarantine/*")) // and the quarantined rows
 
 	// Create Dynamodb database
 
@@ -82,6 +143,16 @@ func NewDataProcessorStack(scope constructs.Construct, id string, props *DataPro
 		Description: jsii.String("s3 bucket ARN"),
 	})
 
+	// log queue URLs
+	awscdk.NewCfnOutput(stack, jsii.String("queueUrl"), &awscdk.CfnOutputProps{
+		Value:       queue.QueueUrl(),
+		Description: jsii.String("S3 notification queue URL"),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("deadLetterQueueUrl"), &awscdk.CfnOutputProps{
+		Value:       deadLetterQueue.QueueUrl(),
+		Description: jsii.String("S3 notification dead-letter queue URL"),
+	})
+
 	// log dynamodb ARN and table
 	awscdk.NewCfnOutput(stack, jsii.String("database-table-arn"),
 		&awscdk.CfnOutputProps{